@@ -25,8 +25,50 @@ type WebAPIConfiguration struct {
 		ShutdownTimeout time.Duration `conf:"default:5s"`
 	}
 	Debug bool
-	DB    struct {
+
+	// MigrateOnly applies the database migrations and exits
+	MigrateOnly bool
+	DB          struct {
+		// Driver is either sqlite3 (using Filename) or postgres (using URL)
+		Driver   string `conf:"default:sqlite3"`
 		Filename string `conf:"default:./database.db"`
+		URL      string `conf:"default:postgres://localhost/wasa?sslmode=disable"`
+	}
+	Auth struct {
+		SessionTTL time.Duration `conf:"default:720h"`
+	}
+	Media struct {
+		// Backend is either local (files in Dir) or s3 (objects in an S3-compatible bucket)
+		Backend string `conf:"default:local"`
+		Dir     string `conf:"default:webui/public/uploads"`
+		S3      struct {
+			Endpoint  string `conf:"default:http://localhost:9000"`
+			Region    string `conf:"default:us-east-1"`
+			Bucket    string `conf:"default:wasa"`
+			AccessKey string
+			SecretKey string `conf:"noprint"`
+			PathStyle bool   `conf:"default:true"`
+		}
+		// MaxPhotoSize, MaxGIFSize, MaxAudioSize and MaxFileSize are the maximum sizes in bytes of the uploaded files
+		MaxPhotoSize int64 `conf:"default:10485760"`
+		MaxGIFSize   int64 `conf:"default:15728640"`
+		MaxAudioSize int64 `conf:"default:20971520"`
+		MaxFileSize  int64 `conf:"default:26214400"`
+		// UserQuota is the maximum number of bytes each user can upload, 0 for no quota
+		UserQuota int64 `conf:"default:1073741824"`
+		// Files are the MIME types of the files that can be shared ("type/*" and "prefix.*" patterns are accepted);
+		// Deny wins over Allow, and an empty Allow allows every type
+		Files struct {
+			Allow []string `conf:"default:application/pdf;text/plain;text/csv;text/markdown;application/json;application/rtf;application/zip;application/gzip;application/x-7z-compressed;application/vnd.rar;application/msword;application/vnd.ms-excel;application/vnd.ms-powerpoint;application/vnd.openxmlformats-officedocument.*;application/vnd.oasis.opendocument.*;application/epub+zip"`
+			Deny  []string `conf:"default:application/x-msdownload;application/x-executable;application/x-mach-binary;application/x-sh;application/x-msi;application/java-archive;application/vnd.android.package-archive;text/html;image/svg+xml;application/javascript"`
+		}
+		// GC deletes the uploaded files that nothing references anymore, every Interval (0 disables it), once they
+		// are older than GracePeriod. With DryRun, they are only logged
+		GC struct {
+			Interval    time.Duration `conf:"default:1h"`
+			GracePeriod time.Duration `conf:"default:24h"`
+			DryRun      bool
+		}
 	}
 }
 
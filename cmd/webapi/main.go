@@ -19,7 +19,7 @@ Return values (exit codes):
 		The program ended due to an error
 
 Note that this program will update the schema of the database to the latest version available (embedded in the
-executable during the build).
+executable during the build). With --migrate-only, it stops after the migration, without starting the servers.
 */
 
 package main
@@ -40,10 +40,12 @@ import (
 	"syscall"
 
 	"github.com/ardanlabs/conf"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/shabdaanov1/wasa/service/api"
 	"github.com/shabdaanov1/wasa/service/database"
 	"github.com/shabdaanov1/wasa/service/globaltime"
+	"github.com/shabdaanov1/wasa/service/media"
 	"github.com/sirupsen/logrus"
 )
 
@@ -88,21 +90,59 @@ func run() error {
 
 	// Start Database
 	logger.Println("initializing database support")
-	dbconn, err := sql.Open("sqlite3", cfg.DB.Filename)
+	dataSource := cfg.DB.Filename
+	if cfg.DB.Driver == database.DriverPostgres {
+		dataSource = cfg.DB.URL
+	}
+	dbconn, err := sql.Open(cfg.DB.Driver, dataSource)
 	if err != nil {
-		logger.WithError(err).Error("error opening SQLite DB")
-		return fmt.Errorf("opening SQLite: %w", err)
+		logger.WithError(err).Error("error opening DB")
+		return fmt.Errorf("opening %s: %w", cfg.DB.Driver, err)
 	}
 	defer func() {
 		logger.Debug("database stopping")
 		_ = dbconn.Close()
 	}()
-	db, err := database.New(dbconn)
+
+	if cfg.MigrateOnly {
+		from, to, err := database.Migrate(cfg.DB.Driver, dbconn)
+		if err != nil {
+			logger.WithError(err).Error("error migrating the database")
+			return fmt.Errorf("migrating database: %w", err)
+		}
+		logger.Infof("database schema migrated from version %d to %d", from, to)
+		return nil
+	}
+
+	db, err := database.New(cfg.DB.Driver, dbconn)
 	if err != nil {
 		logger.WithError(err).Error("error creating AppDatabase")
 		return fmt.Errorf("creating AppDatabase: %w", err)
 	}
 
+	// Start the media store
+	logger.Infof("initializing %s media store", cfg.Media.Backend)
+	var store media.Store
+	switch cfg.Media.Backend {
+	case "local":
+		store, err = media.NewLocalStore(cfg.Media.Dir)
+	case "s3":
+		store, err = media.NewS3Store(media.S3Config{
+			Endpoint:  cfg.Media.S3.Endpoint,
+			Region:    cfg.Media.S3.Region,
+			Bucket:    cfg.Media.S3.Bucket,
+			AccessKey: cfg.Media.S3.AccessKey,
+			SecretKey: cfg.Media.S3.SecretKey,
+			PathStyle: cfg.Media.S3.PathStyle,
+		})
+	default:
+		err = fmt.Errorf("unknown media backend %q", cfg.Media.Backend)
+	}
+	if err != nil {
+		logger.WithError(err).Error("error creating the media store")
+		return fmt.Errorf("creating media store: %w", err)
+	}
+
 	// Start (main) API server
 	logger.Info("initializing API server")
 
@@ -117,8 +157,26 @@ func run() error {
 
 	// Create the API router
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: db,
+		Logger:     logger,
+		Database:   db,
+		Media:      store,
+		SessionTTL: cfg.Auth.SessionTTL,
+		UploadLimits: map[string]int64{
+			"photo": cfg.Media.MaxPhotoSize,
+			"gif":   cfg.Media.MaxGIFSize,
+			"audio": cfg.Media.MaxAudioSize,
+			"file":  cfg.Media.MaxFileSize,
+		},
+		FileTypes: api.FileTypes{
+			Allow: cfg.Media.Files.Allow,
+			Deny:  cfg.Media.Files.Deny,
+		},
+		UploadGC: api.UploadGC{
+			Interval:    cfg.Media.GC.Interval,
+			GracePeriod: cfg.Media.GC.GracePeriod,
+			DryRun:      cfg.Media.GC.DryRun,
+		},
+		StorageQuota: cfg.Media.UserQuota,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -1,10 +1,8 @@
 package api
 
 import (
-	"database/sql" // Import the database/sql package
-	"errors"       // Import the errors package
+	"errors" // Import the errors package
 	"net/http"
-	"strings" // Import the strings package
 
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
@@ -48,34 +46,26 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 		}
 
 		// For all other endpoints, enforce authentication
-		userID, err := rt.extractUserIDFromHeader(r)
-		if err != nil {
+		session, err := rt.authenticate(r)
+		if errors.Is(err, errUnauthorized) {
 			rt.baseLogger.WithError(err).Warn("authentication failed")
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
-		}
-
-		// Validate the user ID (token) by checking if the user exists in the database
-		_, err = rt.db.GetUserId(userID)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				rt.baseLogger.WithError(err).Warn("user not found")
-				http.Error(w, "Invalid user ID (token)", http.StatusUnauthorized)
-				return
-			}
-			rt.baseLogger.WithError(err).Error("error fetching user")
+		} else if err != nil {
+			rt.baseLogger.WithError(err).Error("error fetching session")
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
 		// Create a request-specific logger with user ID
 		ctx := &reqcontext.RequestContext{
-			ReqUUID: reqUUID,
-			UserID:  userID,
+			ReqUUID:   reqUUID,
+			UserID:    session.UserID,
+			SessionID: session.ID,
 			Logger: rt.baseLogger.WithFields(logrus.Fields{
 				"reqid":     reqUUID.String(),
 				"remote-ip": r.RemoteAddr,
-				"user":      userID,
+				"user":      session.UserID,
 			}),
 		}
 
@@ -83,18 +73,3 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 		fn(w, r, ps, ctx)
 	}
 }
-
-// extractUserIDFromHeader extracts the user ID (token) from the Authorization header
-func (rt *_router) extractUserIDFromHeader(r *http.Request) (string, error) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		return "", errors.New("unauthorized: missing authorization header")
-	}
-
-	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		return "", errors.New("unauthorized: invalid authorization format")
-	}
-
-	return parts[1], nil // ✅ Return token as user ID
-}
@@ -9,9 +9,9 @@ func (rt *_router) Handler() http.Handler {
 	// Register routes
 	rt.router.GET("/liveness", rt.liveness)         // done
 	rt.router.POST("/session", rt.wrap(rt.doLogin)) // done
-	rt.router.ServeFiles("/uploads/*filepath", http.Dir("webui/public/uploads"))
+	rt.router.GET("/uploads/*filepath", rt.serveUpload)
 
-	// rt.router.POST("/logout", rt.wrap(rt.logout))
+	rt.router.DELETE("/session", rt.wrap(rt.logout))
 	rt.router.PUT("/users/me/username", rt.wrap(rt.setMyUserName))                                      // done
 	rt.router.PUT("/users/me/photo", rt.wrap(rt.setMyPhoto))                                            // done
 	rt.router.GET("/users/:id/conversations", rt.wrap(rt.getMyConversations))                           // done
@@ -20,22 +20,59 @@ func (rt *_router) Handler() http.Handler {
 	rt.router.GET("/conversations/:c_id", rt.wrap(rt.getConversation))                                  // done
 	rt.router.DELETE("/conversations/:conversation_id/messages/:message_id", rt.wrap(rt.deleteMessage)) // done
 	rt.router.POST("/conversations/:conversation_id/messages/:message_id/forward/:target_conversation_id", rt.wrap(rt.forwardMessage))
-	rt.router.POST("/groups", rt.wrap(rt.createGroup))                               // done
-	rt.router.POST("/groups/:c_id/members", rt.wrap(rt.addToGroup))                  // done
-	rt.router.DELETE("/groups/:c_id/leave", rt.wrap(rt.leaveGroup))                  // done
-	rt.router.PUT("/groups/:c_id/name", rt.wrap(rt.setGroupName))                    // done
-	rt.router.PUT("/conversations/:c_id/set-group-photo", rt.wrap(rt.setGroupPhoto)) // done
+	rt.router.POST("/groups", rt.wrap(rt.createGroup))                                          // done
+	rt.router.POST("/groups/:c_id/members", rt.wrap(rt.addToGroup))                             // done
+	rt.router.DELETE("/groups/:c_id/leave", rt.wrap(rt.leaveGroup))                             // done
+	rt.router.PUT("/groups/:c_id/name", rt.wrap(rt.setGroupName))                               // done
+	rt.router.PUT("/conversations/:conversation_id/set-group-photo", rt.wrap(rt.setGroupPhoto)) // done
 	rt.router.POST("/conversations/:conversation_id/messages/:message_id/comments", rt.wrap(rt.commentMessage))
 	rt.router.DELETE("/conversations/:conversation_id/messages/:message_id/comments/:comment_id", rt.wrap(rt.uncommentMessage))
 	rt.router.GET("/users/:id", rt.wrap(rt.getUser)) // ✅ Add this route
 	rt.router.GET("/messages/:message_id/comments", rt.wrap(rt.getComments))
 	rt.router.GET("/search/users", rt.wrap(rt.searchUser))
+	rt.router.GET("/ws", rt.wrap(rt.streamEvents))
+	rt.router.GET("/users/:id/conversations/events", rt.wrap(rt.streamConversationList))
+	rt.router.PUT("/conversations/:conversation_id/read", rt.wrap(rt.markConversationRead))
+	rt.router.DELETE("/users/me/sessions", rt.wrap(rt.revokeOtherSessions))
+	rt.router.DELETE("/users/me/sessions/:session_id", rt.wrap(rt.revokeSession))
+	rt.router.PATCH("/conversations/:conversation_id/messages/:message_id", rt.wrap(rt.editMessage))
+	rt.router.GET("/groups/:c_id/members", rt.wrap(rt.getGroupMembers))
+	rt.router.DELETE("/groups/:c_id/members/:user_id", rt.wrap(rt.kickMember))
+	rt.router.POST("/groups/:c_id/admins/:user_id", rt.wrap(rt.promoteMember))
+	rt.router.DELETE("/groups/:c_id/admins/:user_id", rt.wrap(rt.demoteMember))
+	rt.router.GET("/groups/:c_id/permissions", rt.wrap(rt.getGroupPermissions))
+	rt.router.PUT("/groups/:c_id/permissions", rt.wrap(rt.setGroupPermissions))
+	rt.router.POST("/groups/:c_id/invites", rt.wrap(rt.createInvite))
+	rt.router.GET("/groups/:c_id/invites", rt.wrap(rt.getInvites))
+	rt.router.DELETE("/groups/:c_id/invites/:invite_id", rt.wrap(rt.revokeInvite))
+	rt.router.GET("/groups/:c_id/join-requests", rt.wrap(rt.getJoinRequests))
+	rt.router.POST("/groups/:c_id/join-requests/:user_id", rt.wrap(rt.approveJoinRequest))
+	rt.router.DELETE("/groups/:c_id/join-requests/:user_id", rt.wrap(rt.rejectJoinRequest))
+	rt.router.GET("/invites/:token", rt.wrap(rt.previewInvite))
+	rt.router.POST("/invites/:token/join", rt.wrap(rt.joinWithInvite))
+	rt.router.PUT("/conversations/:conversation_id/messages/:message_id/reactions/:emoji", rt.wrap(rt.reactToMessage))
+	rt.router.DELETE("/conversations/:conversation_id/messages/:message_id/reactions/:emoji", rt.wrap(rt.unreactToMessage))
+	rt.router.GET("/conversations/:c_id/messages/:message_id/edits", rt.wrap(rt.getMessageEdits))
+	rt.router.GET("/search/messages", rt.wrap(rt.searchMessages))
+	rt.router.GET("/conversations/:c_id/files", rt.wrap(rt.getSharedFiles))
+	rt.router.GET("/conversations/:c_id/media", rt.wrap(rt.getConversationMedia))
+	rt.router.GET("/conversations/:c_id/messages/:message_id/thread", rt.wrap(rt.getMessageThread))
 
 	// rt.router.POST("/conversations/:c_id/messages", rt.wrap(rt.sendMessage))// Send message to an existing conversation
 	// rt.router.GET("/users/:id/conversations/:c_id", rt.getConversation)
 	// :conversation
 
-	return rt.router
+	// Routes of the authenticated user that conflict with the "/users/:id/..." ones
+	rt.me.GET("/users/me/sessions", rt.wrap(rt.getMySessions))
+	rt.me.GET("/users/me/storage", rt.wrap(rt.getMyStorage))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handle, ps, _ := rt.me.Lookup(r.Method, r.URL.Path); handle != nil {
+			handle(w, r, ps)
+			return
+		}
+		rt.router.ServeHTTP(w, r)
+	})
 }
 
 // use context in every(not dologin) api
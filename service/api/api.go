@@ -11,6 +11,7 @@ Example:
 	apirouter, err := api.New(api.Config{
 		Logger:   logger,
 		Database: appdb,
+		Media:    store,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -37,11 +38,16 @@ See the `main.go` file inside the `cmd/webapi` for a full usage example.
 package api
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/shabdaanov1/wasa/service/database"
+	"github.com/shabdaanov1/wasa/service/events"
+	"github.com/shabdaanov1/wasa/service/media"
 	"github.com/sirupsen/logrus"
 )
 
@@ -52,6 +58,34 @@ type Config struct {
 
 	// Database is the instance of database.AppDatabase where data are saved
 	Database database.AppDatabase
+
+	// Media is where the uploaded files are saved
+	Media media.Store
+
+	// UploadLimits is the maximum size in bytes of the uploaded files, by message content type ("photo", "gif",
+	// "audio"). Types without a limit get defaultUploadLimit
+	UploadLimits map[string]int64
+
+	// FileTypes are the types of the files that can be shared as "file" messages
+	FileTypes FileTypes
+
+	// SessionTTL is how long a login session (and its bearer token) is valid. Defaults to 30 days
+	SessionTTL time.Duration
+
+	// UploadGC configures the deletion of the uploaded files that are not used anymore
+	UploadGC UploadGC
+
+	// StorageQuota is the maximum number of bytes each user can upload (each file counted once per user, until none of
+	// their messages, comments or photos uses it anymore). Zero means no quota
+	StorageQuota int64
+}
+
+// FileTypes lists the MIME types of the files that can be shared as "file" messages (photos, GIFs and audio files are
+// not concerned). Patterns are MIME types, "type/*", "prefix.*" (e.g., "application/vnd.oasis.opendocument.*") or
+// "*". A type is allowed if it matches Allow (or Allow is empty) and doesn't match Deny.
+type FileTypes struct {
+	Allow []string
+	Deny  []string
 }
 
 // Router is the package API interface representing an API handler builder
@@ -72,6 +106,27 @@ func New(cfg Config) (Router, error) {
 	if cfg.Database == nil {
 		return nil, errors.New("database is required")
 	}
+	if cfg.Media == nil {
+		return nil, errors.New("media store is required")
+	}
+	for contentType, limit := range cfg.UploadLimits {
+		if limit <= 0 {
+			return nil, fmt.Errorf("upload limit for %s must be positive", contentType)
+		}
+	}
+	if cfg.SessionTTL < 0 {
+		return nil, errors.New("session TTL can't be negative")
+	} else if cfg.SessionTTL == 0 {
+		cfg.SessionTTL = defaultSessionTTL
+	}
+	if cfg.StorageQuota < 0 {
+		return nil, errors.New("storage quota can't be negative")
+	}
+	if cfg.UploadGC.Interval < 0 || cfg.UploadGC.GracePeriod < 0 {
+		return nil, errors.New("upload GC interval and grace period can't be negative")
+	} else if cfg.UploadGC.GracePeriod == 0 {
+		cfg.UploadGC.GracePeriod = defaultUploadGracePeriod
+	}
 
 	// Create a new router where we will register HTTP endpoints. The server will pass requests to this router to be
 	// handled.
@@ -79,19 +134,65 @@ func New(cfg Config) (Router, error) {
 	router.RedirectTrailingSlash = false
 	router.RedirectFixedPath = false
 
-	return &_router{
-		router:     router,
-		baseLogger: cfg.Logger,
-		db:         cfg.Database,
-	}, nil
+	// The GET routes of the authenticated user can't be in router: httprouter doesn't allow "/users/me/..." next to
+	// "/users/:id/...". They are looked up first, see Handler
+	me := httprouter.New()
+
+	rt := &_router{
+		router:       router,
+		me:           me,
+		baseLogger:   cfg.Logger,
+		db:           cfg.Database,
+		media:        cfg.Media,
+		uploadLimits: cfg.UploadLimits,
+		fileTypes:    cfg.FileTypes,
+		hub:          events.NewHub(),
+		sessionTTL:   cfg.SessionTTL,
+		policy:       &accessPolicy{db: cfg.Database},
+		uploadGC:     cfg.UploadGC,
+		storageQuota: cfg.StorageQuota,
+	}
+	if cfg.UploadGC.Interval > 0 {
+		rt.startUploadGC()
+	}
+	return rt, nil
 }
 
 type _router struct {
 	router *httprouter.Router
 
+	// me holds the "/users/me/..." routes that conflict with the "/users/:id/..." routes of router
+	me *httprouter.Router
+
 	// baseLogger is a logger for non-requests contexts, like goroutines or background tasks not started by a request.
 	// Use context logger if available (e.g., in requests) instead of this logger.
 	baseLogger logrus.FieldLogger
 
 	db database.AppDatabase
+
+	// media holds the uploaded files
+	media media.Store
+
+	// uploadLimits is the maximum size of the uploaded files, by content type
+	uploadLimits map[string]int64
+
+	// fileTypes are the types of the files that can be shared
+	fileTypes FileTypes
+
+	// storageQuota is the maximum number of bytes uploaded by each user, 0 if there is no quota
+	storageQuota int64
+
+	// hub fans out real-time events (new messages, comments, ...) to the connected clients
+	hub *events.Hub
+
+	// sessionTTL is the lifetime of new login sessions
+	sessionTTL time.Duration
+
+	// policy holds the authorization rules shared by all handlers
+	policy *accessPolicy
+
+	// uploadGC configures the sweeper of the unused uploads; stopGC stops it, and gcDone is closed when it returns
+	uploadGC UploadGC
+	stopGC   context.CancelFunc
+	gcDone   chan struct{}
 }
@@ -5,29 +5,31 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"sort"
 	"strconv"
 
-	"io"
-	"os"
-	"path/filepath"
-	"strings"
-	"time"
-
 	"github.com/julienschmidt/httprouter"
 	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/database"
+	"github.com/shabdaanov1/wasa/service/events"
+	"github.com/shabdaanov1/wasa/service/globaltime"
 )
 
 func (rt *_router) getMyConversations(w http.ResponseWriter, r *http.Request, ps httprouter.Params, context *reqcontext.RequestContext) {
 	// Log the request
 	context.Logger.Info("Request received: method=%s, path=%s", r.Method, r.URL.Path)
 
-	// Retrieve user_id from the path parameters
-	userID := ps.ByName("id")
-	if userID == "" {
-		context.Logger.Error("User ID is required in the path")
-		http.Error(w, "User ID is required in the path", http.StatusBadRequest)
+	// Users can only list their own conversations
+	if err := rt.policy.self(context, ps.ByName("id")); err != nil {
+		denyAccess(w, context, err)
 		return
 	}
+	userID := context.UserID
+
+	// The client is fetching its conversations: everything sent to the user so far is delivered
+	if err := rt.db.MarkDelivered(context.UserID); err != nil {
+		context.Logger.WithError(err).Warn("Error marking messages as delivered")
+	}
 
 	// Fetch conversations from the database
 	conversations, err := rt.db.GetMyConversations_db(userID)
@@ -37,6 +39,33 @@ func (rt *_router) getMyConversations(w http.ResponseWriter, r *http.Request, ps
 		return
 	}
 
+	// System messages are JSON: show a readable preview instead
+	names := make(map[string]string)
+	for i := range conversations {
+		rt.previewLastMessage(context, &conversations[i].LastMessage, conversations[i].LastMessageType, names)
+	}
+
+	// Optionally sort the list: "recent" puts the latest activity first, "unread" puts conversations with unread
+	// messages first, then the latest activity
+	switch r.URL.Query().Get("sort") {
+	case "":
+	case "recent":
+		sort.SliceStable(conversations, func(i, j int) bool {
+			return conversations[i].LastConvo.After(conversations[j].LastConvo)
+		})
+	case "unread":
+		sort.SliceStable(conversations, func(i, j int) bool {
+			iUnread, jUnread := conversations[i].UnreadCount > 0, conversations[j].UnreadCount > 0
+			if iUnread != jUnread {
+				return iUnread
+			}
+			return conversations[i].LastConvo.After(conversations[j].LastConvo)
+		})
+	default:
+		http.Error(w, "Invalid sort parameter", http.StatusBadRequest)
+		return
+	}
+
 	// Respond with the list of conversations
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(conversations)
@@ -49,11 +78,13 @@ func (rt *_router) sendMessageFirst(w http.ResponseWriter, r *http.Request, ps h
 	// Log the request
 	context.Logger.Info("Request received: method=%s, path=%s", r.Method, r.URL.Path)
 
-	// Extract sender ID from the path
-	senderID := ps.ByName("id")
-	if senderID == "" {
-		context.Logger.Error("Sender ID is required in the path")
-		http.Error(w, "Sender ID is required in the path", http.StatusBadRequest)
+	// The sender in the path must be the authenticated user
+	if err := rt.policy.self(context, ps.ByName("id")); err != nil {
+		denyAccess(w, context, err)
+		return
+	}
+	senderID := context.UserID
+	if !rt.parseUploadForm(w, r) {
 		return
 	}
 
@@ -115,6 +146,37 @@ func (rt *_router) sendMessageFirst(w http.ResponseWriter, r *http.Request, ps h
 		return
 	}
 
+	// Handle file uploads (photo, GIF, audio or any other file). Files that can't be uploaded are rejected before the
+	// conversation is created, so that the request can be sent again
+	file, header, err := r.FormFile("file")
+	var contentType, content string
+	var up upload
+	if err == nil { // File is uploaded
+		defer file.Close()
+
+		// Save the file and get path & type
+		up, err = rt.saveUpload(r.Context(), file, header, senderID)
+		contentType, content = up.contentType, up.url
+		if err != nil {
+			writeUploadError(w, context, err)
+			return
+		}
+	} else {
+		// Parse request body for text messages
+		contentType = r.FormValue("content_type")
+		content = r.FormValue("content")
+
+		if contentType == "" || content == "" {
+			context.Logger.Error("Invalid input: content_type and content are required")
+			http.Error(w, "Invalid input: content_type and content are required", http.StatusBadRequest)
+			return
+		}
+		if !textContentType(contentType) {
+			http.Error(w, `Invalid input: content_type must be "text" or "emoji" without a file`, http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Create a new private conversation
 	newConvo, err := rt.db.CreateConversation_db(false, "", "")
 	if err != nil {
@@ -139,38 +201,19 @@ func (rt *_router) sendMessageFirst(w http.ResponseWriter, r *http.Request, ps h
 		return
 	}
 
-	// Handle file uploads (photo or GIF)
-	file, header, err := r.FormFile("file")
-	var contentType, content string
-	if err == nil { // File is uploaded
-		defer file.Close()
-
-		// Save the file and get path & type
-		contentType, content, err = rt.db.SaveUploadedFile(file, header, senderID)
-		if err != nil {
-			context.Logger.WithError(err).Error("Failed to save uploaded file")
-			http.Error(w, "Failed to save uploaded file", http.StatusInternalServerError)
-			return
-		}
-	} else {
-		// Parse request body for text messages
-		contentType = r.FormValue("content_type")
-		content = r.FormValue("content")
-
-		if contentType == "" || content == "" {
-			context.Logger.Error("Invalid input: content_type and content are required")
-			http.Error(w, "Invalid input: content_type and content are required", http.StatusBadRequest)
-			return
-		}
-	}
-
 	// Send the first message
-	err = rt.db.SendMessageWithMedia(newConvo.ID, sender.ID, contentType, content)
+	messageID, err := rt.db.SendMessageWithMedia(newConvo.ID, sender.ID, contentType, content)
 	if err != nil {
 		context.Logger.WithError(err).Error("Error sending message")
 		http.Error(w, "Error sending message", http.StatusInternalServerError)
 		return
 	}
+	if err := rt.recordSharedFile(up, newConvo.ID, &messageID, nil, sender.ID); err != nil {
+		context.Logger.WithError(err).Error("Error recording shared file")
+		http.Error(w, "Error sending message", http.StatusInternalServerError)
+		return
+	}
+	rt.publishMessage(context, newConvo.ID, messageID)
 
 	// Respond with conversation ID
 	w.WriteHeader(http.StatusCreated)
@@ -207,87 +250,55 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
 	context.Logger.Infof("Extracted sender_id: %s", senderID)
 
 	// Ensure the sender is a participant in the conversation
-	isMember, err := rt.db.IsUserInConversation(senderID, conversationID)
-	if err != nil {
-		context.Logger.WithError(err).Error("Error checking if user is in conversation")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if err := rt.policy.member(senderID, conversationID); err != nil {
+		denyAccess(w, context, err)
 		return
 	}
-	if !isMember {
-		context.Logger.Error("Sender is not part of the conversation")
-		http.Error(w, "Sender is not part of the conversation", http.StatusForbidden)
+	if !rt.parseUploadForm(w, r) {
 		return
 	}
 
 	// ----------------------------------------------------------------
 	// OPTIONALLY parse "reply_to" from form data (if user is replying)
 	// ----------------------------------------------------------------
+	// The replied message must be in this conversation, otherwise the reply would leak its content (see
+	// ReplyToContent) and break the threads
 	replyToStr := r.FormValue("reply_to")
 	var replyTo *int
 	if replyToStr != "" {
 		val, convErr := strconv.Atoi(replyToStr)
-		if convErr == nil {
-			replyTo = &val
-		} else {
-			// If invalid, we can just log a warning or ignore
-			context.Logger.WithError(convErr).Warnf("Ignoring invalid reply_to=%q", replyToStr)
+		if convErr != nil || val <= 0 {
+			http.Error(w, "Invalid reply_to", http.StatusBadRequest)
+			return
+		}
+		replyConversationID, err := rt.db.GetMessageConversationID(val)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && replyConversationID != conversationID) {
+			http.Error(w, "Invalid reply_to: the message is not in this conversation", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			context.Logger.WithError(err).Error("Error fetching replied message")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
+		replyTo = &val
 	}
 
 	// Check if a file is uploaded (photo, GIF, etc.) or if it's just text
 	var content, contentType string
+	var up upload
 	file, header, fileErr := r.FormFile("file")
 
 	if fileErr == nil { // A file is uploaded
 		defer file.Close()
 
-		// Validate file extension
-		fileExt := strings.ToLower(filepath.Ext(header.Filename))
-		allowedExts := map[string]string{
-			".jpg":  "photo",
-			".jpeg": "photo",
-			".png":  "photo",
-			".gif":  "gif",
-		}
-
-		fileType, valid := allowedExts[fileExt]
-		if !valid {
-			context.Logger.Error("Invalid file type")
-			http.Error(w, "Invalid file type", http.StatusBadRequest)
-			return
-		}
-
-		// Ensure the upload directory exists
-		uploadDir := "webui/public/uploads"
-		if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-			context.Logger.WithError(err).Error("Failed to create upload directory")
-			http.Error(w, "Failed to save file", http.StatusInternalServerError)
-			return
-		}
-
-		// Generate a unique filename
-		fileName := senderID + "_" + strconv.Itoa(int(time.Now().Unix())) + fileExt
-		filePath := filepath.Join(uploadDir, fileName)
-
-		out, err := os.Create(filePath)
-		if err != nil {
-			context.Logger.WithError(err).Error("Failed to save file")
-			http.Error(w, "Failed to save file", http.StatusInternalServerError)
-			return
-		}
-		defer out.Close()
-
-		_, err = io.Copy(out, file)
+		// Save the file in the media store; the message content is its URL
+		up, err = rt.saveUpload(r.Context(), file, header, senderID)
+		contentType, content = up.contentType, up.url
 		if err != nil {
-			context.Logger.WithError(err).Error("Failed to write file")
-			http.Error(w, "Failed to save file", http.StatusInternalServerError)
+			writeUploadError(w, context, err)
 			return
 		}
 
-		// Set message content as the uploaded file path
-		content = "/uploads/" + fileName
-		contentType = fileType
-
 	} else {
 		// Handle text message (no file)
 		content = r.FormValue("content")
@@ -298,6 +309,10 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
 			http.Error(w, "Invalid input: content and content_type are required", http.StatusBadRequest)
 			return
 		}
+		if !textContentType(contentType) {
+			http.Error(w, `Invalid input: content_type must be "text" or "emoji" without a file`, http.StatusBadRequest)
+			return
+		}
 	}
 
 	// Fetch the username and photo for the response
@@ -311,17 +326,24 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
 	// ---------------------------------------------------------------------
 	// Save message to database, passing the optional replyTo reference
 	// ---------------------------------------------------------------------
-	err = rt.db.SendMessageWithType(conversationID, senderID, content, contentType, replyTo)
+	messageID, err := rt.db.SendMessageWithType(conversationID, senderID, content, contentType, replyTo)
 	if err != nil {
 		context.Logger.WithError(err).Error("Error saving message")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if err := rt.recordSharedFile(up, conversationID, &messageID, nil, senderID); err != nil {
+		context.Logger.WithError(err).Error("Error recording shared file")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rt.publishMessage(context, conversationID, messageID)
 
 	// Return JSON response with some data about the message
 	w.WriteHeader(http.StatusCreated)
 	err = json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":         "Message sent successfully",
+		"message_id":      messageID,
 		"content_type":    contentType,
 		"content":         content,
 		"sender_username": user.Username,
@@ -333,6 +355,14 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
 	}
 }
 
+const (
+	// defaultMessagePageSize is the number of messages returned by getConversation if no limit is specified
+	defaultMessagePageSize = 50
+
+	// maxMessagePageSize is the maximum number of messages returned by getConversation
+	maxMessagePageSize = 200
+)
+
 func (rt *_router) getConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params, context *reqcontext.RequestContext) {
 	// Extract conversation ID from the path parameters
 	conversationID, err := strconv.Atoi(ps.ByName("c_id"))
@@ -343,6 +373,12 @@ func (rt *_router) getConversation(w http.ResponseWriter, r *http.Request, ps ht
 		return
 	}
 
+	// Only members can read the conversation
+	if err := rt.policy.member(context.UserID, conversationID); err != nil {
+		denyAccess(w, context, err)
+		return
+	}
+
 	// Fetch the conversation details
 	conversation, err := rt.db.GetConversationById(conversationID)
 	if err != nil {
@@ -358,26 +394,80 @@ func (rt *_router) getConversation(w http.ResponseWriter, r *http.Request, ps ht
 		return
 	}
 
-	// Fetch all messages in the conversation
-	messages, err := rt.db.GetMessagesByConversationId(conversationID)
+	// Parse the pagination parameters: "before" and "after" are message IDs, and at most one can be given
+	query := r.URL.Query()
+	var before, after int
+	limit := defaultMessagePageSize
+	for name, dest := range map[string]*int{"before": &before, "after": &after, "limit": &limit} {
+		if value := query.Get(name); value != "" {
+			*dest, err = strconv.Atoi(value)
+			if err != nil || *dest <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": "Invalid " + name + " parameter"})
+				return
+			}
+		}
+	}
+	if before > 0 && after > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Only one of before and after can be specified"})
+		return
+	}
+	if limit > maxMessagePageSize {
+		limit = maxMessagePageSize
+	}
+
+	// The cursor must be a message of this conversation
+	if cursor := before + after; cursor > 0 {
+		cursorConversationID, err := rt.db.GetMessageConversationID(cursor)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			context.Logger.WithError(err).Error("Failed to fetch cursor message")
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch messages"})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) || cursorConversationID != conversationID {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "Invalid cursor"})
+			return
+		}
+	}
+
+	if err := rt.db.MarkDelivered(context.UserID); err != nil {
+		context.Logger.WithError(err).Warn("Error marking messages as delivered")
+	}
+
+	// Fetch a page of messages in the conversation
+	page, err := rt.db.GetMessagesPage(conversationID, before, after, limit, context.UserID)
 	if err != nil {
 		context.Logger.WithError(err).Error("Failed to fetch messages")
 		w.WriteHeader(http.StatusInternalServerError)
 		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch messages"})
 		return
 	}
+	messages := page.Messages
 
 	// Ensure each message has a valid sender_photo, otherwise use default
-	for i, message := range messages {
-		if !message.SenderPhoto.Valid || message.SenderPhoto.String == "" {
-			messages[i].SenderPhoto.String = "/default-profile.png" // Set to default profile image
-		}
+	for i := range messages {
+		setDefaultSenderPhoto(&messages[i])
 	}
 
-	// Prepare the response
+	// Prepare the response. prev_cursor is the value of "before" to load older messages, next_cursor the value of
+	// "after" to load newer ones; they are null when there is nothing more to load.
+	var prevCursor, nextCursor *int
+	if len(messages) > 0 {
+		if page.HasOlder {
+			prevCursor = &messages[0].ID
+		}
+		if page.HasNewer {
+			nextCursor = &messages[len(messages)-1].ID
+		}
+	}
 	response := map[string]interface{}{
 		"conversation": conversation,
 		"messages":     messages,
+		"prev_cursor":  prevCursor,
+		"next_cursor":  nextCursor,
 	}
 
 	// Respond with the conversation and messages
@@ -419,21 +509,26 @@ func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
-	// ✅ Ensure the message exists
-	exists, err := rt.db.DoesMessageExist(messageID)
+	// ✅ Ensure the message exists in this conversation, and that the user sent it
+	if err := rt.policy.messageOwner(userID, conversationID, messageID); err != nil {
+		denyAccess(w, context, err)
+		return
+	}
+
+	// System messages are the history of the group: their actor can't delete them
+	message, err := rt.db.GetMessageByID(messageID, userID)
 	if err != nil {
-		context.Logger.WithError(err).Error("Error checking message existence")
+		context.Logger.WithError(err).Error("Error fetching message")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	if !exists {
-		context.Logger.Error("Message not found")
-		http.Error(w, "Message not found", http.StatusNotFound)
+	if message.ContentType == contentTypeSystem {
+		http.Error(w, "System messages can't be deleted", http.StatusBadRequest)
 		return
 	}
 
 	// ✅ Convert comments to normal messages before deleting
-	err = rt.db.ConvertCommentsToMessages(messageID, conversationID)
+	convertedIDs, err := rt.db.ConvertCommentsToMessages(messageID, conversationID)
 	if err != nil {
 		context.Logger.WithError(err).Error("Error converting comments to messages")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -448,6 +543,16 @@ func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
+	rt.publish(context, events.Event{
+		Type:           events.MessageDeleted,
+		ConversationID: conversationID,
+		Payload:        map[string]int{"message_id": messageID},
+	})
+	for _, convertedID := range convertedIDs {
+		rt.publishMessage(context, conversationID, convertedID)
+	}
+	rt.publishConversationUpdate(context, conversationID)
+
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(map[string]string{
 		"message": "Message deleted successfully, comments converted to normal messages",
@@ -487,6 +592,25 @@ func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps htt
 		return
 	}
 
+	// The message must be in the source conversation, and the user must be a member of it. This is checked before
+	// resolving the target, which may create a new conversation.
+	if err := rt.policy.message(userID, sourceConversationID, messageID); err != nil {
+		denyAccess(w, context, err)
+		return
+	}
+
+	// System messages only make sense in the group they describe
+	message, err := rt.db.GetMessageByID(messageID, userID)
+	if err != nil {
+		context.Logger.WithError(err).Error("Error fetching message")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if message.ContentType == contentTypeSystem {
+		http.Error(w, "System messages can't be forwarded", http.StatusBadRequest)
+		return
+	}
+
 	if targetConversationIDStr == "new" {
 		// Forward to a new conversation using a target name (which can be a group or a user).
 		var input struct {
@@ -511,18 +635,7 @@ func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps htt
 			return
 		}
 		if groupConv.ID != 0 {
-			// Found a group conversation. Verify membership.
-			isMember, err := rt.db.IsUserInConversation(userID, groupConv.ID)
-			if err != nil {
-				context.Logger.WithError(err).Error("Error checking membership in target group")
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-			if !isMember {
-				context.Logger.Error("User is not part of the target group")
-				http.Error(w, "User is not part of the target group", http.StatusForbidden)
-				return
-			}
+			// Found a group conversation (membership is verified below)
 			context.Logger.Info("Forwarding to group with conversation ID:", groupConv.ID)
 			targetConversationID = groupConv.ID
 		} else {
@@ -589,77 +702,26 @@ func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps htt
 		}
 	}
 
-	// Step 4: Validate membership.
-	// Check that the user is part of the source conversation.
-	isMemberSource, err := rt.db.IsUserInConversation(userID, sourceConversationID)
-	if err != nil {
-		context.Logger.WithError(err).Error("Error checking membership in source conversation")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-	if !isMemberSource {
-		context.Logger.Error("User is not part of the source conversation")
-		http.Error(w, "User is not part of the source conversation", http.StatusForbidden)
-		return
-	}
-	// For target conversation:
-	// If it is a group, check that the user is a member.
-	isGroup, err := rt.db.IsConversationGroup(targetConversationID)
-	if err != nil {
-		context.Logger.WithError(err).Error("Error checking conversation type")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-	if isGroup {
-		isMemberTarget, err := rt.db.IsUserInConversation(userID, targetConversationID)
-		if err != nil {
-			context.Logger.WithError(err).Error("Error checking membership in target group conversation")
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-		if !isMemberTarget {
-			context.Logger.Error("User is not part of the target group conversation")
-			http.Error(w, "User is not part of the target group conversation", http.StatusForbidden)
-			return
-		}
-	} else {
-		// For one-on-one conversations, ensure that the forwarding user is a member.
-		isMemberTarget, err := rt.db.IsUserInConversation(userID, targetConversationID)
-		if err != nil {
-			context.Logger.WithError(err).Error("Error checking membership in target conversation")
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-		if !isMemberTarget {
-			context.Logger.Error("User is not part of the target conversation")
-			http.Error(w, "User is not part of the target conversation", http.StatusForbidden)
-			return
-		}
-	}
-
-	// Step 5: Retrieve the message content from the source conversation.
-	messageContent, err := rt.db.GetMessageContent(messageID)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			context.Logger.WithError(err).Error("Message not found")
-			http.Error(w, "Message not found", http.StatusNotFound)
-			return
-		}
-		context.Logger.WithError(err).Error("Error fetching message content")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	// Step 4: Validate access to the target conversation.
+	if err := rt.policy.member(userID, targetConversationID); err != nil {
+		denyAccess(w, context, err)
 		return
 	}
 
-	// Step 6: Forward the message.
+	// Step 5: Forward the message, with its content type (and its file, if any).
 	// The new message will be created with sender = userID (i.e. the forwarding user).
-	err = rt.db.ForwardMessage(targetConversationID, userID, messageContent)
-	if err != nil {
+	forwardedID, err := rt.db.ForwardMessage(messageID, targetConversationID, userID, globaltime.Now().UTC())
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		context.Logger.WithError(err).Error("Error forwarding message")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	rt.publishMessage(context, targetConversationID, forwardedID)
 
-	// Step 7: Respond with success.
+	// Step 6: Respond with success.
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(map[string]string{
 		"message": "Message forwarded successfully",
@@ -674,10 +736,8 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 		return
 	}
 
-	// Parse the incoming form data (10MB limit)
-	err := r.ParseMultipartForm(10 << 20)
-	if err != nil {
-		http.Error(w, "Error parsing form", http.StatusBadRequest)
+	// Parse the incoming form data (with the photo, if any)
+	if !rt.parseUploadForm(w, r) {
 		return
 	}
 
@@ -687,7 +747,7 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 	// Parse usernames from JSON string
 	var usernames []string
 	if usernamesRaw != "" {
-		err = json.Unmarshal([]byte(usernamesRaw), &usernames)
+		err := json.Unmarshal([]byte(usernamesRaw), &usernames)
 		if err != nil {
 			http.Error(w, "Invalid usernames format", http.StatusBadRequest)
 			return
@@ -701,15 +761,16 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 
 	// Handle the uploaded photo
 	var photoPath string
-	photoFile, _, err := r.FormFile("photo") // Get the uploaded file
+	photoFile, photoHeader, err := r.FormFile("photo") // Get the uploaded file
 	if err == nil {
-		// Save the photo to disk and get the file path
-		_, filePath, saveErr := rt.db.SaveUploadedFile(photoFile, r.MultipartForm.File["photo"][0], creatorID)
-		if saveErr != nil {
-			http.Error(w, "Error saving photo", http.StatusInternalServerError)
+		defer photoFile.Close()
+
+		// Save the photo in the media store and get its URL
+		photoPath, err = rt.savePhoto(r.Context(), photoFile, photoHeader, creatorID)
+		if err != nil {
+			writeUploadError(w, context, err)
 			return
 		}
-		photoPath = filePath
 	}
 
 	// Step 1: Create a new group conversation
@@ -719,14 +780,18 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 		return
 	}
 
-	// Step 2: Add the creator to the group
+	// Step 2: Add the creator to the group, as its owner
 	err = rt.db.AddUsersToConversation(creatorID, newGroup.ID)
+	if err == nil {
+		_, err = rt.db.SetMemberRole(creatorID, newGroup.ID, database.RoleOwner)
+	}
 	if err != nil {
 		http.Error(w, "Error adding creator to group", http.StatusInternalServerError)
 		return
 	}
 
 	// Step 3: Fetch user IDs for given usernames and add them to the group
+	var memberIDs []string
 	for _, username := range usernames {
 		user, err := rt.db.GetUser(username)
 		if err != nil {
@@ -743,7 +808,14 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 			http.Error(w, "Error adding user "+username+" to group", http.StatusInternalServerError)
 			return
 		}
+		memberIDs = append(memberIDs, user.ID)
 	}
+	rt.postSystemMessage(context, newGroup.ID, systemMessage{
+		Actor:    creatorID,
+		Action:   systemCreated,
+		Targets:  memberIDs,
+		NewValue: groupName,
+	})
 
 	// Step 4: Respond with success, group details, and members
 	w.WriteHeader(http.StatusCreated)
@@ -783,19 +855,23 @@ func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
-	// Check if the requester is part of the group
-	isMember, err := rt.db.IsUserInConversation(requesterID, conversationID)
+	// Check if the requester is allowed to add members to the group
+	isGroup, err := rt.db.IsConversationGroup(conversationID)
 	if err != nil {
-		http.Error(w, "Error checking membership", http.StatusInternalServerError)
+		http.Error(w, "Error checking group type", http.StatusInternalServerError)
+		return
+	}
+	if !isGroup {
+		http.Error(w, "This conversation is not a group", http.StatusBadRequest)
 		return
 	}
-	if !isMember {
-		http.Error(w, "You must be a member of the group to add others", http.StatusForbidden)
+	if err := rt.policy.groupChange(requesterID, conversationID, groupAddMembers); err != nil {
+		denyAccess(w, context, err)
 		return
 	}
 
 	// Retrieve user IDs for each provided username
-	var addedUsers []string
+	var addedUsers, addedIDs []string
 	for _, username := range input.Usernames {
 		user, err := rt.db.GetUser(username)
 		if err != nil {
@@ -826,6 +902,14 @@ func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprou
 
 		// Add to the response list
 		addedUsers = append(addedUsers, username)
+		addedIDs = append(addedIDs, user.ID)
+	}
+	if len(addedIDs) > 0 {
+		rt.postSystemMessage(context, conversationID, systemMessage{
+			Actor:   requesterID,
+			Action:  systemAdded,
+			Targets: addedIDs,
+		})
 	}
 
 	// Respond with success and list of added users
@@ -860,22 +944,32 @@ func (rt *_router) leaveGroup(w http.ResponseWriter, r *http.Request, ps httprou
 	}
 
 	// ✅ Check if the user is a member of the group
-	isMember, err := rt.db.IsUserInConversation(userID, groupID)
-	if err != nil {
-		http.Error(w, "Error checking user membership", http.StatusInternalServerError)
-		return
-	}
-	if !isMember {
-		http.Error(w, "User is not part of this group", http.StatusForbidden)
+	if err := rt.policy.member(userID, groupID); err != nil {
+		denyAccess(w, ctx, err)
 		return
 	}
 
-	// ✅ Remove the user from the group
-	err = rt.db.RemoveUserFromGroup(userID, groupID)
+	// ✅ Remove the user from the group. If they were the last owner, someone else takes over
+	newOwnerID, err := rt.db.RemoveGroupMember(userID, groupID)
 	if err != nil {
 		http.Error(w, "Error leaving the group", http.StatusInternalServerError)
 		return
 	}
+	// The other devices of the user are told as well, so that they can drop the conversation
+	ev := events.Event{
+		Type:           events.MemberRemoved,
+		ConversationID: groupID,
+		Payload:        memberEvent{UserID: userID},
+	}
+	rt.publish(ctx, ev)
+	rt.hub.Publish([]string{userID}, ev)
+	if newOwnerID != "" {
+		rt.publish(ctx, events.Event{
+			Type:           events.MemberRoleChanged,
+			ConversationID: groupID,
+			Payload:        memberEvent{UserID: newOwnerID, Role: database.RoleOwner},
+		})
+	}
 
 	// ✅ Check if the group is now empty
 	remainingMembers, err := rt.db.GetGroupMemberCount(groupID)
@@ -891,6 +985,16 @@ func (rt *_router) leaveGroup(w http.ResponseWriter, r *http.Request, ps httprou
 			http.Error(w, "Error deleting empty group", http.StatusInternalServerError)
 			return
 		}
+	} else {
+		rt.postSystemMessage(ctx, groupID, systemMessage{Actor: userID, Action: systemLeft})
+		if newOwnerID != "" {
+			rt.postSystemMessage(ctx, groupID, systemMessage{
+				Actor:    userID,
+				Action:   systemRoleChanged,
+				Targets:  []string{newOwnerID},
+				NewValue: database.RoleOwner,
+			})
+		}
 	}
 
 	// ✅ Respond with success
@@ -934,14 +1038,9 @@ func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httpr
 		return
 	}
 
-	// ✅ Check if the user is a member of the group
-	isMember, err := rt.db.IsUserInConversation(userID, groupID)
-	if err != nil {
-		http.Error(w, "Error checking user membership", http.StatusInternalServerError)
-		return
-	}
-	if !isMember {
-		http.Error(w, "User is not part of this group", http.StatusForbidden)
+	// ✅ Check if the user is allowed to rename the group
+	if err := rt.policy.groupChange(userID, groupID, groupRename); err != nil {
+		denyAccess(w, context, err)
 		return
 	}
 
@@ -956,6 +1055,12 @@ func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httpr
 		return
 	}
 
+	oldName, err := rt.db.GetGroupNameById(groupID)
+	if err != nil {
+		http.Error(w, "Error fetching group name", http.StatusInternalServerError)
+		return
+	}
+
 	// ✅ Update the group name
 	err = rt.db.UpdateGroupName(groupID, input.NewName)
 	if err != nil {
@@ -963,6 +1068,18 @@ func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httpr
 		return
 	}
 
+	rt.publish(context, events.Event{
+		Type:           events.GroupRenamed,
+		ConversationID: groupID,
+		Payload:        map[string]string{"name": input.NewName},
+	})
+	rt.postSystemMessage(context, groupID, systemMessage{
+		Actor:    userID,
+		Action:   systemRenamed,
+		OldValue: oldName,
+		NewValue: input.NewName,
+	})
+
 	// ✅ Respond with success
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(map[string]string{
@@ -981,7 +1098,7 @@ func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps http
 	}
 
 	// Extract group (conversation) ID
-	groupIDStr := ps.ByName("c_id")
+	groupIDStr := ps.ByName("conversation_id")
 	groupID, err := strconv.Atoi(groupIDStr)
 	if err != nil || groupID <= 0 {
 		http.Error(w, "Invalid group ID", http.StatusBadRequest)
@@ -999,18 +1116,16 @@ func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
-	// Check if the user is a member of the group
-	isMember, err := rt.db.IsUserInConversation(userID, groupID)
-	if err != nil {
-		http.Error(w, "Error checking user membership", http.StatusInternalServerError)
-		return
-	}
-	if !isMember {
-		http.Error(w, "User is not part of this group", http.StatusForbidden)
+	// Check if the user is allowed to change the group photo
+	if err := rt.policy.groupChange(userID, groupID, groupChangePhoto); err != nil {
+		denyAccess(w, ctx, err)
 		return
 	}
 
 	// Parse the uploaded file
+	if !rt.parseUploadForm(w, r) {
+		return
+	}
 	file, header, err := r.FormFile("photo")
 	if err != nil {
 		http.Error(w, "Invalid file upload", http.StatusBadRequest)
@@ -1018,49 +1133,20 @@ func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps http
 	}
 	defer file.Close()
 
-	// Validate the file extension
-	fileExt := strings.ToLower(filepath.Ext(header.Filename))
-	allowedExts := map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true}
-	if !allowedExts[fileExt] {
-		http.Error(w, "Invalid file type", http.StatusBadRequest)
-		return
-	}
-
-	// Ensure upload directory exists
-	uploadDir := "webui/public/uploads"
-	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to create upload directory")
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
-	}
-
-	// Generate new filename using the group ID
-	fileName := "group_" + strconv.Itoa(groupID) + fileExt
-	filePath := filepath.Join(uploadDir, fileName)
-
-	// Save the file
-	out, err := os.Create(filePath)
-	if err != nil {
-		http.Error(w, "Failed to save image", http.StatusInternalServerError)
-		return
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, file)
+	// Save the photo in the media store
+	photoURL, err := rt.savePhoto(r.Context(), file, header, userID)
 	if err != nil {
-		http.Error(w, "Failed to save image", http.StatusInternalServerError)
+		writeUploadError(w, ctx, err)
 		return
 	}
 
-	// Generate the correct photo URL for the frontend
-	photoURL := "/uploads/" + fileName
-
 	// Update the group's profile photo in the database
 	err = rt.db.UpdateGroupPhoto(groupID, photoURL)
 	if err != nil {
 		http.Error(w, "Failed to update group photo", http.StatusInternalServerError)
 		return
 	}
+	rt.postSystemMessage(ctx, groupID, systemMessage{Actor: userID, Action: systemPhotoChanged, NewValue: photoURL})
 
 	// ✅ Respond with the updated group photo URL
 	w.WriteHeader(http.StatusOK)
@@ -1095,63 +1181,42 @@ func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps htt
 	}
 
 	// Check if the user is a member of the conversation
-	isMember, err := rt.db.IsUserInConversation(userID, conversationID)
-	if err != nil {
-		http.Error(w, "Error checking user membership", http.StatusInternalServerError)
+	if err := rt.policy.member(userID, conversationID); err != nil {
+		denyAccess(w, context, err)
 		return
 	}
-	if !isMember {
-		http.Error(w, "User is not part of this conversation", http.StatusForbidden)
+
+	// ✅ Check if the commented message still exists. An existing message must belong to this conversation. This is done
+	// before saving the file, so that requests that are denied don't store anything
+	exists, err := rt.db.DoesMessageExist(messageID)
+	if err != nil {
+		http.Error(w, "Error checking message existence", http.StatusInternalServerError)
 		return
 	}
+	if exists {
+		if err := rt.policy.message(userID, conversationID, messageID); err != nil {
+			denyAccess(w, context, err)
+			return
+		}
+	}
 
-	// Handle file uploads (photo or GIF)
+	// Handle file uploads (photo, GIF, audio or any other file)
+	if !rt.parseUploadForm(w, r) {
+		return
+	}
 	file, header, err := r.FormFile("file")
 	var contentType, content string
+	var up upload
 	if err == nil { // File is uploaded
 		defer file.Close()
 
-		// Validate file type
-		fileExt := strings.ToLower(filepath.Ext(header.Filename))
-		allowedExts := map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true}
-		if !allowedExts[fileExt] {
-			http.Error(w, "Invalid file type", http.StatusBadRequest)
-			return
-		}
-
-		// Ensure uploads directory exists
-		uploadDir := "webui/public/uploads"
-		if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-			context.Logger.WithError(err).Error("Failed to create upload directory")
-			http.Error(w, "Failed to save file", http.StatusInternalServerError)
-			return
-		}
-
-		// Generate unique filename
-		fileName := userID + "_" + strconv.Itoa(messageID) + fileExt
-		filePath := filepath.Join(uploadDir, fileName)
-
-		// Save file
-		out, err := os.Create(filePath)
+		// Save the file in the media store; the comment content is its URL
+		up, err = rt.saveUpload(r.Context(), file, header, userID)
+		contentType, content = up.contentType, up.url
 		if err != nil {
-			http.Error(w, "Failed to save file", http.StatusInternalServerError)
+			writeUploadError(w, context, err)
 			return
 		}
-		defer out.Close()
-
-		_, err = io.Copy(out, file)
-		if err != nil {
-			http.Error(w, "Failed to save file", http.StatusInternalServerError)
-			return
-		}
-
-		// Set contentType and content for DB
-		if fileExt == ".gif" {
-			contentType = "gif"
-		} else {
-			contentType = "photo"
-		}
-		content = "/uploads/" + fileName // ✅ Store relative file path
 	} else {
 		// Parse request body for text or emoji comment
 		var input struct {
@@ -1163,24 +1228,27 @@ func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps htt
 			http.Error(w, "Invalid input: content_type and content are required", http.StatusBadRequest)
 			return
 		}
+		if !textContentType(input.ContentType) {
+			http.Error(w, `Invalid input: content_type must be "text" or "emoji" without a file`, http.StatusBadRequest)
+			return
+		}
 		contentType = input.ContentType
 		content = input.Content
 	}
 
-	// ✅ Check if the commented message still exists
-	exists, err := rt.db.DoesMessageExist(messageID)
-	if err != nil {
-		http.Error(w, "Error checking message existence", http.StatusInternalServerError)
-		return
-	}
-
 	// ✅ If message is deleted, comment becomes a normal message
 	if !exists {
-		err = rt.db.SendMessageFull(conversationID, userID, content)
+		newMessageID, err := rt.db.SendMessageWithType(conversationID, userID, content, contentType, nil)
 		if err != nil {
 			http.Error(w, "Error sending message", http.StatusInternalServerError)
 			return
 		}
+		if err := rt.recordSharedFile(up, conversationID, &newMessageID, nil, userID); err != nil {
+			context.Logger.WithError(err).Error("Error recording shared file")
+			http.Error(w, "Error sending message", http.StatusInternalServerError)
+			return
+		}
+		rt.publishMessage(context, conversationID, newMessageID)
 
 		w.WriteHeader(http.StatusCreated)
 		_ = json.NewEncoder(w).Encode(map[string]string{
@@ -1190,17 +1258,34 @@ func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps htt
 	}
 
 	// ✅ If message exists, add a comment linked to the message
-	err = rt.db.CommentOnMessage(messageID, userID, contentType, content)
+	commentID, err := rt.db.CommentOnMessage(messageID, userID, contentType, content)
 	if err != nil {
 		http.Error(w, "Error commenting on message", http.StatusInternalServerError)
 		return
 	}
+	if err := rt.recordSharedFile(up, conversationID, nil, &commentID, userID); err != nil {
+		context.Logger.WithError(err).Error("Error recording shared file")
+		http.Error(w, "Error commenting on message", http.StatusInternalServerError)
+		return
+	}
+
+	comment, err := rt.db.GetCommentByID(commentID)
+	if err != nil {
+		context.Logger.WithError(err).Warn("can't load comment for event")
+	} else {
+		rt.publish(context, events.Event{
+			Type:           events.CommentAdded,
+			ConversationID: conversationID,
+			Payload:        comment,
+		})
+	}
 
 	// ✅ Respond with success
 	w.WriteHeader(http.StatusCreated)
 	_ = json.NewEncoder(w).Encode(map[string]string{
 		"message":      "Comment added successfully",
 		"message_id":   strconv.Itoa(messageID),
+		"comment_id":   strconv.Itoa(commentID),
 		"content_type": contentType,
 		"content":      content,
 	})
@@ -1228,35 +1313,25 @@ func (rt *_router) uncommentMessage(w http.ResponseWriter, r *http.Request, ps h
 		return
 	}
 
-	// ✅ Check if the user is a member of the conversation
-	isMember, err := rt.db.IsUserInConversation(userID, conversationID)
-	if err != nil {
-		http.Error(w, "Error checking user membership", http.StatusInternalServerError)
-		return
-	}
-	if !isMember {
-		http.Error(w, "User is not part of this conversation", http.StatusForbidden)
-		return
-	}
-
-	// ✅ Check if the user is the owner of the comment
-	isOwner, err := rt.db.IsCommentOwner(userID, commentID)
-	if err != nil {
-		http.Error(w, "Error checking comment ownership", http.StatusInternalServerError)
-		return
-	}
-	if !isOwner {
-		http.Error(w, "User does not own this comment", http.StatusForbidden)
+	// ✅ Check that the comment is on a message of this conversation, and that the user owns it
+	if err := rt.policy.commentOwner(userID, conversationID, messageID, commentID); err != nil {
+		denyAccess(w, context, err)
 		return
 	}
 
 	// ✅ Delete the comment
-	err = rt.db.DeleteComment(commentID)
+	err := rt.db.DeleteComment(commentID)
 	if err != nil {
 		http.Error(w, "Error deleting comment", http.StatusInternalServerError)
 		return
 	}
 
+	rt.publish(context, events.Event{
+		Type:           events.CommentRemoved,
+		ConversationID: conversationID,
+		Payload:        map[string]int{"message_id": messageID, "comment_id": commentID},
+	})
+
 	// ✅ Respond with success
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(map[string]string{
@@ -1272,10 +1347,16 @@ func (rt *_router) getComments(w http.ResponseWriter, r *http.Request, ps httpro
 		return
 	}
 
+	// Only members of the conversation of the message can read its comments
+	if _, err := rt.policy.messageByID(context.UserID, messageID); err != nil {
+		denyAccess(w, context, err)
+		return
+	}
+
 	comments, err := rt.db.GetCommentsByMessageID(messageID)
 	if err != nil {
 		context.Logger.WithError(err).Error("Error retrieving comments")
-		// Optionally, write out the error in plain text to help debugging (remove in production)
+		http.Error(w, "Error retrieving comments", http.StatusInternalServerError)
 		return
 	}
 
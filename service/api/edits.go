@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/events"
+	"github.com/shabdaanov1/wasa/service/globaltime"
+)
+
+// editMessage replaces the content of a text message. Only the sender can edit a message; the previous content is
+// kept in the edit history (see getMessageEdits).
+func (rt *_router) editMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	conversationID, err := strconv.Atoi(ps.ByName("conversation_id"))
+	if err != nil || conversationID <= 0 {
+		http.Error(w, "Invalid conversation ID", http.StatusBadRequest)
+		return
+	}
+	messageID, err := strconv.Atoi(ps.ByName("message_id"))
+	if err != nil || messageID <= 0 {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	var input struct {
+		Content string `json:"content"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&input)
+	if err != nil || strings.TrimSpace(input.Content) == "" {
+		http.Error(w, "Invalid input: content is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := rt.policy.messageOwner(ctx.UserID, conversationID, messageID); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	message, err := rt.db.GetMessageByID(messageID, ctx.UserID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching message")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if message.ContentType != "text" {
+		http.Error(w, "Only text messages can be edited", http.StatusBadRequest)
+		return
+	}
+
+	// Nothing to do if the content is the same: don't add an entry to the history
+	if input.Content != message.Content {
+		err = rt.db.EditMessage(messageID, input.Content, globaltime.Now().UTC())
+		if err != nil {
+			ctx.Logger.WithError(err).Error("Error editing message")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		message, err = rt.db.GetMessageByID(messageID, ctx.UserID)
+		if err != nil {
+			ctx.Logger.WithError(err).Error("Error fetching edited message")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		rt.publish(ctx, events.Event{
+			Type:           events.MessageEdited,
+			ConversationID: conversationID,
+			Payload:        broadcastMessage(message),
+		})
+		rt.publishConversationUpdate(ctx, conversationID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Message edited successfully",
+		"edited_message": message,
+	})
+}
+
+// getMessageEdits returns the edit history of a message: the previous versions of its content, the oldest first.
+func (rt *_router) getMessageEdits(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	conversationID, err := strconv.Atoi(ps.ByName("c_id"))
+	if err != nil || conversationID <= 0 {
+		http.Error(w, "Invalid conversation ID", http.StatusBadRequest)
+		return
+	}
+	messageID, err := strconv.Atoi(ps.ByName("message_id"))
+	if err != nil || messageID <= 0 {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := rt.policy.message(ctx.UserID, conversationID, messageID); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	edits, err := rt.db.GetMessageEdits(messageID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching edit history")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(edits)
+}
@@ -0,0 +1,265 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/database"
+	"github.com/shabdaanov1/wasa/service/events"
+)
+
+const (
+	// wsWriteWait is the time allowed to write a single frame to the client
+	wsWriteWait = 10 * time.Second
+
+	// wsPongWait is the time allowed to read the next pong from the client
+	wsPongWait = 60 * time.Second
+
+	// wsPingPeriod is how often pings are sent. Must be less than wsPongWait
+	wsPingPeriod = (wsPongWait * 9) / 10
+
+	// sseKeepAlive is how often a comment line is sent on idle event streams, so that proxies keep them open
+	sseKeepAlive = 30 * time.Second
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// The CORS policy of this server allows any origin (see cmd/webapi/cors.go), do the same for WebSockets
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// streamEvents upgrades the connection to a WebSocket and pushes every event of the conversations the authenticated
+// user belongs to, as JSON text frames. Messages sent by the client are ignored.
+func (rt *_router) streamEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied to the client
+		ctx.Logger.WithError(err).Warn("WebSocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	sub := rt.hub.Subscribe(ctx.UserID)
+	defer sub.Close()
+
+	// Read pump: we don't expect anything from the client, but we need to read to process control frames (pong,
+	// close) and to notice when the client goes away.
+	done := make(chan struct{})
+	conn.SetReadLimit(512)
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				// The hub is shutting down, or we were too slow: the client should reconnect
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			if err := conn.WriteJSON(ev); err != nil {
+				ctx.Logger.WithError(err).Debug("error writing WebSocket event")
+				return
+			}
+		case <-ticker.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// streamConversationList sends the updates to the list returned by getMyConversations as Server-Sent Events. Each
+// "conversation.updated" event carries the new last message and last activity time of one conversation.
+//
+// A client that reconnects with a Last-Event-ID header (or a lastEventId query parameter) receives the events it
+// missed. If the server can't tell what was missed (e.g., after a restart), it sends the current state of every
+// conversation instead.
+func (rt *_router) streamConversationList(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	if err := rt.policy.self(ctx, ps.ByName("id")); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		var err error
+		lastID, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sub, missed, complete, currentID := rt.hub.SubscribeFrom(ctx.UserID, lastID)
+	defer sub.Close()
+
+	// The stream is long-lived: disable the server write timeout for this response
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if lastEventID == "" || !complete {
+		// New client, or we lost track of it: send the current state
+		conversations, err := rt.db.GetMyConversations_db(ctx.UserID)
+		if err != nil {
+			ctx.Logger.WithError(err).Error("Error fetching conversations for the event stream")
+			return
+		}
+		names := make(map[string]string)
+		for _, convo := range conversations {
+			rt.previewLastMessage(ctx, &convo.LastMessage, convo.LastMessageType, names)
+			err = writeSSE(w, events.Event{
+				ID:             currentID,
+				Type:           events.ConversationUpdated,
+				ConversationID: convo.ID,
+				Payload: database.ConversationSummary{
+					ConversationID:  convo.ID,
+					LastMessage:     convo.LastMessage,
+					LastMessageType: convo.LastMessageType,
+					LastConvo:       convo.LastConvo,
+				},
+			})
+			if err != nil {
+				return
+			}
+		}
+	} else {
+		for _, ev := range missed {
+			if ev.Type != events.ConversationUpdated {
+				continue
+			}
+			if err := writeSSE(w, ev); err != nil {
+				return
+			}
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				// The hub is shutting down, or we were too slow: the client will reconnect
+				return
+			}
+			if ev.Type != events.ConversationUpdated {
+				continue
+			}
+			if err := writeSSE(w, ev); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeSSE writes ev in the text/event-stream format. The data field is the JSON-encoded payload.
+func writeSSE(w http.ResponseWriter, ev events.Event) error {
+	data, err := json.Marshal(ev.Payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+	return err
+}
+
+// publish sends ev to every member of ev.ConversationID. Real-time delivery is best effort: errors are logged and
+// never fail the request that caused the event.
+func (rt *_router) publish(ctx *reqcontext.RequestContext, ev events.Event) {
+	members, err := rt.db.GetConversationMemberIDs(ev.ConversationID)
+	if err != nil {
+		ctx.Logger.WithError(err).Warn("can't load conversation members for event")
+		return
+	}
+	rt.hub.Publish(members, ev)
+}
+
+// publishMessage loads the message and publishes it as a events.MessageCreated event, followed by the updated
+// conversation summary.
+func (rt *_router) publishMessage(ctx *reqcontext.RequestContext, conversationID int, messageID int) {
+	msg, err := rt.db.GetMessageByID(messageID, "")
+	if err != nil {
+		ctx.Logger.WithError(err).Warn("can't load message for event")
+		return
+	}
+	rt.publish(ctx, events.Event{
+		Type:           events.MessageCreated,
+		ConversationID: conversationID,
+		Payload:        msg,
+	})
+	rt.publishConversationUpdate(ctx, conversationID)
+}
+
+// broadcastMessage returns a copy of msg that can be sent to every member of the conversation: ReactedByMe is only
+// meaningful for the user who loaded the message.
+func broadcastMessage(msg database.MessageWithSender) database.MessageWithSender {
+	reactions := make([]database.ReactionSummary, len(msg.Reactions))
+	for i, reaction := range msg.Reactions {
+		reaction.ReactedByMe = false
+		reactions[i] = reaction
+	}
+	msg.Reactions = reactions
+	return msg
+}
+
+// publishConversationUpdate publishes the current last message and activity time of the conversation as a
+// events.ConversationUpdated event.
+func (rt *_router) publishConversationUpdate(ctx *reqcontext.RequestContext, conversationID int) {
+	summary, err := rt.db.GetConversationSummary(conversationID)
+	if err != nil {
+		ctx.Logger.WithError(err).Warn("can't load conversation summary for event")
+		return
+	}
+	rt.previewLastMessage(ctx, &summary.LastMessage, summary.LastMessageType, make(map[string]string))
+	rt.publish(ctx, events.Event{
+		Type:           events.ConversationUpdated,
+		ConversationID: conversationID,
+		Payload:        summary,
+	})
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/database"
+)
+
+const (
+	// defaultFilePageSize is the number of items returned by getSharedFiles and getConversationMedia if no limit is
+	// specified
+	defaultFilePageSize = 50
+
+	// maxFilePageSize is the maximum number of items returned by getSharedFiles and getConversationMedia
+	maxFilePageSize = 200
+)
+
+// getSharedFiles lists the files shared in a conversation, in messages or in comments, the newest first. The
+// "before" parameter is the next_cursor of the previous page.
+func (rt *_router) getSharedFiles(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	conversationID, err := strconv.Atoi(ps.ByName("c_id"))
+	if err != nil || conversationID <= 0 {
+		http.Error(w, "Invalid conversation ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := rt.policy.member(ctx.UserID, conversationID); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	query := r.URL.Query()
+	var before int
+	limit := defaultFilePageSize
+	for name, dest := range map[string]*int{"before": &before, "limit": &limit} {
+		if value := query.Get(name); value != "" {
+			*dest, err = strconv.Atoi(value)
+			if err != nil || *dest <= 0 {
+				http.Error(w, "Invalid "+name+" parameter", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if limit > maxFilePageSize {
+		limit = maxFilePageSize
+	}
+
+	// Fetch one more file to know if there is a next page
+	files, err := rt.db.GetSharedFiles(conversationID, before, limit+1)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching shared files")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	var nextCursor *int
+	if len(files) > limit {
+		files = files[:limit]
+		nextCursor = &files[limit-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"files":       files,
+		"next_cursor": nextCursor,
+	})
+}
+
+// mediaTypes are the content types listed by getConversationMedia
+var mediaTypes = []string{"photo", "gif", "file"}
+
+// getConversationMedia lists the photos, GIFs and files sent in a conversation, the newest first. The "type" parameter
+// restricts the content types (comma-separated or repeated), and "comments=true" also lists the media sent in
+// comments. The "before" parameter is the next_cursor of the previous page.
+func (rt *_router) getConversationMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	conversationID, err := strconv.Atoi(ps.ByName("c_id"))
+	if err != nil || conversationID <= 0 {
+		http.Error(w, "Invalid conversation ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := rt.policy.member(ctx.UserID, conversationID); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	query := r.URL.Query()
+	q := database.MediaGalleryQuery{ConversationID: conversationID, Limit: defaultFilePageSize}
+	if value := query.Get("limit"); value != "" {
+		q.Limit, err = strconv.Atoi(value)
+		if err != nil || q.Limit <= 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if q.Limit > maxFilePageSize {
+		q.Limit = maxFilePageSize
+	}
+	if value := query.Get("comments"); value != "" {
+		q.Comments, err = strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "Invalid comments parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, value := range query["type"] {
+		for _, t := range strings.Split(value, ",") {
+			t = strings.TrimSpace(t)
+			if !slices.Contains(mediaTypes, t) {
+				http.Error(w, "Invalid type parameter: use photo, gif or file", http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(q.ContentTypes, t) {
+				q.ContentTypes = append(q.ContentTypes, t)
+			}
+		}
+	}
+	if len(q.ContentTypes) == 0 {
+		q.ContentTypes = mediaTypes
+	}
+
+	if value := query.Get("before"); value != "" {
+		q.BeforeSource, q.BeforeID, err = rt.parseMediaCursor(value, conversationID)
+		if errors.Is(err, errInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			ctx.Logger.WithError(err).Error("Error fetching cursor")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Fetch one more item to know if there is a next page
+	limit := q.Limit
+	q.Limit++
+	items, err := rt.db.GetConversationMedia(q)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching conversation media")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	var nextCursor *string
+	if len(items) > limit {
+		items = items[:limit]
+		cursor := mediaCursor(items[limit-1])
+		nextCursor = &cursor
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"media":       items,
+		"next_cursor": nextCursor,
+	})
+}
+
+// errInvalidCursor is returned by parseMediaCursor for malformed cursors and for cursors of other conversations.
+var errInvalidCursor = errors.New("invalid cursor")
+
+// mediaCursor returns the cursor of a media item, "message:<id>" or "comment:<id>".
+func mediaCursor(item database.MediaItem) string {
+	if item.CommentID != nil {
+		return database.MediaSourceComment + ":" + strconv.Itoa(*item.CommentID)
+	}
+	return database.MediaSourceMessage + ":" + strconv.Itoa(item.MessageID)
+}
+
+// parseMediaCursor parses a cursor returned by mediaCursor, and checks that its item is in the conversation.
+func (rt *_router) parseMediaCursor(cursor string, conversationID int) (string, int, error) {
+	source, value, _ := strings.Cut(cursor, ":")
+	id, err := strconv.Atoi(value)
+	if err != nil || id <= 0 || (source != database.MediaSourceMessage && source != database.MediaSourceComment) {
+		return "", 0, errInvalidCursor
+	}
+
+	messageID := id
+	if source == database.MediaSourceComment {
+		comment, err := rt.db.GetCommentByID(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", 0, errInvalidCursor
+		} else if err != nil {
+			return "", 0, err
+		}
+		messageID = comment.MessageID
+	}
+	cursorConversationID, err := rt.db.GetMessageConversationID(messageID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && cursorConversationID != conversationID) {
+		return "", 0, errInvalidCursor
+	}
+	return source, id, err
+}
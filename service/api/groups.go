@@ -0,0 +1,265 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/database"
+	"github.com/shabdaanov1/wasa/service/events"
+)
+
+// memberEvent is the payload of the events.MemberRoleChanged and events.MemberRemoved events.
+type memberEvent struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role,omitempty"`
+}
+
+// parseGroupID reads the group ID from the path, and checks that it's a group. It writes the error response and
+// returns false if it's not.
+func (rt *_router) parseGroupID(w http.ResponseWriter, ps httprouter.Params, ctx *reqcontext.RequestContext) (int, bool) {
+	groupID, err := strconv.Atoi(ps.ByName("c_id"))
+	if err != nil || groupID <= 0 {
+		http.Error(w, "Invalid group ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	isGroup, err := rt.db.IsConversationGroup(groupID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error checking group type")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !isGroup {
+		exists, err := rt.db.DoesConversationExist(groupID)
+		if err == nil && !exists {
+			http.Error(w, "Group not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "This conversation is not a group", http.StatusBadRequest)
+		}
+		return 0, false
+	}
+	return groupID, true
+}
+
+// getGroupMembers lists the members of a group with their roles.
+func (rt *_router) getGroupMembers(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	groupID, ok := rt.parseGroupID(w, ps, ctx)
+	if !ok {
+		return
+	}
+	if err := rt.policy.member(ctx.UserID, groupID); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	members, err := rt.db.GetGroupMembers(groupID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching group members")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(members)
+}
+
+// promoteMember makes a member of the group an admin. Only the owner can do it.
+func (rt *_router) promoteMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	rt.changeMemberRole(w, ps, ctx, database.RoleAdmin)
+}
+
+// demoteMember makes an admin of the group a plain member. Only the owner can do it.
+func (rt *_router) demoteMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	rt.changeMemberRole(w, ps, ctx, database.RoleMember)
+}
+
+func (rt *_router) changeMemberRole(w http.ResponseWriter, ps httprouter.Params, ctx *reqcontext.RequestContext, role string) {
+	groupID, ok := rt.parseGroupID(w, ps, ctx)
+	if !ok {
+		return
+	}
+	targetID := ps.ByName("user_id")
+
+	if _, err := rt.policy.role(ctx.UserID, groupID, database.RoleOwner); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	current, err := rt.db.GetMemberRole(targetID, groupID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User is not a member of this group", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching member role")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if current == database.RoleOwner {
+		http.Error(w, "The role of the owner can't be changed", http.StatusConflict)
+		return
+	}
+
+	if current != role {
+		if _, err := rt.db.SetMemberRole(targetID, groupID, role); err != nil {
+			ctx.Logger.WithError(err).Error("Error changing member role")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		rt.publish(ctx, events.Event{
+			Type:           events.MemberRoleChanged,
+			ConversationID: groupID,
+			Payload:        memberEvent{UserID: targetID, Role: role},
+		})
+		rt.postSystemMessage(ctx, groupID, systemMessage{
+			Actor:    ctx.UserID,
+			Action:   systemRoleChanged,
+			Targets:  []string{targetID},
+			OldValue: current,
+			NewValue: role,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Member role updated",
+		"user_id": targetID,
+		"role":    role,
+	})
+}
+
+// kickMember removes a member from the group. Admins can remove members, the owner can also remove admins.
+func (rt *_router) kickMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	groupID, ok := rt.parseGroupID(w, ps, ctx)
+	if !ok {
+		return
+	}
+	targetID := ps.ByName("user_id")
+	if targetID == ctx.UserID {
+		http.Error(w, "Use leave to remove yourself from the group", http.StatusBadRequest)
+		return
+	}
+
+	role, err := rt.policy.role(ctx.UserID, groupID, database.RoleAdmin)
+	if err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	targetRole, err := rt.db.GetMemberRole(targetID, groupID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User is not a member of this group", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching member role")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if roleRank[targetRole] >= roleRank[role] {
+		http.Error(w, "You can only remove members with a lower role than yours", http.StatusForbidden)
+		return
+	}
+
+	if _, err := rt.db.RemoveGroupMember(targetID, groupID); err != nil {
+		ctx.Logger.WithError(err).Error("Error removing group member")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The removed user is told as well, so that their clients can drop the conversation
+	ev := events.Event{
+		Type:           events.MemberRemoved,
+		ConversationID: groupID,
+		Payload:        memberEvent{UserID: targetID},
+	}
+	rt.publish(ctx, ev)
+	rt.hub.Publish([]string{targetID}, ev)
+	rt.postSystemMessage(ctx, groupID, systemMessage{Actor: ctx.UserID, Action: systemRemoved, Targets: []string{targetID}})
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Member removed from the group",
+		"user_id": targetID,
+	})
+}
+
+// getGroupPermissions returns the minimum role needed for each change of the group.
+func (rt *_router) getGroupPermissions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	groupID, ok := rt.parseGroupID(w, ps, ctx)
+	if !ok {
+		return
+	}
+	if err := rt.policy.member(ctx.UserID, groupID); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	perms, err := rt.db.GetGroupPermissions(groupID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching group permissions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(perms)
+}
+
+// setGroupPermissions changes the minimum role needed for each change of the group. Only the owner can do it;
+// missing fields are left unchanged.
+func (rt *_router) setGroupPermissions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	groupID, ok := rt.parseGroupID(w, ps, ctx)
+	if !ok {
+		return
+	}
+
+	var input database.GroupPermissions
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	for _, role := range []string{input.Rename, input.ChangePhoto, input.AddMembers} {
+		if _, valid := roleRank[role]; role != "" && !valid {
+			http.Error(w, "Invalid role: "+role, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := rt.policy.role(ctx.UserID, groupID, database.RoleOwner); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	perms, err := rt.db.GetGroupPermissions(groupID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching group permissions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	before := perms
+	if input.Rename != "" {
+		perms.Rename = input.Rename
+	}
+	if input.ChangePhoto != "" {
+		perms.ChangePhoto = input.ChangePhoto
+	}
+	if input.AddMembers != "" {
+		perms.AddMembers = input.AddMembers
+	}
+
+	if err := rt.db.UpdateGroupPermissions(groupID, perms); err != nil {
+		ctx.Logger.WithError(err).Error("Error updating group permissions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if perms != before {
+		rt.postSystemMessage(ctx, groupID, systemMessage{Actor: ctx.UserID, Action: systemPermissionsChanged})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(perms)
+}
@@ -0,0 +1,374 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/database"
+	"github.com/shabdaanov1/wasa/service/globaltime"
+)
+
+// newInviteToken returns a random URL-safe invite token. Unlike session tokens, invite tokens are stored as they are:
+// admins need to see them again to share the link.
+func newInviteToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// inviteUnusable returns why the invite can't be used at now, or "" if it can.
+func inviteUnusable(invite database.GroupInvite, now time.Time) string {
+	switch {
+	case invite.RevokedAt != nil:
+		return "This invite has been revoked"
+	case invite.ExpiresAt != nil && !now.Before(*invite.ExpiresAt):
+		return "This invite has expired"
+	case invite.MaxUses != nil && invite.Uses >= *invite.MaxUses:
+		return "This invite has reached its maximum number of uses"
+	}
+	return ""
+}
+
+// createInvite mints a new invite link for a group. Only admins can do it.
+func (rt *_router) createInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	groupID, ok := rt.parseGroupID(w, ps, ctx)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		ExpiresAt        *time.Time `json:"expires_at"`
+		MaxUses          *int       `json:"max_uses"`
+		RequiresApproval bool       `json:"requires_approval"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	now := globaltime.Now().UTC()
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(now) {
+		http.Error(w, "Invalid input: expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+	if input.MaxUses != nil && *input.MaxUses < 1 {
+		http.Error(w, "Invalid input: max_uses must be at least 1", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := rt.policy.role(ctx.UserID, groupID, database.RoleAdmin); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	token, err := newInviteToken()
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error generating invite token")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	invite := database.GroupInvite{
+		ConversationID:   groupID,
+		Token:            token,
+		CreatedBy:        ctx.UserID,
+		CreatedAt:        now,
+		MaxUses:          input.MaxUses,
+		RequiresApproval: input.RequiresApproval,
+	}
+	if input.ExpiresAt != nil {
+		expiresAt := input.ExpiresAt.UTC()
+		invite.ExpiresAt = &expiresAt
+	}
+
+	invite, err = rt.db.CreateInvite(invite)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error creating invite")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(invite)
+}
+
+// getInvites lists the invites of a group that were not revoked. Only admins can do it.
+func (rt *_router) getInvites(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	groupID, ok := rt.parseGroupID(w, ps, ctx)
+	if !ok {
+		return
+	}
+	if _, err := rt.policy.role(ctx.UserID, groupID, database.RoleAdmin); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	invites, err := rt.db.GetInvites(groupID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching invites")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(invites)
+}
+
+// revokeInvite disables an invite of a group. Only admins can do it.
+func (rt *_router) revokeInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	groupID, ok := rt.parseGroupID(w, ps, ctx)
+	if !ok {
+		return
+	}
+	inviteID, err := strconv.Atoi(ps.ByName("invite_id"))
+	if err != nil || inviteID <= 0 {
+		http.Error(w, "Invalid invite ID", http.StatusBadRequest)
+		return
+	}
+	if _, err := rt.policy.role(ctx.UserID, groupID, database.RoleAdmin); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	revoked, err := rt.db.RevokeInvite(groupID, inviteID, globaltime.Now().UTC())
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error revoking invite")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadInvite reads the invite token from the path. It writes the error response and returns false if there is no
+// such invite.
+func (rt *_router) loadInvite(w http.ResponseWriter, ps httprouter.Params, ctx *reqcontext.RequestContext) (database.GroupInvite, bool) {
+	invite, err := rt.db.GetInviteByToken(ps.ByName("token"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return invite, false
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching invite")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return invite, false
+	}
+	return invite, true
+}
+
+// previewInvite shows the group an invite link leads to, so that the user can decide whether to join. Only what's
+// needed for that is returned: the members and the messages are not visible until the user joins.
+func (rt *_router) previewInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	invite, ok := rt.loadInvite(w, ps, ctx)
+	if !ok {
+		return
+	}
+	if reason := inviteUnusable(invite, globaltime.Now()); reason != "" {
+		http.Error(w, reason, http.StatusGone)
+		return
+	}
+
+	name, err := rt.db.GetGroupNameById(invite.ConversationID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching group")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	members, err := rt.db.GetConversationMemberIDs(invite.ConversationID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching group members")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	isMember, err := rt.db.IsUserInConversation(ctx.UserID, invite.ConversationID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error checking membership")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"c_id":              invite.ConversationID,
+		"name":              name,
+		"members":           len(members),
+		"requires_approval": invite.RequiresApproval,
+		"expires_at":        invite.ExpiresAt,
+		"is_member":         isMember,
+	})
+}
+
+// joinWithInvite adds the authenticated user to the group of an invite link. If the invite requires approval, a join
+// request is stored instead, and the user joins when an admin approves it.
+func (rt *_router) joinWithInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	invite, ok := rt.loadInvite(w, ps, ctx)
+	if !ok {
+		return
+	}
+
+	isMember, err := rt.db.IsUserInConversation(ctx.UserID, invite.ConversationID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error checking membership")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if isMember {
+		writeAlreadyMember(w, invite.ConversationID)
+		return
+	}
+
+	now := globaltime.Now().UTC()
+	if reason := inviteUnusable(invite, now); reason != "" {
+		http.Error(w, reason, http.StatusGone)
+		return
+	}
+
+	if invite.RequiresApproval {
+		if err := rt.db.RequestToJoin(invite, ctx.UserID, now); err != nil {
+			ctx.Logger.WithError(err).Error("Error storing join request")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Your request to join the group is waiting for the approval of an admin",
+			"c_id":    invite.ConversationID,
+			"status":  "pending",
+		})
+		return
+	}
+
+	joined, err := rt.db.JoinWithInvite(invite, ctx.UserID)
+	if errors.Is(err, database.ErrAlreadyMember) {
+		// Joined with another request since the check above
+		writeAlreadyMember(w, invite.ConversationID)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Error joining group")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !joined {
+		// Revoked or used up since it was loaded
+		http.Error(w, "This invite is no longer valid", http.StatusGone)
+		return
+	}
+
+	rt.postSystemMessage(ctx, invite.ConversationID, systemMessage{Actor: ctx.UserID, Action: systemJoined})
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "You joined the group",
+		"c_id":    invite.ConversationID,
+		"status":  "member",
+	})
+}
+
+// writeAlreadyMember answers a join with an invite of a user who is already in the group.
+func writeAlreadyMember(w http.ResponseWriter, conversationID int) {
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "You are already a member of this group",
+		"c_id":    conversationID,
+		"status":  "member",
+	})
+}
+
+// getJoinRequests lists the pending requests to join a group. Only admins can do it.
+func (rt *_router) getJoinRequests(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	groupID, ok := rt.parseGroupID(w, ps, ctx)
+	if !ok {
+		return
+	}
+	if _, err := rt.policy.role(ctx.UserID, groupID, database.RoleAdmin); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	requests, err := rt.db.GetJoinRequests(groupID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching join requests")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(requests)
+}
+
+// approveJoinRequest adds the user who made a join request to the group. Only admins can do it.
+func (rt *_router) approveJoinRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	groupID, ok := rt.parseGroupID(w, ps, ctx)
+	if !ok {
+		return
+	}
+	targetID := ps.ByName("user_id")
+	if _, err := rt.policy.role(ctx.UserID, groupID, database.RoleAdmin); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	approved, err := rt.db.ApproveJoinRequest(groupID, targetID)
+	if errors.Is(err, database.ErrAlreadyMember) {
+		http.Error(w, "The user is already a member of this group", http.StatusConflict)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Error approving join request")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !approved {
+		http.Error(w, "Join request not found", http.StatusNotFound)
+		return
+	}
+
+	rt.postSystemMessage(ctx, groupID, systemMessage{
+		Actor:   ctx.UserID,
+		Action:  systemJoinApproved,
+		Targets: []string{targetID},
+	})
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Join request approved",
+		"user_id": targetID,
+	})
+}
+
+// rejectJoinRequest drops a join request. Only admins can do it.
+func (rt *_router) rejectJoinRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	groupID, ok := rt.parseGroupID(w, ps, ctx)
+	if !ok {
+		return
+	}
+	targetID := ps.ByName("user_id")
+	if _, err := rt.policy.role(ctx.UserID, groupID, database.RoleAdmin); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	rejected, err := rt.db.RejectJoinRequest(groupID, targetID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error rejecting join request")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !rejected {
+		http.Error(w, "Join request not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/shabdaanov1/wasa/service/database"
+)
+
+// conversationMessages returns the latest messages of a conversation, as seen by user.
+func (f *policyFixture) conversationMessages(user string, conv string) []database.MessageWithSender {
+	f.t.Helper()
+	var page struct {
+		Messages []database.MessageWithSender `json:"messages"`
+	}
+	f.mustDo(user, http.MethodGet, "/conversations/"+conv, "", &page)
+	return page.Messages
+}
+
+func TestForwardSystemMessage(t *testing.T) {
+	f := newPolicyFixture(t)
+
+	var systemID int
+	for _, msg := range f.conversationMessages("alice", f.vars["conv"]) {
+		if msg.ContentType == contentTypeSystem {
+			systemID = msg.ID
+		}
+	}
+	if systemID == 0 {
+		t.Fatal("no system message in the group")
+	}
+
+	rec := f.do("alice", http.MethodPost, "/conversations/{conv}/messages/"+strconv.Itoa(systemID)+"/forward/{other_conv}",
+		"", f.vars, 0)
+	expectStatus(t, "forward", rec, http.StatusBadRequest)
+	for _, msg := range f.conversationMessages("alice", f.vars["other_conv"]) {
+		if msg.Status == "forwarded" {
+			t.Errorf("system message forwarded as %q", msg.Content)
+		}
+	}
+}
+
+func TestCommentOnDeletedMessage(t *testing.T) {
+	f := newPolicyFixture(t)
+	f.mustDo("alice", http.MethodDelete, "/conversations/{conv}/messages/{msg}", "", nil)
+
+	// The comment becomes a message, with the type of its file
+	f.mustDo("bob", http.MethodPost, "/conversations/{conv}/messages/{msg}/comments",
+		multipartBody{files: []string{"file"}}, nil)
+	messages := f.conversationMessages("bob", f.vars["conv"])
+	last := messages[len(messages)-1]
+	if last.SenderUsername != "bob" || last.ContentType != "photo" {
+		t.Errorf("comment on a deleted message: got a %q message of %s", last.ContentType, last.SenderUsername)
+	}
+}
+
+// upload sends a multipart request as user, with the given fields and a "file" field with the given name and content,
+// and returns the response and the number of bytes of the body read by the server.
+func (f *policyFixture) upload(user string, path string, fields map[string]string, name string, content []byte) (*httptest.ResponseRecorder, int64) {
+	f.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for field, value := range fields {
+		_ = mw.WriteField(field, value)
+	}
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	if _, err := part.Write(content); err != nil {
+		f.t.Fatal(err)
+	}
+	_ = mw.Close()
+
+	counter := &countingReader{r: &body}
+	req := httptest.NewRequest(http.MethodPost, path, counter)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+f.tokens[user])
+	rec := httptest.NewRecorder()
+	f.handler.ServeHTTP(rec, req)
+	return rec, counter.n
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestUploadBodyLimit(t *testing.T) {
+	f := newPolicyFixture(t)
+	limit := (&_router{}).maxUploadBody()
+
+	// The body is cut at the largest limit, whatever the size the client announces for the file
+	stored := f.storedFiles()
+	rec, read := f.upload("alice", "/conversations/"+f.vars["conv"]+"/messages", nil, "big.bin", make([]byte, 2*limit))
+	expectStatus(t, "upload", rec, http.StatusRequestEntityTooLarge)
+	if got := f.storedFiles(); got != stored {
+		t.Errorf("stored %d files", got-stored)
+	}
+	if read > limit+64<<10 {
+		t.Errorf("read %d bytes of the body, the limit is %d", read, limit)
+	}
+}
+
+func TestFirstMessageWithInvalidFile(t *testing.T) {
+	f := newPolicyFixture(t)
+	path := "/users/" + f.vars["eve"] + "/conversations/first-message"
+	fields := map[string]string{"recipient_username": "bob"}
+
+	// The file is rejected before the conversation is created, so the message can be sent again
+	rec, _ := f.upload("eve", path, fields, "photo.png", []byte("not a PNG image"))
+	expectStatus(t, "invalid file", rec, http.StatusBadRequest)
+	rec, _ = f.upload("eve", path, fields, "notes.txt", []byte("a valid file"))
+	expectStatus(t, "retry", rec, http.StatusCreated)
+}
+
+func TestMediaContentTypeWithoutFile(t *testing.T) {
+	f := newPolicyFixture(t)
+	for _, contentType := range []string{"photo", "gif", "audio", "file", contentTypeSystem} {
+		url := "/uploads/" + contentType
+		rec := f.do("alice", http.MethodPost, "/conversations/{conv}/messages", multipartBody{fields: map[string]string{
+			"content_type": contentType,
+			"content":      url,
+		}}, f.vars, 0)
+		expectStatus(t, contentType+" message", rec, http.StatusBadRequest)
+		rec = f.do("alice", http.MethodPost, "/users/{alice}/conversations/first-message",
+			multipartBody{fields: map[string]string{"recipient_username": "dave", "content_type": contentType,
+				"content": url}}, f.vars, 0)
+		expectStatus(t, contentType+" first message", rec, http.StatusBadRequest)
+		rec = f.do("alice", http.MethodPost, "/conversations/{conv}/messages/{msg}/comments",
+			`{"content_type": "`+contentType+`", "content": "`+url+`"}`, f.vars, 0)
+		expectStatus(t, contentType+" comment", rec, http.StatusBadRequest)
+	}
+
+	rec := f.do("alice", http.MethodPost, "/conversations/{conv}/messages/{msg}/comments",
+		`{"content_type": "emoji", "content": "🎉"}`, f.vars, 0)
+	expectStatus(t, "emoji comment", rec, http.StatusCreated)
+}
+
+func TestUploadAgainWithFullQuota(t *testing.T) {
+	f := newPolicyFixture(t)
+	path := "/conversations/" + f.vars["conv"] + "/messages"
+	content := []byte("a valid file")
+	rec, _ := f.upload("alice", path, nil, "notes.txt", content)
+	expectStatus(t, "upload", rec, http.StatusCreated)
+
+	// The file is counted once: sending it again uses no room
+	f.rt.storageQuota = int64(len(content))
+	rec, _ = f.upload("alice", path, nil, "notes.txt", content)
+	expectStatus(t, "same file", rec, http.StatusCreated)
+
+	stored := f.storedFiles()
+	rec, _ = f.upload("alice", path, nil, "other.txt", []byte("another file"))
+	expectStatus(t, "other file", rec, http.StatusRequestEntityTooLarge)
+	if got := f.storedFiles(); got != stored {
+		t.Errorf("stored %d files over the quota", got-stored)
+	}
+}
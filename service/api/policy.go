@@ -0,0 +1,199 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/database"
+)
+
+// accessPolicy decides whether a user can access a resource. Every handler that reads or changes a conversation, a
+// message or a comment asks the policy first, so that the rules (and the status codes) are the same everywhere:
+//
+//   - 404 Not Found if the resource does not exist, or does not belong to the parent in the path (e.g., a message ID
+//     of another conversation);
+//   - 403 Forbidden if the resource exists, but the user is not allowed to access it.
+//
+// Parents are checked before children: a user who is not a member of a conversation gets 403 for every message ID
+// in it, without learning whether the message exists.
+type accessPolicy struct {
+	db database.AppDatabase
+}
+
+// accessError is returned by the accessPolicy checks when access is denied. Other errors are internal errors.
+type accessError struct {
+	status  int
+	message string
+}
+
+func (e *accessError) Error() string {
+	return e.message
+}
+
+func notFound(message string) error {
+	return &accessError{status: http.StatusNotFound, message: message}
+}
+
+func forbidden(message string) error {
+	return &accessError{status: http.StatusForbidden, message: message}
+}
+
+// self checks that the user ID in a path (either the literal "me" or an ID) is the authenticated user.
+func (p *accessPolicy) self(ctx *reqcontext.RequestContext, pathUserID string) error {
+	if pathUserID != "me" && pathUserID != ctx.UserID {
+		return forbidden("You can only access your own data")
+	}
+	return nil
+}
+
+// member checks that the conversation exists, and that userID is one of its members.
+func (p *accessPolicy) member(userID string, conversationID int) error {
+	isMember, err := p.db.IsUserInConversation(userID, conversationID)
+	if err != nil {
+		return fmt.Errorf("checking membership: %w", err)
+	}
+	if isMember {
+		return nil
+	}
+
+	exists, err := p.db.DoesConversationExist(conversationID)
+	if err != nil {
+		return fmt.Errorf("checking conversation: %w", err)
+	}
+	if !exists {
+		return notFound("Conversation not found")
+	}
+	return forbidden("User is not part of this conversation")
+}
+
+// message checks that userID is a member of the conversation, and that messageID is a message of it.
+func (p *accessPolicy) message(userID string, conversationID int, messageID int) error {
+	if err := p.member(userID, conversationID); err != nil {
+		return err
+	}
+
+	messageConversationID, err := p.db.GetMessageConversationID(messageID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && messageConversationID != conversationID) {
+		return notFound("Message not found in this conversation")
+	} else if err != nil {
+		return fmt.Errorf("checking message: %w", err)
+	}
+	return nil
+}
+
+// messageByID checks that userID is a member of the conversation messageID belongs to, and returns the conversation.
+// It's meant for paths that don't contain the conversation ID.
+func (p *accessPolicy) messageByID(userID string, messageID int) (int, error) {
+	conversationID, err := p.db.GetMessageConversationID(messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, notFound("Message not found")
+	} else if err != nil {
+		return 0, fmt.Errorf("checking message: %w", err)
+	}
+	return conversationID, p.member(userID, conversationID)
+}
+
+// messageOwner checks that messageID is a message of the conversation, sent by userID.
+func (p *accessPolicy) messageOwner(userID string, conversationID int, messageID int) error {
+	if err := p.message(userID, conversationID, messageID); err != nil {
+		return err
+	}
+
+	isOwner, err := p.db.IsMessageOwner(userID, messageID)
+	if err != nil {
+		return fmt.Errorf("checking message ownership: %w", err)
+	}
+	if !isOwner {
+		return forbidden("User does not own this message")
+	}
+	return nil
+}
+
+// commentOwner checks that commentID is a comment on messageID, in the conversation, written by userID.
+func (p *accessPolicy) commentOwner(userID string, conversationID int, messageID int, commentID int) error {
+	if err := p.message(userID, conversationID, messageID); err != nil {
+		return err
+	}
+
+	comment, err := p.db.GetCommentByID(commentID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && comment.MessageID != messageID) {
+		return notFound("Comment not found on this message")
+	} else if err != nil {
+		return fmt.Errorf("checking comment: %w", err)
+	}
+	if comment.UserID != userID {
+		return forbidden("User does not own this comment")
+	}
+	return nil
+}
+
+// roleRank orders the group roles: a role can do everything the lower ones can.
+var roleRank = map[string]int{
+	database.RoleMember: 1,
+	database.RoleAdmin:  2,
+	database.RoleOwner:  3,
+}
+
+// role checks that userID is a member of the conversation with at least minRole, and returns their role.
+func (p *accessPolicy) role(userID string, conversationID int, minRole string) (string, error) {
+	if err := p.member(userID, conversationID); err != nil {
+		return "", err
+	}
+
+	role, err := p.db.GetMemberRole(userID, conversationID)
+	if err != nil {
+		return "", fmt.Errorf("checking role: %w", err)
+	}
+	if roleRank[role] < roleRank[minRole] {
+		if minRole == database.RoleOwner {
+			return role, forbidden("Only the group owner can do this")
+		}
+		return role, forbidden("Only group admins can do this")
+	}
+	return role, nil
+}
+
+// Group changes whose minimum role is set in database.GroupPermissions.
+const (
+	groupRename      = "rename"
+	groupChangePhoto = "change_photo"
+	groupAddMembers  = "add_members"
+)
+
+// groupChange checks that userID is a member of the group with the role needed for the change.
+func (p *accessPolicy) groupChange(userID string, groupID int, change string) error {
+	if err := p.member(userID, groupID); err != nil {
+		return err
+	}
+
+	perms, err := p.db.GetGroupPermissions(groupID)
+	if err != nil {
+		return fmt.Errorf("checking group permissions: %w", err)
+	}
+	minRole := database.RoleMember
+	switch change {
+	case groupRename:
+		minRole = perms.Rename
+	case groupChangePhoto:
+		minRole = perms.ChangePhoto
+	case groupAddMembers:
+		minRole = perms.AddMembers
+	}
+
+	_, err = p.role(userID, groupID, minRole)
+	return err
+}
+
+// denyAccess writes the response for an error returned by an accessPolicy check.
+func denyAccess(w http.ResponseWriter, ctx *reqcontext.RequestContext, err error) {
+	var accessErr *accessError
+	if errors.As(err, &accessErr) {
+		http.Error(w, accessErr.message, accessErr.status)
+		return
+	}
+	ctx.Logger.WithError(err).Error("Error checking access")
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
@@ -0,0 +1,378 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/shabdaanov1/wasa/service/database"
+	"github.com/shabdaanov1/wasa/service/media"
+	"github.com/sirupsen/logrus"
+)
+
+// policyFixture is a fresh API with two groups:
+//
+//   - "home" (conv), with alice (owner) and bob, where alice sent msg and commented it (comment);
+//   - "other" (other_conv), with alice and eve, where alice sent other_msg and commented it (other_comment).
+//
+// Both messages have a 👍 reaction of alice. eve is not a member of "home", and dave asked to join it with an invite
+// that requires approval (invite).
+type policyFixture struct {
+	t       *testing.T
+	rt      *_router
+	handler http.Handler
+	tokens  map[string]string
+	vars    map[string]string
+	store   media.Store
+
+	// search is false if SQLite was built without FTS5
+	search bool
+}
+
+func newPolicyFixture(t *testing.T) *policyFixture {
+	t.Helper()
+	dir := t.TempDir()
+
+	conn, err := sql.Open(database.DriverSQLite, filepath.Join(dir, "wasa.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	db, err := database.New(database.DriverSQLite, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := media.NewLocalStore(filepath.Join(dir, "uploads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	router, err := New(Config{Logger: logger, Database: db, Media: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = router.Close() })
+
+	_, err = db.SearchMessages("", database.MessageSearch{Query: "hello", Limit: 1})
+	f := &policyFixture{
+		t:       t,
+		rt:      router.(*_router),
+		handler: router.Handler(),
+		tokens:  map[string]string{},
+		vars:    map[string]string{},
+		store:   store,
+		search:  !errors.Is(err, database.ErrSearchUnavailable),
+	}
+	for _, name := range []string{"alice", "bob", "eve", "dave"} {
+		var login struct {
+			Token string        `json:"token"`
+			User  database.User `json:"user"`
+		}
+		f.mustDo("", http.MethodPost, "/session", `{"username": "`+name+`"}`, &login)
+		f.tokens[name] = login.Token
+		f.vars[name] = login.User.ID
+	}
+
+	for conv, member := range map[string]string{"conv": "bob", "other_conv": "eve"} {
+		var group struct {
+			ID int `json:"group_id"`
+		}
+		f.mustDo("alice", http.MethodPost, "/groups", multipartBody{fields: map[string]string{
+			"group_name": conv,
+			"usernames":  `["` + member + `"]`,
+		}}, &group)
+		f.vars[conv] = strconv.Itoa(group.ID)
+	}
+
+	for _, prefix := range []string{"", "other_"} {
+		conv := f.vars[prefix+"conv"]
+		var message struct {
+			ID int `json:"message_id"`
+		}
+		f.mustDo("alice", http.MethodPost, "/conversations/"+conv+"/messages", multipartBody{fields: map[string]string{
+			"content_type": "text",
+			"content":      "hello",
+		}}, &message)
+		f.vars[prefix+"msg"] = strconv.Itoa(message.ID)
+
+		var comment struct {
+			ID string `json:"comment_id"`
+		}
+		f.mustDo("alice", http.MethodPost, "/conversations/"+conv+"/messages/"+f.vars[prefix+"msg"]+"/comments",
+			`{"content_type": "text", "content": "nice"}`, &comment)
+		f.vars[prefix+"comment"] = comment.ID
+
+		f.mustDo("alice", http.MethodPut, "/conversations/"+conv+"/messages/"+f.vars[prefix+"msg"]+
+			"/reactions/%F0%9F%91%8D", "", nil)
+	}
+
+	var invite database.GroupInvite
+	f.mustDo("alice", http.MethodPost, "/groups/"+f.vars["conv"]+"/invites", `{"requires_approval": true}`, &invite)
+	f.vars["invite"] = strconv.Itoa(invite.ID)
+	f.mustDo("dave", http.MethodPost, "/invites/"+invite.Token+"/join", "", nil)
+	return f
+}
+
+// multipartBody is a multipart/form-data request body. File fields get a small PNG image.
+type multipartBody struct {
+	fields map[string]string
+	files  []string
+}
+
+// do sends a request as user (no authentication if empty), and returns the response. body is a JSON string or a
+// multipartBody; path and body can contain {placeholders}, replaced with vars.
+func (f *policyFixture) do(user string, method string, path string, body interface{}, vars map[string]string,
+	timeout time.Duration) *httptest.ResponseRecorder {
+	f.t.Helper()
+	pairs := make([]string, 0, 2*len(vars))
+	for name, value := range vars {
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	var reader io.Reader
+	contentType := "application/json"
+	switch b := body.(type) {
+	case string:
+		reader = strings.NewReader(replacer.Replace(b))
+	case multipartBody:
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for name, value := range b.fields {
+			_ = mw.WriteField(name, replacer.Replace(value))
+		}
+		for _, name := range b.files {
+			part, err := mw.CreateFormFile(name, "photo.png")
+			if err != nil {
+				f.t.Fatal(err)
+			}
+			if err := png.Encode(part, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+				f.t.Fatal(err)
+			}
+		}
+		_ = mw.Close()
+		reader, contentType = &buf, mw.FormDataContentType()
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req := httptest.NewRequest(method, replacer.Replace(path), reader).WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	if user != "" {
+		req.Header.Set("Authorization", "Bearer "+f.tokens[user])
+	}
+	rec := httptest.NewRecorder()
+	f.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// mustDo sends a request needed by the fixture, and decodes the response in out (if not nil).
+func (f *policyFixture) mustDo(user string, method string, path string, body interface{}, out interface{}) {
+	f.t.Helper()
+	rec := f.do(user, method, path, body, f.vars, 0)
+	if rec.Code >= 300 {
+		f.t.Fatalf("%s %s: %d %s", method, path, rec.Code, rec.Body.String())
+	}
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			f.t.Fatalf("%s %s: decoding %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+}
+
+// policyRoutes are the routes that read or change a conversation, a message, a comment or the data of a user. Each
+// one is requested by a member (alice), by a user who is not a member (eve, or another user in /users/{id} paths),
+// and by a member with the message and comment IDs of another conversation, if the route has a conversation and a
+// message or a comment.
+//
+// Invite links are not listed: the token is what grants access to the group.
+var policyRoutes = []struct {
+	method string
+	path   string
+	body   interface{}
+
+	// stream is true for the long-lived event streams, which are interrupted after the first response
+	stream bool
+
+	// search is true for the message search, which answers 503 to members if SQLite was built without FTS5
+	search bool
+
+	// member is the expected status for alice; foreign is 404 unless set
+	member  int
+	foreign int
+}{
+	// Reads
+	{method: "GET", path: "/users/{alice}/conversations", member: 200},
+	{method: "GET", path: "/users/{alice}/conversations/events", stream: true, member: 200},
+	{method: "GET", path: "/conversations/{conv}", member: 200},
+	{method: "GET", path: "/conversations/{conv}/files", member: 200},
+	{method: "GET", path: "/conversations/{conv}/media", member: 200},
+	{method: "GET", path: "/conversations/{conv}/messages/{msg}/edits", member: 200},
+	{method: "GET", path: "/conversations/{conv}/messages/{msg}/thread", member: 200},
+	{method: "GET", path: "/messages/{msg}/comments", member: 200},
+	{method: "GET", path: "/search/messages?q=hello&conversation_id={conv}", search: true, member: 200},
+	{method: "GET", path: "/groups/{conv}/members", member: 200},
+	{method: "GET", path: "/groups/{conv}/permissions", member: 200},
+	{method: "GET", path: "/groups/{conv}/invites", member: 200},
+	{method: "GET", path: "/groups/{conv}/join-requests", member: 200},
+
+	// Messages
+	{method: "POST", path: "/users/{alice}/conversations/first-message",
+		body: multipartBody{fields: map[string]string{"recipient_username": "bob", "content_type": "text",
+			"content": "hi"}}, member: 201},
+	{method: "POST", path: "/conversations/{conv}/messages",
+		body: multipartBody{fields: map[string]string{"content_type": "text", "content": "hi"}}, member: 201},
+	{method: "POST", path: "/conversations/{conv}/messages",
+		body:   multipartBody{fields: map[string]string{"content_type": "text", "content": "hi", "reply_to": "{msg}"}},
+		member: 201, foreign: http.StatusBadRequest},
+	{method: "PATCH", path: "/conversations/{conv}/messages/{msg}", body: `{"content": "edited"}`, member: 200},
+	{method: "DELETE", path: "/conversations/{conv}/messages/{msg}", member: 200},
+	{method: "POST", path: "/conversations/{conv}/messages/{msg}/forward/{other_conv}", member: 200},
+	{method: "PUT", path: "/conversations/{conv}/read", body: `{"message_id": {msg}}`, member: 200},
+	{method: "PUT", path: "/conversations/{conv}/messages/{msg}/reactions/%F0%9F%91%8D", member: 200},
+	{method: "DELETE", path: "/conversations/{conv}/messages/{msg}/reactions/%F0%9F%91%8D", member: 200},
+
+	// Comments
+	{method: "POST", path: "/conversations/{conv}/messages/{msg}/comments",
+		body: `{"content_type": "text", "content": "hi"}`, member: 201},
+	{method: "POST", path: "/conversations/{conv}/messages/{msg}/comments",
+		body: multipartBody{files: []string{"file"}}, member: 201},
+	{method: "DELETE", path: "/conversations/{conv}/messages/{msg}/comments/{comment}", member: 200},
+
+	// Groups
+	{method: "POST", path: "/groups/{conv}/members", body: `{"usernames": ["dave"]}`, member: 200},
+	{method: "PUT", path: "/groups/{conv}/name", body: `{"new_name": "renamed"}`, member: 200},
+	{method: "PUT", path: "/conversations/{conv}/set-group-photo", body: multipartBody{files: []string{"photo"}},
+		member: 200},
+	{method: "PUT", path: "/groups/{conv}/permissions", body: `{"rename": "admin"}`, member: 200},
+	{method: "POST", path: "/groups/{conv}/admins/{bob}", member: 200},
+	{method: "DELETE", path: "/groups/{conv}/admins/{bob}", member: 200},
+	{method: "DELETE", path: "/groups/{conv}/members/{bob}", member: 200},
+	{method: "POST", path: "/groups/{conv}/invites", body: `{}`, member: 201},
+	{method: "DELETE", path: "/groups/{conv}/invites/{invite}", member: 204},
+	{method: "POST", path: "/groups/{conv}/join-requests/{dave}", member: 200},
+	{method: "DELETE", path: "/groups/{conv}/join-requests/{dave}", member: 204},
+	{method: "DELETE", path: "/groups/{conv}/leave", member: 200},
+}
+
+// TestAccessPolicy checks that no route gives access to a conversation (or its messages and comments) to a user who
+// is not a member, and that the IDs of another conversation are not found.
+func TestAccessPolicy(t *testing.T) {
+	for _, route := range policyRoutes {
+		name := route.method + " " + route.path
+		if body, ok := route.body.(multipartBody); ok && len(body.files) > 0 {
+			name += " (upload)"
+		}
+		t.Run(name, func(t *testing.T) {
+			f := newPolicyFixture(t)
+			var timeout time.Duration
+			if route.stream {
+				timeout = 100 * time.Millisecond
+			}
+
+			// Requests that are denied must not change anything, so the member goes last
+			stored := f.storedFiles()
+			nonMemberVars := copyVars(f.vars)
+			nonMemberVars["alice"] = f.vars["bob"]
+			expectStatus(t, "non-member", f.do("eve", route.method, route.path, route.body, nonMemberVars, timeout),
+				http.StatusForbidden)
+
+			scoped := strings.Contains(route.path, "{conv}")
+			if scoped && strings.Contains(route.path+bodyText(route.body), "{msg}") {
+				foreignVars := copyVars(f.vars)
+				foreignVars["msg"] = f.vars["other_msg"]
+				foreignVars["comment"] = f.vars["other_comment"]
+				expectStatus(t, "foreign message", f.do("alice", route.method, route.path, route.body, foreignVars,
+					timeout), statusOr(route.foreign, http.StatusNotFound))
+			}
+			if scoped && strings.Contains(route.path, "{comment}") {
+				foreignVars := copyVars(f.vars)
+				foreignVars["comment"] = f.vars["other_comment"]
+				expectStatus(t, "foreign comment", f.do("alice", route.method, route.path, route.body, foreignVars,
+					timeout), statusOr(route.foreign, http.StatusNotFound))
+			}
+
+			// Not even the uploaded files are saved
+			if got := f.storedFiles(); got != stored {
+				t.Errorf("denied requests stored %d files", got-stored)
+			}
+
+			member := route.member
+			if route.search && !f.search {
+				member = http.StatusServiceUnavailable
+			}
+			expectStatus(t, "member", f.do("alice", route.method, route.path, route.body, f.vars, timeout), member)
+		})
+	}
+}
+
+// storedFiles returns the number of files in the media store.
+func (f *policyFixture) storedFiles() int {
+	f.t.Helper()
+	n := 0
+	err := f.store.List(context.Background(), func(media.Info) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return n
+}
+
+func expectStatus(t *testing.T, who string, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Errorf("%s: got %d (%s), expected %d", who, rec.Code, strings.TrimSpace(rec.Body.String()), status)
+	}
+}
+
+func statusOr(status int, fallback int) int {
+	if status == 0 {
+		return fallback
+	}
+	return status
+}
+
+func copyVars(vars map[string]string) map[string]string {
+	c := make(map[string]string, len(vars))
+	for name, value := range vars {
+		c[name] = value
+	}
+	return c
+}
+
+// bodyText returns the text of a body with placeholders, to find the ones it uses.
+func bodyText(body interface{}) string {
+	switch b := body.(type) {
+	case string:
+		return b
+	case multipartBody:
+		var values []string
+		for _, value := range b.fields {
+			values = append(values, value)
+		}
+		return strings.Join(values, " ")
+	}
+	return ""
+}
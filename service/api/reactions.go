@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/events"
+	"github.com/shabdaanov1/wasa/service/globaltime"
+)
+
+// maxEmojiLength caps the size of a reaction. Emojis made of several code points (skin tones, flags, ZWJ sequences)
+// are still a few bytes long.
+const maxEmojiLength = 32
+
+// reactionEvent is the payload of the events.ReactionAdded and events.ReactionRemoved events.
+type reactionEvent struct {
+	MessageID int    `json:"message_id"`
+	UserID    string `json:"user_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// isEmoji returns true if s looks like a single emoji: symbols, optionally with modifiers, variation selectors and
+// zero width joiners. Keycaps (e.g., "1️⃣") start with a digit, "#" or "*".
+func isEmoji(s string) bool {
+	if s == "" || len(s) > maxEmojiLength || !utf8.ValidString(s) {
+		return false
+	}
+	symbols := 0
+	for i, r := range s {
+		switch {
+		case unicode.Is(unicode.So, r):
+			symbols++
+		case unicode.Is(unicode.Sk, r), unicode.Is(unicode.Mn, r), unicode.Is(unicode.Me, r):
+		case r == '\u200d', r == '\ufe0f', r >= 0xe0020 && r <= 0xe007f: // ZWJ, emoji presentation, tag sequences
+		case i == 0 && (r == '#' || r == '*' || (r >= '0' && r <= '9')):
+			symbols++
+		default:
+			return false
+		}
+	}
+	return symbols > 0
+}
+
+// parseReactionParams reads the conversation ID, message ID and emoji of a reaction path. It writes the error
+// response and returns false if they are not valid.
+func parseReactionParams(w http.ResponseWriter, ps httprouter.Params) (int, int, string, bool) {
+	conversationID, err := strconv.Atoi(ps.ByName("conversation_id"))
+	if err != nil || conversationID <= 0 {
+		http.Error(w, "Invalid conversation ID", http.StatusBadRequest)
+		return 0, 0, "", false
+	}
+	messageID, err := strconv.Atoi(ps.ByName("message_id"))
+	if err != nil || messageID <= 0 {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return 0, 0, "", false
+	}
+	emoji := ps.ByName("emoji")
+	if !isEmoji(emoji) {
+		http.Error(w, "Invalid emoji", http.StatusBadRequest)
+		return 0, 0, "", false
+	}
+	return conversationID, messageID, emoji, true
+}
+
+// reactToMessage adds a reaction of the authenticated user to a message. Reacting twice with the same emoji is a
+// no-op.
+func (rt *_router) reactToMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	conversationID, messageID, emoji, ok := parseReactionParams(w, ps)
+	if !ok {
+		return
+	}
+
+	if err := rt.policy.message(ctx.UserID, conversationID, messageID); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	added, err := rt.db.AddReaction(messageID, ctx.UserID, emoji, globaltime.Now().UTC())
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error adding reaction")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if added {
+		rt.publish(ctx, events.Event{
+			Type:           events.ReactionAdded,
+			ConversationID: conversationID,
+			Payload:        reactionEvent{MessageID: messageID, UserID: ctx.UserID, Emoji: emoji},
+		})
+	}
+
+	rt.writeReactions(w, ctx, messageID)
+}
+
+// unreactToMessage removes a reaction of the authenticated user from a message.
+func (rt *_router) unreactToMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	conversationID, messageID, emoji, ok := parseReactionParams(w, ps)
+	if !ok {
+		return
+	}
+
+	if err := rt.policy.message(ctx.UserID, conversationID, messageID); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	removed, err := rt.db.RemoveReaction(messageID, ctx.UserID, emoji)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error removing reaction")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Reaction not found", http.StatusNotFound)
+		return
+	}
+
+	rt.publish(ctx, events.Event{
+		Type:           events.ReactionRemoved,
+		ConversationID: conversationID,
+		Payload:        reactionEvent{MessageID: messageID, UserID: ctx.UserID, Emoji: emoji},
+	})
+
+	rt.writeReactions(w, ctx, messageID)
+}
+
+// writeReactions responds with the current reactions of the message.
+func (rt *_router) writeReactions(w http.ResponseWriter, ctx *reqcontext.RequestContext, messageID int) {
+	reactions, err := rt.db.GetReactions(messageID, ctx.UserID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching reactions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"message_id": messageID,
+		"reactions":  reactions,
+	})
+}
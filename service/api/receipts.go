@@ -0,0 +1,58 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/events"
+)
+
+// markConversationRead marks every message of the conversation, up to the given message ID, as read by the
+// authenticated user.
+func (rt *_router) markConversationRead(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	conversationID, err := strconv.Atoi(ps.ByName("conversation_id"))
+	if err != nil || conversationID <= 0 {
+		http.Error(w, "Invalid conversation ID", http.StatusBadRequest)
+		return
+	}
+
+	var input struct {
+		MessageID int `json:"message_id"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&input)
+	if err != nil || input.MessageID <= 0 {
+		http.Error(w, "Invalid input: message_id is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := rt.policy.message(ctx.UserID, conversationID, input.MessageID); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	err = rt.db.MarkConversationRead(ctx.UserID, conversationID, input.MessageID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error marking conversation as read")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rt.publish(ctx, events.Event{
+		Type:           events.MessagesRead,
+		ConversationID: conversationID,
+		Payload: map[string]interface{}{
+			"user_id":    ctx.UserID,
+			"message_id": input.MessageID,
+		},
+	})
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":         "Conversation marked as read",
+		"conversation_id": conversationID,
+		"read_up_to":      input.MessageID,
+	})
+}
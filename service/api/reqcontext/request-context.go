@@ -21,4 +21,7 @@ type RequestContext struct {
 
 	// UserID is the ID of the authenticated user
 	UserID string
+
+	// SessionID is the ID of the session whose token authenticated the request
+	SessionID int
 }
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/database"
+)
+
+const (
+	// defaultSearchPageSize is the number of results returned by searchMessages if no limit is specified
+	defaultSearchPageSize = 20
+
+	// maxSearchPageSize is the maximum number of results returned by searchMessages
+	maxSearchPageSize = 100
+)
+
+// searchMessages runs a full-text search on the messages of the conversations the authenticated user belongs to.
+// Results are sorted by relevance, and their snippet is HTML with the matched terms in <mark> elements.
+func (rt *_router) searchMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	query := r.URL.Query()
+
+	search := database.MessageSearch{
+		Query:       strings.TrimSpace(query.Get("q")),
+		ContentType: query.Get("content_type"),
+		Limit:       defaultSearchPageSize,
+	}
+	if search.Query == "" {
+		http.Error(w, "Missing q query parameter", http.StatusBadRequest)
+		return
+	}
+
+	for name, dest := range map[string]*int{"limit": &search.Limit, "offset": &search.Offset, "conversation_id": &search.ConversationID} {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || (n == 0 && name != "offset") {
+				http.Error(w, "Invalid "+name+" parameter", http.StatusBadRequest)
+				return
+			}
+			*dest = n
+		}
+	}
+	if search.Limit > maxSearchPageSize {
+		search.Limit = maxSearchPageSize
+	}
+
+	for name, dest := range map[string]*time.Time{"from": &search.From, "to": &search.To} {
+		if value := query.Get(name); value != "" {
+			t, err := parseSearchTime(value)
+			if err != nil {
+				http.Error(w, "Invalid "+name+" parameter: use RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			*dest = t
+		}
+	}
+
+	// Restricting the search to a conversation the user is not part of is an error, not an empty result
+	if search.ConversationID > 0 {
+		if err := rt.policy.member(ctx.UserID, search.ConversationID); err != nil {
+			denyAccess(w, ctx, err)
+			return
+		}
+	}
+
+	if sender := query.Get("sender"); sender != "" {
+		senderID, err := rt.db.GetUserIDByUsername(sender)
+		if err != nil {
+			// No such user: no messages from them
+			writeSearchResults(w, []database.MessageSearchResult{}, nil)
+			return
+		}
+		search.SenderID = senderID
+	}
+
+	results, err := rt.db.SearchMessages(ctx.UserID, search)
+	if errors.Is(err, database.ErrSearchUnavailable) {
+		http.Error(w, "Message search is not available on this server", http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("Error searching messages")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var nextOffset *int
+	if len(results) > search.Limit {
+		results = results[:search.Limit]
+		next := search.Offset + search.Limit
+		nextOffset = &next
+	}
+	for i := range results {
+		results[i].Snippet = highlightSnippet(results[i].Snippet)
+	}
+
+	writeSearchResults(w, results, nextOffset)
+}
+
+func writeSearchResults(w http.ResponseWriter, results []database.MessageSearchResult, nextOffset *int) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"results":     results,
+		"next_offset": nextOffset,
+	})
+}
+
+// parseSearchTime parses a date filter, either as a full RFC 3339 time or as a date (midnight UTC).
+func parseSearchTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// highlightSnippet escapes a snippet returned by the database, and wraps the matched terms in <mark> elements.
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, database.SnippetMatchStart, "<mark>")
+	return strings.ReplaceAll(snippet, database.SnippetMatchEnd, "</mark>")
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/database"
+	"github.com/shabdaanov1/wasa/service/globaltime"
+)
+
+const (
+	// defaultSessionTTL is the lifetime of a session when Config.SessionTTL is not set
+	defaultSessionTTL = 30 * 24 * time.Hour
+
+	// sessionTouchInterval limits how often the last-used time of a session is written to the database
+	sessionTouchInterval = time.Minute
+
+	// maxDeviceLabelLength and maxUserAgentLength cap the client-provided strings stored with a session
+	maxDeviceLabelLength = 64
+	maxUserAgentLength   = 255
+)
+
+// errUnauthorized is returned by authenticate when the request has no valid credentials. The message is sent to the
+// client.
+var errUnauthorized = errors.New("unauthorized")
+
+// newSessionToken returns a new random bearer token and its hash, as stored in the database.
+func newSessionToken() (token string, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashSessionToken(token), nil
+}
+
+// hashSessionToken returns the hex-encoded SHA-256 of the token. Tokens are random and long, so a plain (unsalted)
+// hash is enough to make a leaked hash useless.
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientIP returns the address of the client that sent r, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// truncate cuts s to at most n bytes, without splitting UTF-8 sequences.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// startSession creates a new session for userID, logged in with the request r, and returns its bearer token. The
+// deviceLabel is a free-form name chosen by the client (e.g., "Phone"); the user agent is used when it's empty.
+func (rt *_router) startSession(r *http.Request, userID string, deviceLabel string) (string, database.Session, error) {
+	token, hash, err := newSessionToken()
+	if err != nil {
+		return "", database.Session{}, fmt.Errorf("generating session token: %w", err)
+	}
+
+	now := globaltime.Now().UTC()
+
+	// Good time to forget the old sessions of this user
+	if err := rt.db.DeleteExpiredSessions(userID, now); err != nil {
+		return "", database.Session{}, fmt.Errorf("deleting expired sessions: %w", err)
+	}
+
+	userAgent := truncate(r.UserAgent(), maxUserAgentLength)
+	deviceLabel = strings.TrimSpace(deviceLabel)
+	if deviceLabel == "" {
+		deviceLabel = userAgent
+	}
+
+	session, err := rt.db.CreateSession(database.Session{
+		UserID:      userID,
+		CreatedAt:   now,
+		LastUsedAt:  now,
+		ExpiresAt:   now.Add(rt.sessionTTL),
+		DeviceLabel: truncate(deviceLabel, maxDeviceLabelLength),
+		IP:          clientIP(r),
+		UserAgent:   userAgent,
+	}, hash)
+	if err != nil {
+		return "", database.Session{}, fmt.Errorf("creating session: %w", err)
+	}
+	return token, session, nil
+}
+
+// authenticate resolves the bearer token of the request to a session. It returns an error wrapping errUnauthorized if
+// the token is missing, unknown or expired.
+func (rt *_router) authenticate(r *http.Request) (database.Session, error) {
+	token, err := extractTokenFromHeader(r)
+	if err != nil {
+		return database.Session{}, err
+	}
+
+	session, err := rt.db.GetSessionByTokenHash(hashSessionToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.Session{}, fmt.Errorf("%w: invalid token", errUnauthorized)
+	} else if err != nil {
+		return database.Session{}, fmt.Errorf("fetching session: %w", err)
+	}
+
+	now := globaltime.Now().UTC()
+	if !now.Before(session.ExpiresAt) {
+		return database.Session{}, fmt.Errorf("%w: session expired", errUnauthorized)
+	}
+
+	if ip := clientIP(r); now.Sub(session.LastUsedAt) >= sessionTouchInterval || ip != session.IP {
+		if err := rt.db.TouchSession(session.ID, now, ip); err != nil {
+			return database.Session{}, fmt.Errorf("updating session: %w", err)
+		}
+		session.LastUsedAt = now
+		session.IP = ip
+	}
+	return session, nil
+}
+
+// extractTokenFromHeader extracts the bearer token from the Authorization header
+func extractTokenFromHeader(r *http.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", fmt.Errorf("%w: missing authorization header", errUnauthorized)
+	}
+
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" || parts[1] == "" {
+		return "", fmt.Errorf("%w: invalid authorization format", errUnauthorized)
+	}
+
+	return parts[1], nil
+}
+
+// activeSession is a session as shown to its owner.
+type activeSession struct {
+	database.Session
+
+	// Current is true for the session used to make the request
+	Current bool `json:"current"`
+}
+
+// getMySessions lists the active sessions (logged in devices) of the authenticated user.
+func (rt *_router) getMySessions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	sessions, err := rt.db.GetActiveSessions(ctx.UserID, globaltime.Now().UTC())
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching sessions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]activeSession, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, activeSession{Session: session, Current: session.ID == ctx.SessionID})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// revokeSession ends one session of the authenticated user, e.g. a lost phone. Revoking the current session is the
+// same as logging out.
+func (rt *_router) revokeSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	sessionID, err := strconv.Atoi(ps.ByName("session_id"))
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	found, err := rt.db.DeleteUserSession(ctx.UserID, sessionID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error revoking session")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeOtherSessions ends every session of the authenticated user except the current one ("log out everywhere
+// else").
+func (rt *_router) revokeOtherSessions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	revoked, err := rt.db.DeleteOtherSessions(ctx.UserID, ctx.SessionID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error revoking sessions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Logged out from the other sessions",
+		"revoked": revoked,
+	})
+}
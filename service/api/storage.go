@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/database"
+)
+
+// storageContentTypes are the content types of the uploads, always listed by getMyStorage
+var storageContentTypes = []string{"photo", "gif", "audio", contentTypeFile}
+
+// storageUsage is the usage of one content type, in the response of getMyStorage.
+type storageUsage struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// getMyStorage returns the space used by the uploads of the authenticated user, in total and by content type, and
+// their quota (null if there is none).
+func (rt *_router) getMyStorage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	usage, err := rt.db.GetStorageUsage(ctx.UserID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching storage usage")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	byContentType := make(map[string]storageUsage, len(storageContentTypes))
+	for _, contentType := range storageContentTypes {
+		byContentType[contentType] = storageUsage{}
+	}
+	files := 0
+	for _, u := range usage {
+		byContentType[u.ContentType] = storageUsage{Files: u.Files, Bytes: u.Bytes}
+		files += u.Files
+	}
+	used := totalStorageUsage(usage)
+
+	var quota, available *int64
+	if rt.storageQuota > 0 {
+		quota = &rt.storageQuota
+		left := max(rt.storageQuota-used, 0)
+		available = &left
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"used":            used,
+		"files":           files,
+		"quota":           quota,
+		"available":       available,
+		"by_content_type": byContentType,
+	})
+}
+
+// totalStorageUsage returns the bytes used by all the content types.
+func totalStorageUsage(usage []database.StorageUsage) int64 {
+	var total int64
+	for _, u := range usage {
+		total += u.Bytes
+	}
+	return total
+}
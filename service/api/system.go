@@ -0,0 +1,146 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+)
+
+// contentTypeSystem is the content type of the messages written by the server to record changes of a group (e.g.,
+// "Alice joined"). Their content is a JSON-encoded systemMessage, that clients render in their own words. Clients
+// can't send messages with this content type.
+const contentTypeSystem = "system"
+
+// Actions recorded by system messages. Targets, OldValue and NewValue are only set when noted.
+const (
+	// systemCreated: Actor created the group with Targets as members, NewValue is its name
+	systemCreated = "created"
+
+	// systemAdded: Actor added Targets to the group
+	systemAdded = "added"
+
+	// systemJoined: Actor joined the group through an invite link
+	systemJoined = "joined"
+
+	// systemJoinApproved: Actor approved the request of Targets to join the group
+	systemJoinApproved = "join_approved"
+
+	// systemLeft: Actor left the group
+	systemLeft = "left"
+
+	// systemRemoved: Actor removed Targets from the group
+	systemRemoved = "removed"
+
+	// systemRenamed: Actor renamed the group from OldValue to NewValue
+	systemRenamed = "renamed"
+
+	// systemPhotoChanged: Actor changed the photo of the group to NewValue
+	systemPhotoChanged = "photo_changed"
+
+	// systemRoleChanged: the role of Targets changed from OldValue to NewValue. Actor is the owner who changed it, or
+	// the owner who left the group when the ownership is transferred (OldValue is not set then)
+	systemRoleChanged = "role_changed"
+
+	// systemPermissionsChanged: Actor changed the permissions of the group
+	systemPermissionsChanged = "permissions_changed"
+)
+
+// systemMessage is the content of a system message. Actor and Targets are user IDs.
+type systemMessage struct {
+	Actor    string   `json:"actor"`
+	Action   string   `json:"action"`
+	Targets  []string `json:"targets,omitempty"`
+	OldValue string   `json:"old_value,omitempty"`
+	NewValue string   `json:"new_value,omitempty"`
+}
+
+// postSystemMessage adds a system message to the conversation, and publishes it. Like events, system messages are best
+// effort: errors are logged and never fail the request that made the change.
+func (rt *_router) postSystemMessage(ctx *reqcontext.RequestContext, conversationID int, msg systemMessage) {
+	content, err := json.Marshal(msg)
+	if err != nil {
+		ctx.Logger.WithError(err).Warn("can't encode system message")
+		return
+	}
+	messageID, err := rt.db.SendMessageWithType(conversationID, msg.Actor, string(content), contentTypeSystem, nil)
+	if err != nil {
+		ctx.Logger.WithError(err).Warn("can't save system message")
+		return
+	}
+	rt.publishMessage(ctx, conversationID, messageID)
+}
+
+// systemPreview returns the text shown in the conversation list when a system message is the last message, e.g.
+// "alice added bob, carol". names maps user IDs to usernames; it's filled as needed, so that it can be shared by the
+// conversations of a list.
+func (rt *_router) systemPreview(content string, names map[string]string) (string, error) {
+	var msg systemMessage
+	if err := json.Unmarshal([]byte(content), &msg); err != nil {
+		return "", err
+	}
+	name := func(userID string) (string, error) {
+		if username, ok := names[userID]; ok {
+			return username, nil
+		}
+		user, err := rt.db.GetUserByID(userID)
+		if err != nil {
+			return "", err
+		}
+		names[userID] = user.Username
+		return user.Username, nil
+	}
+
+	actor, err := name(msg.Actor)
+	if err != nil {
+		return "", err
+	}
+	targets := make([]string, len(msg.Targets))
+	for i, target := range msg.Targets {
+		if targets[i], err = name(target); err != nil {
+			return "", err
+		}
+	}
+
+	switch msg.Action {
+	case systemCreated:
+		return actor + " created the group \"" + msg.NewValue + "\"", nil
+	case systemAdded:
+		return actor + " added " + strings.Join(targets, ", "), nil
+	case systemJoined:
+		return actor + " joined the group", nil
+	case systemJoinApproved:
+		return actor + " approved " + strings.Join(targets, ", "), nil
+	case systemLeft:
+		return actor + " left the group", nil
+	case systemRemoved:
+		return actor + " removed " + strings.Join(targets, ", "), nil
+	case systemRenamed:
+		return actor + " renamed the group to \"" + msg.NewValue + "\"", nil
+	case systemPhotoChanged:
+		return actor + " changed the group photo", nil
+	case systemRoleChanged:
+		return strings.Join(targets, ", ") + " is now " + msg.NewValue, nil
+	case systemPermissionsChanged:
+		return actor + " changed the group permissions", nil
+	default:
+		return actor + " changed the group", nil
+	}
+}
+
+// previewLastMessage replaces lastMessage, the JSON content of a system message, with its systemPreview. Other
+// messages are left as they are. If the preview can't be made, lastMessage is cleared.
+func (rt *_router) previewLastMessage(ctx *reqcontext.RequestContext, lastMessage *sql.NullString,
+	lastMessageType sql.NullString, names map[string]string) {
+	if !lastMessage.Valid || lastMessageType.String != contentTypeSystem {
+		return
+	}
+	preview, err := rt.systemPreview(lastMessage.String, names)
+	if err != nil {
+		ctx.Logger.WithError(err).Warn("can't render system message preview")
+		*lastMessage = sql.NullString{}
+		return
+	}
+	lastMessage.String = preview
+}
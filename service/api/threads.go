@@ -0,0 +1,54 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/database"
+)
+
+// getMessageThread returns a message with all its replies, including the replies to the replies, the oldest first.
+// The thread can be opened from any message, not only from messages that are not replies.
+func (rt *_router) getMessageThread(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx *reqcontext.RequestContext) {
+	conversationID, err := strconv.Atoi(ps.ByName("c_id"))
+	if err != nil || conversationID <= 0 {
+		http.Error(w, "Invalid conversation ID", http.StatusBadRequest)
+		return
+	}
+	messageID, err := strconv.Atoi(ps.ByName("message_id"))
+	if err != nil || messageID <= 0 {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := rt.policy.message(ctx.UserID, conversationID, messageID); err != nil {
+		denyAccess(w, ctx, err)
+		return
+	}
+
+	thread, err := rt.db.GetMessageThread(messageID, ctx.UserID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Error fetching thread")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Like getConversation, senders without a photo get the default one
+	setDefaultSenderPhoto(&thread.Root.MessageWithSender)
+	for i := range thread.Replies {
+		setDefaultSenderPhoto(&thread.Replies[i].MessageWithSender)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(thread)
+}
+
+// setDefaultSenderPhoto sets the default profile image as the sender photo of a message whose sender has no photo.
+func setDefaultSenderPhoto(message *database.MessageWithSender) {
+	if !message.SenderPhoto.Valid || message.SenderPhoto.String == "" {
+		message.SenderPhoto.String = "/default-profile.png"
+	}
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/shabdaanov1/wasa/service/globaltime"
+	"github.com/shabdaanov1/wasa/service/media"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultUploadGracePeriod is how long unreferenced files are kept if UploadGC.GracePeriod is not set
+const defaultUploadGracePeriod = 24 * time.Hour
+
+// UploadGC configures the background sweeper deleting the uploaded files that nothing references anymore: files of
+// deleted messages and comments, replaced user and group photos, photos of deleted groups, and their variants.
+type UploadGC struct {
+	// Interval is the time between two sweeps. Zero disables the sweeper
+	Interval time.Duration
+
+	// GracePeriod is how long a file is kept after it was last uploaded, even if nothing references it: files are
+	// saved before the message (or the photo change) that uses them. Defaults to 24 hours
+	GracePeriod time.Duration
+
+	// DryRun only logs the files that would be deleted
+	DryRun bool
+}
+
+// uploadGCReport is the outcome of a sweep of the media store.
+type uploadGCReport struct {
+	// Scanned is the number of files in the store, Referenced and Recent the number of files kept because they are
+	// used or in their grace period
+	Scanned    int
+	Referenced int
+	Recent     int
+
+	// Orphans are the unreferenced files older than the grace period, deleted unless in dry-run mode
+	Orphans      []media.Info
+	OrphanBytes  int64
+	Deleted      int
+	DeletedBytes int64
+}
+
+// startUploadGC runs a sweep now, then every rt.uploadGC.Interval, until stopUploadGC is called.
+func (rt *_router) startUploadGC() {
+	ctx, cancel := context.WithCancel(context.Background())
+	rt.stopGC = cancel
+	rt.gcDone = make(chan struct{})
+
+	go func() {
+		defer close(rt.gcDone)
+		ticker := time.NewTicker(rt.uploadGC.Interval)
+		defer ticker.Stop()
+		for {
+			rt.runUploadGC(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stopUploadGC stops the sweeper, interrupting the current sweep, and waits for it to return.
+func (rt *_router) stopUploadGC() {
+	if rt.stopGC == nil {
+		return
+	}
+	rt.stopGC()
+	<-rt.gcDone
+}
+
+// runUploadGC runs a sweep and logs its report.
+func (rt *_router) runUploadGC(ctx context.Context) {
+	logger := rt.baseLogger.WithField("dry_run", rt.uploadGC.DryRun)
+	start := globaltime.Now()
+	report, err := rt.sweepUploads(ctx, logger, start)
+	if errors.Is(err, context.Canceled) {
+		return
+	} else if err != nil {
+		logger.WithError(err).Error("upload GC: sweep failed")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"scanned":       report.Scanned,
+		"referenced":    report.Referenced,
+		"recent":        report.Recent,
+		"orphans":       len(report.Orphans),
+		"orphan_bytes":  report.OrphanBytes,
+		"deleted":       report.Deleted,
+		"deleted_bytes": report.DeletedBytes,
+		"duration":      globaltime.Since(start),
+	}).Info("upload GC: sweep done")
+}
+
+// sweepUploads finds the files of the media store that are not referenced and older than the grace period, and
+// deletes them (with their database records) unless in dry-run mode.
+func (rt *_router) sweepUploads(ctx context.Context, logger logrus.FieldLogger, now time.Time) (uploadGCReport, error) {
+	var report uploadGCReport
+
+	// The store is listed before the references are loaded: a file saved during the listing is either not listed, or
+	// already recorded with its upload time
+	var files []media.Info
+	err := rt.media.List(ctx, func(info media.Info) error {
+		files = append(files, info)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Scanned = len(files)
+
+	referenced, err := rt.db.GetReferencedUploads()
+	if err != nil {
+		return report, err
+	}
+	uploaded, err := rt.db.GetUploadTimes()
+	if err != nil {
+		return report, err
+	}
+
+	for _, file := range files {
+		if referenced[file.Key] {
+			report.Referenced++
+			continue
+		}
+		// A file uploaded again is saved once (see media.Ingest): its modification time is the first upload
+		last := file.ModTime
+		if t, ok := uploaded[file.Key]; ok && t.After(last) {
+			last = t
+		}
+		if now.Sub(last) < rt.uploadGC.GracePeriod {
+			report.Recent++
+			continue
+		}
+
+		// The references were loaded at the start of the sweep: the file may have been used, or uploaded again, since
+		inUse, err := rt.db.UploadInUse(file.Key, now.Add(-rt.uploadGC.GracePeriod))
+		if err != nil {
+			return report, err
+		}
+		if inUse {
+			report.Referenced++
+			continue
+		}
+
+		report.Orphans = append(report.Orphans, file)
+		report.OrphanBytes += file.Size
+		fileLogger := logger.WithFields(logrus.Fields{"key": file.Key, "size": file.Size, "last_upload": last})
+		if rt.uploadGC.DryRun {
+			fileLogger.Info("upload GC: would delete unreferenced file")
+			continue
+		}
+
+		// Records first: if the file can't be deleted, the next sweep finds it again
+		if err := rt.db.DeleteMediaRecords(file.Key); err != nil {
+			return report, err
+		}
+		if err := rt.media.Delete(ctx, file.Key); err != nil {
+			return report, err
+		}
+		report.Deleted++
+		report.DeletedBytes += file.Size
+		fileLogger.Debug("upload GC: deleted unreferenced file")
+	}
+	return report, nil
+}
@@ -0,0 +1,414 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/shabdaanov1/wasa/service/api/reqcontext"
+	"github.com/shabdaanov1/wasa/service/database"
+	"github.com/shabdaanov1/wasa/service/globaltime"
+	"github.com/shabdaanov1/wasa/service/media"
+)
+
+// Errors returned by saveUpload for the files that can't be uploaded.
+var (
+	errInvalidFileType = errors.New("invalid file type")
+	errFileTooLarge    = errors.New("file too large")
+	errQuotaExceeded   = errors.New("storage quota exceeded")
+)
+
+// writeUploadError writes the response to a request whose file couldn't be saved by saveUpload or savePhoto.
+func writeUploadError(w http.ResponseWriter, ctx *reqcontext.RequestContext, err error) {
+	switch {
+	case errors.Is(err, errInvalidFileType):
+		http.Error(w, "Invalid file type", http.StatusBadRequest)
+	case errors.Is(err, errFileTooLarge):
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errQuotaExceeded):
+		http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+	default:
+		ctx.Logger.WithError(err).Error("Failed to save uploaded file")
+		http.Error(w, "Failed to save uploaded file", http.StatusInternalServerError)
+	}
+}
+
+// defaultUploadLimit is the maximum size of the uploaded files whose type has no limit in Config.UploadLimits.
+const defaultUploadLimit = 10 << 20
+
+const (
+	// uploadFormOverhead is the room left for the other fields and the multipart headers of a request with a file, on
+	// top of the largest upload limit
+	uploadFormOverhead = 1 << 20
+
+	// uploadFormMemory is the part of a multipart form kept in memory; the rest is written to temporary files
+	uploadFormMemory = 10 << 20
+)
+
+// parseUploadForm parses the body of a request that can carry a file, after limiting its size to maxUploadBody: the
+// limit of each file is checked by saveUpload, but nothing must be written to the disk first. Bodies that are not
+// multipart (e.g., JSON) are left to the handler. It writes the response and returns false if the body is too large
+// (413) or not a valid form (400).
+func (rt *_router) parseUploadForm(w http.ResponseWriter, r *http.Request) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, rt.maxUploadBody())
+	err := r.ParseMultipartForm(uploadFormMemory)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil || errors.Is(err, http.ErrNotMultipart):
+		return true
+	case errors.As(err, &tooLarge):
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+	default:
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+	}
+	return false
+}
+
+// maxUploadBody returns the maximum size of the body of a request with a file: the largest upload limit, plus
+// uploadFormOverhead.
+func (rt *_router) maxUploadBody() int64 {
+	largest := rt.uploadLimit(contentTypeFile)
+	for _, kind := range uploadTypes {
+		if limit := rt.uploadLimit(kind.contentType); limit > largest {
+			largest = limit
+		}
+	}
+	return largest + uploadFormOverhead
+}
+
+// uploadType is how an uploaded file is stored and shown, given its extension.
+type uploadType struct {
+	// contentType is the content type of a message with this file
+	contentType string
+	mimeType    string
+}
+
+// uploadTypes lists the extensions of the files that can be uploaded.
+var uploadTypes = map[string]uploadType{
+	".jpg":  {contentType: "photo", mimeType: "image/jpeg"},
+	".jpeg": {contentType: "photo", mimeType: "image/jpeg"},
+	".png":  {contentType: "photo", mimeType: "image/png"},
+	".gif":  {contentType: "gif", mimeType: "image/gif"},
+	".ogg":  {contentType: "audio", mimeType: "audio/ogg"},
+	".opus": {contentType: "audio", mimeType: "audio/ogg"},
+	".mp3":  {contentType: "audio", mimeType: "audio/mpeg"},
+	".m4a":  {contentType: "audio", mimeType: "audio/mp4"},
+}
+
+// contentAddressed matches the keys made of a SHA-256 (originals and their variants), whose content never changes.
+var contentAddressed = regexp.MustCompile(`^[0-9a-f]{64}(-[a-z]+)?(\.[a-z0-9]+)?$`)
+
+// contentTypeFile is the content type of the messages with a file that is not a photo, a GIF or an audio file.
+const contentTypeFile = "file"
+
+// textContentType returns true for the content types of the messages and comments sent without a file. The others are
+// set from the uploaded file (see saveUpload), and system messages are only posted by the server.
+func textContentType(contentType string) bool {
+	return contentType == "text" || contentType == "emoji"
+}
+
+// maxFileNameLength is the maximum length (in bytes) of the names of the shared files; longer names are truncated.
+const maxFileNameLength = 255
+
+// upload is a file saved by saveUpload.
+type upload struct {
+	// contentType is the content type of a message with this file
+	contentType string
+	url         string
+
+	// name is the name of the file on the device of the user, cleaned by cleanFileName
+	name     string
+	size     int64
+	mimeType string
+}
+
+// saveUpload saves an uploaded file in the media store and records ownerID as its owner. Images get resized variants
+// (see media.MakeVariants) and audio files get their duration and waveform (see media.ProbeAudio), unless the same
+// file was uploaded before. Files with other extensions are saved as "file" attachments, if their type (detected from
+// the content) is allowed. It returns errInvalidFileType if the file can't be uploaded, or if its content doesn't
+// match its extension, errFileTooLarge if it's over the limit of its type, and errQuotaExceeded if the owner has no
+// room left for it.
+func (rt *_router) saveUpload(ctx context.Context, file multipart.File, header *multipart.FileHeader, ownerID string) (upload, error) {
+	// The extension is chosen by the client: the actual content is checked too
+	head := make([]byte, media.SniffLen)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return upload{}, err
+	}
+	head = head[:n]
+
+	kind, ok := uploadTypes[strings.ToLower(filepath.Ext(header.Filename))]
+	if ok {
+		if media.Sniff(head) != kind.mimeType {
+			return upload{}, errInvalidFileType
+		}
+	} else {
+		kind = uploadType{contentType: contentTypeFile, mimeType: media.DetectType(head, header.Filename)}
+		if !rt.fileTypeAllowed(kind.mimeType) {
+			return upload{}, errInvalidFileType
+		}
+	}
+	if header.Size > rt.uploadLimit(kind.contentType) {
+		return upload{}, errFileTooLarge
+	}
+	// Checked again when the upload is recorded, but files over quota shouldn't reach the store
+	obj, err := media.Ingest(ctx, rt.media, file, kind.mimeType, func(obj media.Object) error {
+		return rt.checkStorageQuota(ownerID, obj)
+	})
+	if errors.Is(err, media.ErrNotImage) {
+		return upload{}, errInvalidFileType
+	} else if err != nil {
+		return upload{}, err
+	}
+
+	// Images and audio files are checked (by making their variants or probing them) before the upload is recorded
+	switch kind.contentType {
+	case "photo", "gif":
+		err = rt.makeVariants(ctx, obj, file)
+	case "audio":
+		err = rt.probeAudio(obj, file, header.Size)
+	}
+	if err != nil {
+		return upload{}, err
+	}
+
+	_, err = rt.db.RecordMedia(database.Media{
+		SHA256:      obj.SHA256,
+		Key:         obj.Key,
+		OwnerID:     ownerID,
+		Size:        obj.Size,
+		MIMEType:    obj.MIMEType,
+		CreatedAt:   globaltime.Now().UTC(),
+		ContentType: kind.contentType,
+	}, rt.storageQuota)
+	if errors.Is(err, database.ErrQuotaExceeded) {
+		return upload{}, errQuotaExceeded
+	} else if err != nil {
+		return upload{}, err
+	}
+	return upload{
+		contentType: kind.contentType,
+		url:         database.UploadsPrefix + obj.Key,
+		name:        cleanFileName(header.Filename),
+		size:        obj.Size,
+		mimeType:    obj.MIMEType,
+	}, nil
+}
+
+// checkStorageQuota returns errQuotaExceeded if obj would bring the storage usage of userID over the quota. Files that
+// userID uploaded before are not counted again.
+func (rt *_router) checkStorageQuota(userID string, obj media.Object) error {
+	if rt.storageQuota <= 0 {
+		return nil
+	}
+	if owned, err := rt.db.OwnsMedia(obj.SHA256, userID); err != nil || owned {
+		return err
+	}
+	usage, err := rt.db.GetStorageUsage(userID)
+	if err != nil {
+		return err
+	}
+	if totalStorageUsage(usage)+obj.Size > rt.storageQuota {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// fileTypeAllowed returns true if files of the given MIME type can be shared: the type must match the allow list
+// (any type if it's empty), and not the deny list.
+func (rt *_router) fileTypeAllowed(mimeType string) bool {
+	if media.MatchType(mimeType, rt.fileTypes.Deny) {
+		return false
+	}
+	return len(rt.fileTypes.Allow) == 0 || media.MatchType(mimeType, rt.fileTypes.Allow)
+}
+
+// cleanFileName returns the base name of a file, without control characters, and truncated to maxFileNameLength.
+func cleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	for len(name) > maxFileNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+// recordSharedFile records a file sent in a message or a comment, so that it's listed with the files of the
+// conversation. Uploads that are not "file" attachments are ignored.
+func (rt *_router) recordSharedFile(up upload, conversationID int, messageID *int, commentID *int, uploaderID string) error {
+	if up.contentType != contentTypeFile {
+		return nil
+	}
+	_, err := rt.db.AddSharedFile(database.SharedFile{
+		ConversationID: conversationID,
+		MessageID:      messageID,
+		CommentID:      commentID,
+		UploaderID:     uploaderID,
+		URL:            up.url,
+		FileInfo:       database.FileInfo{Name: up.name, Size: up.size, MIMEType: up.mimeType},
+		CreatedAt:      globaltime.Now().UTC(),
+	})
+	return err
+}
+
+// savePhoto is saveUpload for the profile photos of the users and groups, which must be photos or GIFs. It returns
+// the URL of the photo.
+func (rt *_router) savePhoto(ctx context.Context, file multipart.File, header *multipart.FileHeader, ownerID string) (string, error) {
+	kind, ok := uploadTypes[strings.ToLower(filepath.Ext(header.Filename))]
+	if !ok || (kind.contentType != "photo" && kind.contentType != "gif") {
+		return "", errInvalidFileType
+	}
+	up, err := rt.saveUpload(ctx, file, header, ownerID)
+	return up.url, err
+}
+
+// uploadLimit returns the maximum size of the uploaded files of a content type.
+func (rt *_router) uploadLimit(contentType string) int64 {
+	if limit, ok := rt.uploadLimits[contentType]; ok {
+		return limit
+	}
+	return defaultUploadLimit
+}
+
+// makeVariants saves the resized variants of an uploaded image, read again from file, and records them. It returns
+// errInvalidFileType if the file is not an image of the type its extension says.
+func (rt *_router) makeVariants(ctx context.Context, obj media.Object, file multipart.File) error {
+	url := database.UploadsPrefix + obj.Key
+	existing, err := rt.db.GetMediaVariants([]string{url})
+	if err != nil {
+		return err
+	}
+	if len(existing[url]) > 0 {
+		return nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	variants, err := media.MakeVariants(ctx, rt.media, obj, file)
+	if errors.Is(err, media.ErrNotImage) {
+		return errInvalidFileType
+	} else if err != nil {
+		return err
+	}
+
+	records := make([]database.MediaVariant, len(variants))
+	for i, v := range variants {
+		records[i] = database.MediaVariant{Name: v.Name, Key: v.Key, Width: v.Width, Height: v.Height, MIMEType: v.MIMEType}
+	}
+	return rt.db.AddMediaVariants(obj.Key, records)
+}
+
+// probeAudio reads the duration and the waveform of an uploaded audio file, read again from file, and records them. It
+// returns errInvalidFileType if the file is not an audio file of the type its extension says.
+func (rt *_router) probeAudio(obj media.Object, file multipart.File, size int64) error {
+	url := database.UploadsPrefix + obj.Key
+	existing, err := rt.db.GetMediaAudio([]string{url})
+	if err != nil {
+		return err
+	}
+	if _, ok := existing[url]; ok {
+		return nil
+	}
+
+	info, err := media.ProbeAudio(file, size, obj.MIMEType)
+	if errors.Is(err, media.ErrNotAudio) {
+		return errInvalidFileType
+	} else if err != nil {
+		return err
+	}
+	return rt.db.AddMediaAudio(obj.Key, database.AudioInfo{
+		DurationMS: info.Duration.Milliseconds(),
+		Waveform:   info.Waveform,
+	})
+}
+
+// photoVariants returns the URLs of the variants of a photo by variant name, or nil if it has none. Errors are only
+// logged: the photo itself can always be used.
+func (rt *_router) photoVariants(ctx *reqcontext.RequestContext, photo string) map[string]string {
+	variants, err := rt.db.GetMediaVariants([]string{photo})
+	if err != nil {
+		ctx.Logger.WithError(err).Warn("can't load photo variants")
+		return nil
+	}
+	return variants[photo]
+}
+
+// inlineType returns true for the types of the uploads that are shown by the web UI (photos, GIFs and audio files).
+// SVG images are not, as they can hold scripts.
+func inlineType(mimeType string) bool {
+	return (strings.HasPrefix(mimeType, "image/") && mimeType != "image/svg+xml") || strings.HasPrefix(mimeType, "audio/")
+}
+
+// serveUpload serves a file of the media store. Like the web UI assets, uploads are public: whoever has the URL can
+// download the file, and image tags can't send a bearer token anyway. Range requests are supported (both stores return
+// seekable readers), so that players can seek in audio files.
+func (rt *_router) serveUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := strings.TrimPrefix(ps.ByName("filepath"), "/")
+	if !media.ValidKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := rt.media.Get(r.Context(), key)
+	if errors.Is(err, media.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).WithField("key", key).Error("can't read media")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// Uploads are shown in the pages of the web UI: the browser must never run them as part of the site
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	if mimeType := media.TypeByKey(key); inlineType(mimeType) {
+		w.Header().Set("Content-Type", mimeType)
+	} else {
+		// Anything else is downloaded, with the type and name it was shared with
+		mimeType, name := "application/octet-stream", key
+		shared, err := rt.db.GetSharedFileByKey(key)
+		if err == nil {
+			mimeType, name = shared.MIMEType, shared.Name
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			rt.baseLogger.WithError(err).WithField("key", key).Warn("can't load shared file")
+		}
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": name})
+		if disposition == "" {
+			disposition = "attachment"
+		}
+		w.Header().Set("Content-Type", mimeType)
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	if contentAddressed.MatchString(key) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+
+	if seeker, ok := file.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, key, time.Time{}, seeker)
+		return
+	}
+	_, _ = io.Copy(w, file)
+}
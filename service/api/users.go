@@ -11,17 +11,13 @@ import (
 
 	// "github.com/sirupsen/logrus"
 	"database/sql"
-
-	"io"
-	"os"
-	"path/filepath"
-	"strings"
 )
 
 func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, context *reqcontext.RequestContext) {
 	// Parse input
 	var input struct {
-		Username string `json:"username"`
+		Username    string `json:"username"`
+		DeviceLabel string `json:"device_label"`
 	}
 	err := json.NewDecoder(r.Body).Decode(&input)
 	if err != nil || input.Username == "" {
@@ -48,56 +44,47 @@ func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter
 		}
 	}
 
-	// Respond with the user data and user ID (token)
+	// Start a new session: the token is the only credential of the user from now on
+	token, session, err := rt.startSession(r, user.ID, input.DeviceLabel)
+	if err != nil {
+		context.Logger.WithError(err).Error("Failed to start session")
+		http.Error(w, "Internal server error: failed to start session", http.StatusInternalServerError)
+		return
+	}
+
+	user.PhotoVariants = rt.photoVariants(context, user.Photo.String)
+
+	// Respond with the user data and the session token
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(map[string]interface{}{
-		"user":  user,
-		"token": user.ID, // The user ID is the token
+		"user":       user,
+		"token":      token,
+		"expires_at": session.ExpiresAt,
 	})
 }
 
-// func (rt *_router) logout(w http.ResponseWriter, r *http.Request, ps httprouter.Params, context reqcontext.RequestContext) {
-// 	// Parse the request body to extract the user ID (UUID)
-// 	var user User
-// 	err := json.NewDecoder(r.Body).Decode(&user)
-// 	if err != nil || user.ID == "" {
-// 		http.Error(w, "Invalid request body or missing user ID", http.StatusBadRequest)
-// 		return
-// 	}
-
-// 	// Validate if the user exists in the database
-// 	_, err = rt.db.GetUserId(user.ID)
-// 	if err != nil {
-// 		if err == sql.ErrNoRows {
-// 			http.Error(w, "User not found", http.StatusNotFound)
-// 			return
-// 		}
-// 		http.Error(w, "Failed to validate user", http.StatusInternalServerError)
-// 		return
-// 	}
-
-// 	// Perform any additional logout logic here (if needed)
+// logout ends the session used to authenticate the request. Other sessions of the same user are not affected.
+func (rt *_router) logout(w http.ResponseWriter, r *http.Request, ps httprouter.Params, context *reqcontext.RequestContext) {
+	err := rt.db.DeleteSession(context.SessionID)
+	if err != nil {
+		context.Logger.WithError(err).Error("Failed to delete session")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
-// 	// Send a success response
-// 	w.WriteHeader(http.StatusOK)
-// 	w.Header().Set("Content-Type", "text/plain")
-// 	_, _ = w.Write([]byte("Logout successful"))
-// }
+	w.WriteHeader(http.StatusNoContent)
+}
 
 // -----------------
 
 func (rt *_router) setMyUserName(w http.ResponseWriter, r *http.Request, ps httprouter.Params, context *reqcontext.RequestContext) {
-	userID, err := rt.extractUserIDFromHeader(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
+	userID := context.UserID
 
 	var input struct {
 		NewName string `json:"newname"`
 	}
 
-	err = json.NewDecoder(r.Body).Decode(&input)
+	err := json.NewDecoder(r.Body).Decode(&input)
 	if err != nil || input.NewName == "" {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
@@ -141,6 +128,9 @@ func (rt *_router) setMyPhoto(w http.ResponseWriter, r *http.Request, ps httprou
 	}
 
 	// Parse the uploaded file
+	if !rt.parseUploadForm(w, r) {
+		return
+	}
 	file, header, err := r.FormFile("photo")
 	if err != nil {
 		http.Error(w, "Invalid file upload", http.StatusBadRequest)
@@ -148,43 +138,13 @@ func (rt *_router) setMyPhoto(w http.ResponseWriter, r *http.Request, ps httprou
 	}
 	defer file.Close()
 
-	// Validate the file extension
-	fileExt := strings.ToLower(filepath.Ext(header.Filename))
-	allowedExts := map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true}
-	if !allowedExts[fileExt] {
-		http.Error(w, "Invalid file type", http.StatusBadRequest)
-		return
-	}
-
-	// Ensure upload directory exists
-	uploadDir := "webui/public/uploads"
-	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to create upload directory")
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
-	}
-
-	// Generate the new filename using the user ID
-	fileName := userID + fileExt
-	filePath := filepath.Join(uploadDir, fileName)
-
-	// Save the file
-	out, err := os.Create(filePath)
-	if err != nil {
-		http.Error(w, "Failed to save image", http.StatusInternalServerError)
-		return
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, file)
+	// Save the photo in the media store
+	photoURL, err := rt.savePhoto(r.Context(), file, header, userID)
 	if err != nil {
-		http.Error(w, "Failed to save image", http.StatusInternalServerError)
+		writeUploadError(w, ctx, err)
 		return
 	}
 
-	// Generate the correct photo URL for the frontend
-	photoURL := "/uploads/" + fileName
-
 	// Update the user's profile photo in the database
 	err = rt.db.UpdateUserPhoto(userID, photoURL)
 	if err != nil {
@@ -227,6 +187,9 @@ func (rt *_router) getUser(w http.ResponseWriter, r *http.Request, ps httprouter
 		"username": user.Username,
 		"photo":    photoURL, // ✅ Now a plain string
 	}
+	if variants := rt.photoVariants(context, photoURL); variants != nil {
+		response["photo_variants"] = variants
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(response)
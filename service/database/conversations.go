@@ -3,11 +3,7 @@ package database
 import (
 	"database/sql"
 	"errors"
-	"io"
-	"mime/multipart"
-	"os"
-	"path/filepath"
-	"strconv"
+	"fmt"
 	"strings"
 	"time"
 )
@@ -59,10 +55,13 @@ func (db *appdbimpl) CreateConversation_db(isGroup bool, name string, photo stri
 	)
 	return
 }
+
+// AddUsersToConversation adds userID to the members of the conversation. Adding a member twice is a no-op.
 func (db *appdbimpl) AddUsersToConversation(userID string, conversationID int) (err error) {
 	query := `
 		INSERT INTO convmembers (user_id, conversation_id)
-		VALUES (?, ?);
+		VALUES (?, ?)
+		ON CONFLICT (conversation_id, user_id) DO NOTHING;
 	`
 	_, err = db.c.Exec(query, userID, conversationID)
 	return
@@ -124,7 +123,11 @@ func (db *appdbimpl) GetMyConversations_db(userID string) ([]Conversation, error
                 ELSE NULL
             END AS user_photo,
             (SELECT m.content FROM messages m WHERE m.conversation_id = c.id ORDER BY m.datetime DESC LIMIT 1) AS last_message,
-            (SELECT m.content_type FROM messages m WHERE m.conversation_id = c.id ORDER BY m.datetime DESC LIMIT 1) AS last_message_type
+            (SELECT m.content_type FROM messages m WHERE m.conversation_id = c.id ORDER BY m.datetime DESC LIMIT 1) AS last_message_type,
+            (SELECT COUNT(*) FROM messages m
+             WHERE m.conversation_id = c.id AND m.sender <> ? AND m.id > COALESCE(cm.last_read_message_id, 0)) AS unread_count,
+            (SELECT MIN(m.id) FROM messages m
+             WHERE m.conversation_id = c.id AND m.sender <> ? AND m.id > COALESCE(cm.last_read_message_id, 0)) AS first_unread_message_id
         FROM 
             conversations c
         JOIN 
@@ -133,8 +136,8 @@ func (db *appdbimpl) GetMyConversations_db(userID string) ([]Conversation, error
             cm.user_id = ?;
     `
 
-	// Pass userID three times: first two for the subqueries and the third for the WHERE clause.
-	rows, err := db.c.Query(query, userID, userID, userID)
+	// Pass userID five times: first four for the subqueries and the fifth for the WHERE clause.
+	rows, err := db.c.Query(query, userID, userID, userID, userID, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -143,23 +146,15 @@ func (db *appdbimpl) GetMyConversations_db(userID string) ([]Conversation, error
 	var conversations []Conversation
 	for rows.Next() {
 		var convo Conversation
-		var lastConvoStr string // temporary variable for the timestamp as string
 		var userPhoto sql.NullString
 		var lastMessage sql.NullString
 		var lastMessageType sql.NullString
 
-		err := rows.Scan(&convo.ID, &lastConvoStr, &convo.IsGroup, &convo.Photo, &convo.Name, &userPhoto, &lastMessage, &lastMessageType)
-		if err != nil {
-			return nil, err
-		}
-
-		// Parse the last conversation timestamp string into a time.Time.
-		// Adjust the layout if your database returns a different format.
-		parsedTime, err := time.Parse("2006-01-02 15:04:05", lastConvoStr)
+		err := rows.Scan(&convo.ID, timestamp{&convo.LastConvo}, &convo.IsGroup, &convo.Photo, &convo.Name, &userPhoto, &lastMessage, &lastMessageType,
+			&convo.UnreadCount, &convo.FirstUnreadMessageID)
 		if err != nil {
 			return nil, err
 		}
-		convo.LastConvo = parsedTime
 
 		// Correct the photo URL by avoiding double '/uploads/'
 		if userPhoto.Valid && userPhoto.String != "" {
@@ -187,9 +182,50 @@ func (db *appdbimpl) GetMyConversations_db(userID string) ([]Conversation, error
 		return nil, err
 	}
 
+	photos := make([]string, len(conversations))
+	for i, convo := range conversations {
+		photos[i] = convo.Photo.String
+	}
+	variants, err := db.GetMediaVariants(photos)
+	if err != nil {
+		return nil, err
+	}
+	for i := range conversations {
+		conversations[i].PhotoVariants = variants[conversations[i].Photo.String]
+	}
+
 	return conversations, nil
 }
 
+// GetConversationSummary returns the last message and the last activity time of a conversation, that is the fields
+// of GetMyConversations_db that change when messages are sent or deleted.
+func (db *appdbimpl) GetConversationSummary(conversationID int) (ConversationSummary, error) {
+	query := `
+        SELECT 
+            c.id, 
+            COALESCE(
+                (SELECT MAX(m.datetime) 
+                 FROM messages m 
+                 WHERE m.conversation_id = c.id),
+                c.lastconvo
+            ) AS lastconvo,
+            (SELECT m.content FROM messages m WHERE m.conversation_id = c.id ORDER BY m.datetime DESC, m.id DESC LIMIT 1) AS last_message,
+            (SELECT m.content_type FROM messages m WHERE m.conversation_id = c.id ORDER BY m.datetime DESC, m.id DESC LIMIT 1) AS last_message_type
+        FROM 
+            conversations c
+        WHERE 
+            c.id = ?;
+    `
+
+	var summary ConversationSummary
+	err := db.c.QueryRow(query, conversationID).Scan(&summary.ConversationID, timestamp{&summary.LastConvo},
+		&summary.LastMessage, &summary.LastMessageType)
+	if err != nil {
+		return ConversationSummary{}, err
+	}
+	return summary, nil
+}
+
 // SendMessage inserts a new message into the database.
 func (db *appdbimpl) SendMessage(conversationID int, senderID string, content string) error {
 	query := `
@@ -213,39 +249,90 @@ func (db *appdbimpl) IsUserInConversation(userID string, conversationID int) (bo
 	}
 	return count > 0, nil
 }
-func (db *appdbimpl) SendMessageFull(conversationID int, senderID string, content string) error {
+func (db *appdbimpl) SendMessageFull(conversationID int, senderID string, content string) (messageID int, err error) {
 	query := `
         INSERT INTO messages (conversation_id, sender, content, datetime, status)
-        VALUES (?, ?, ?, CURRENT_TIMESTAMP, 'sent');
+        VALUES (?, ?, ?, CURRENT_TIMESTAMP, 'sent')
+        RETURNING id;
     `
-	_, err := db.c.Exec(query, conversationID, senderID, content)
-	return err
+	err = db.c.QueryRow(query, conversationID, senderID, content).Scan(&messageID)
+	return
 }
 
-// GetMessagesByConversationId: now does a LEFT JOIN on the "parent" message
-func (db *appdbimpl) GetMessagesByConversationId(conversationID int) ([]MessageWithSender, error) {
-	query := `
+// messageWithSenderSelect selects the columns scanned by scanMessageWithSender, joining the sender and (if any) the
+// "parent" message this one is replying to. The replies to the message (in its conversation, see GetMessageThread)
+// are counted with the idx_messages_reply_to index.
+const messageWithSenderSelect = `
 	SELECT 
 	  m.id,
 	  m.datetime,
 	  m.content,
+	  m.content_type,
 	  m.status,
+	  m.edited_at,
 	  u.id         AS sender_id,
 	  u.name       AS sender_username,
 	  u.photo      AS sender_photo,
 	
 	  m.reply_to,
 	  pm.content   AS reply_to_content,
-	  pu.name      AS reply_to_sender_username
-	
+	  pu.name      AS reply_to_sender_username,
+	  (SELECT COUNT(*) FROM messages rm
+	   WHERE rm.reply_to = m.id AND rm.conversation_id = m.conversation_id) AS reply_count,
+	  (SELECT MAX(rm.datetime) FROM messages rm
+	   WHERE rm.reply_to = m.id AND rm.conversation_id = m.conversation_id) AS last_reply_at,
+	` + receiptSummarySelect + `
 	FROM messages m
 	JOIN users u ON m.sender = u.id
 	
 	LEFT JOIN messages pm ON m.reply_to = pm.id
 	LEFT JOIN users pu    ON pm.sender = pu.id
-	
+`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMessageWithSender(row rowScanner) (MessageWithSender, error) {
+	var msg MessageWithSender
+	var contentType sql.NullString
+	err := row.Scan(
+		&msg.ID,
+		&msg.Datetime,
+		&msg.Content,
+		&contentType,
+		&msg.Status,
+		&msg.EditedAt,
+		&msg.SenderID,
+		&msg.SenderUsername,
+		&msg.SenderPhoto,
+
+		// columns for the reply
+		&msg.ReplyTo,
+		&msg.ReplyToContent,
+		&msg.ReplyToSenderUsername,
+		&msg.ReplyCount,
+		nullTimestamp{&msg.LastReplyAt},
+
+		&msg.Receipt.Recipients,
+		&msg.Receipt.Delivered,
+		&msg.Receipt.Read,
+	)
+	msg.Receipt.fillCheckmarks()
+	if contentType.Valid {
+		msg.ContentType = contentType.String
+	} else {
+		msg.ContentType = "text"
+	}
+	return msg, err
+}
+
+// GetMessagesByConversationId: now does a LEFT JOIN on the "parent" message. Reactions are summarized for viewerID.
+func (db *appdbimpl) GetMessagesByConversationId(conversationID int, viewerID string) ([]MessageWithSender, error) {
+	query := messageWithSenderSelect + `
 	WHERE m.conversation_id = ?
-	ORDER BY m.datetime ASC;
+	ORDER BY m.datetime ASC, m.id ASC;
     `
 
 	rows, err := db.c.Query(query, conversationID)
@@ -256,23 +343,7 @@ func (db *appdbimpl) GetMessagesByConversationId(conversationID int) ([]MessageW
 
 	var messages []MessageWithSender
 	for rows.Next() {
-		var msg MessageWithSender
-
-		// We scan the joined columns
-		err := rows.Scan(
-			&msg.ID,
-			&msg.Datetime,
-			&msg.Content,
-			&msg.Status,
-			&msg.SenderID,
-			&msg.SenderUsername,
-			&msg.SenderPhoto,
-
-			// new columns for the reply
-			&msg.ReplyTo,
-			&msg.ReplyToContent,
-			&msg.ReplyToSenderUsername,
-		)
+		msg, err := scanMessageWithSender(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -283,9 +354,167 @@ func (db *appdbimpl) GetMessagesByConversationId(conversationID int) ([]MessageW
 		return nil, err
 	}
 
+	if err := db.attachReactions(messages, viewerID); err != nil {
+		return nil, err
+	}
+	if err := db.attachVariants(messages); err != nil {
+		return nil, err
+	}
+	if err := db.attachAudio(messages); err != nil {
+		return nil, err
+	}
+	if err := db.attachFiles(messages); err != nil {
+		return nil, err
+	}
 	return messages, nil
 }
 
+// GetMessagesPage returns up to `limit` messages of the conversation, in chronological order. Messages are ordered by
+// (datetime, id), and the cursors are message IDs:
+//   - with `before` > 0, the messages right before the `before` message are returned;
+//   - with `after` > 0, the messages right after the `after` message are returned;
+//   - otherwise, the latest messages are returned.
+//
+// The cursor messages must belong to the conversation (see GetMessageConversationID). Reactions are summarized for
+// viewerID.
+func (db *appdbimpl) GetMessagesPage(conversationID int, before int, after int, limit int, viewerID string) (MessagePage, error) {
+	var query string
+	var args []interface{}
+	switch {
+	case before > 0:
+		query = messageWithSenderSelect + `
+	WHERE m.conversation_id = ?
+	  AND (m.datetime, m.id) < (SELECT datetime, id FROM messages WHERE id = ?)
+	ORDER BY m.datetime DESC, m.id DESC
+	LIMIT ?;
+    `
+		args = []interface{}{conversationID, before, limit + 1}
+	case after > 0:
+		query = messageWithSenderSelect + `
+	WHERE m.conversation_id = ?
+	  AND (m.datetime, m.id) > (SELECT datetime, id FROM messages WHERE id = ?)
+	ORDER BY m.datetime ASC, m.id ASC
+	LIMIT ?;
+    `
+		args = []interface{}{conversationID, after, limit + 1}
+	default:
+		query = messageWithSenderSelect + `
+	WHERE m.conversation_id = ?
+	ORDER BY m.datetime DESC, m.id DESC
+	LIMIT ?;
+    `
+		args = []interface{}{conversationID, limit + 1}
+	}
+
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return MessagePage{}, err
+	}
+	defer rows.Close()
+
+	var page MessagePage
+	for rows.Next() {
+		msg, err := scanMessageWithSender(rows)
+		if err != nil {
+			return MessagePage{}, err
+		}
+		page.Messages = append(page.Messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return MessagePage{}, err
+	}
+
+	// We asked for one more row than needed, to know whether there is another page
+	more := len(page.Messages) > limit
+	if more {
+		page.Messages = page.Messages[:limit]
+	}
+
+	if after > 0 {
+		page.HasNewer = more
+		page.HasOlder = true // at least the `after` message
+	} else {
+		// Rows were read newest first
+		for i, j := 0, len(page.Messages)-1; i < j; i, j = i+1, j-1 {
+			page.Messages[i], page.Messages[j] = page.Messages[j], page.Messages[i]
+		}
+		page.HasOlder = more
+		page.HasNewer = before > 0 // at least the `before` message
+	}
+
+	if err := db.attachReactions(page.Messages, viewerID); err != nil {
+		return MessagePage{}, err
+	}
+	if err := db.attachVariants(page.Messages); err != nil {
+		return MessagePage{}, err
+	}
+	if err := db.attachAudio(page.Messages); err != nil {
+		return MessagePage{}, err
+	}
+	if err := db.attachFiles(page.Messages); err != nil {
+		return MessagePage{}, err
+	}
+	return page, nil
+}
+
+// GetMessageConversationID returns the ID of the conversation the message belongs to. It returns sql.ErrNoRows if
+// the message does not exist.
+func (db *appdbimpl) GetMessageConversationID(messageID int) (int, error) {
+	var conversationID int
+	err := db.c.QueryRow(`SELECT conversation_id FROM messages WHERE id = ?;`, messageID).Scan(&conversationID)
+	return conversationID, err
+}
+
+// GetMessageByID returns a single message with its sender details. It returns sql.ErrNoRows if the message does not
+// exist. Reactions are summarized for viewerID, which can be empty for messages sent to every member.
+func (db *appdbimpl) GetMessageByID(messageID int, viewerID string) (MessageWithSender, error) {
+	query := messageWithSenderSelect + `
+	WHERE m.id = ?;
+    `
+	msg, err := scanMessageWithSender(db.c.QueryRow(query, messageID))
+	if err != nil {
+		return MessageWithSender{}, err
+	}
+
+	messages := []MessageWithSender{msg}
+	if err := db.attachReactions(messages, viewerID); err != nil {
+		return MessageWithSender{}, err
+	}
+	if err := db.attachVariants(messages); err != nil {
+		return MessageWithSender{}, err
+	}
+	if err := db.attachAudio(messages); err != nil {
+		return MessageWithSender{}, err
+	}
+	if err := db.attachFiles(messages); err != nil {
+		return MessageWithSender{}, err
+	}
+	return messages[0], nil
+}
+
+// GetConversationMemberIDs returns the IDs of all users in the conversation.
+func (db *appdbimpl) GetConversationMemberIDs(conversationID int) ([]string, error) {
+	query := `SELECT user_id FROM convmembers WHERE conversation_id = ?;`
+	rows, err := db.c.Query(query, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		members = append(members, userID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
 func (db *appdbimpl) IsMessageOwner(userID string, messageID int) (bool, error) {
 	query := `
         SELECT COUNT(*) 
@@ -300,10 +529,48 @@ func (db *appdbimpl) IsMessageOwner(userID string, messageID int) (bool, error)
 	return count > 0, nil
 }
 
-func (db *appdbimpl) DeleteMessage(messageID int) error {
-	query := `DELETE FROM messages WHERE id = ?;`
-	_, err := db.c.Exec(query, messageID)
-	return err
+func (db *appdbimpl) DeleteMessage(messageID int) (err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	// The space used by its file is released if its sender doesn't use the file anywhere else
+	var content string
+	err = tx.QueryRow(`SELECT content FROM messages WHERE id = ?;`, messageID).Scan(&content)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to fetch message: %w", err)
+	}
+
+	if _, err = tx.Exec(`DELETE FROM message_receipts WHERE message_id = ?;`, messageID); err != nil {
+		return fmt.Errorf("failed to delete receipts: %w", err)
+	}
+	if _, err = tx.Exec(`DELETE FROM message_edits WHERE message_id = ?;`, messageID); err != nil {
+		return fmt.Errorf("failed to delete edit history: %w", err)
+	}
+	if _, err = tx.Exec(`DELETE FROM message_reactions WHERE message_id = ?;`, messageID); err != nil {
+		return fmt.Errorf("failed to delete reactions: %w", err)
+	}
+	if _, err = tx.Exec(`DELETE FROM shared_files WHERE message_id = ?;`, messageID); err != nil {
+		return fmt.Errorf("failed to delete shared files: %w", err)
+	}
+	// The replies stay, without the message they replied to (SQLite doesn't enforce the foreign key)
+	if _, err = tx.Exec(`UPDATE messages SET reply_to = NULL WHERE reply_to = ?;`, messageID); err != nil {
+		return fmt.Errorf("failed to detach replies: %w", err)
+	}
+	if _, err = tx.Exec(`DELETE FROM messages WHERE id = ?;`, messageID); err != nil {
+		return fmt.Errorf("failed to delete message: %w", err)
+	}
+	if err = releaseUnusedMedia(tx, content); err != nil {
+		return fmt.Errorf("failed to release uploads: %w", err)
+	}
+
+	return tx.Commit()
 }
 
 func (db *appdbimpl) GetMessageContent(messageID int) (string, error) {
@@ -320,20 +587,43 @@ func (db *appdbimpl) GetMessageContent(messageID int) (string, error) {
 	return content, nil
 }
 
-func (db *appdbimpl) ForwardMessage(targetConversationID int, senderID string, content string) error {
-	query := `
-        INSERT INTO messages (conversation_id, sender, content, datetime, status)
-        VALUES (?, ?, ?, CURRENT_TIMESTAMP, 'forwarded');
-    `
-	_, err := db.c.Exec(query, targetConversationID, senderID, content)
-	return err
-}
+// ForwardMessage copies a message, with its content type, to another conversation as a message of senderID, and
+// returns the ID of the copy. The file of a "file" message is recorded as shared in the target conversation too, at
+// forwardedAt. It returns sql.ErrNoRows if the message doesn't exist.
+func (db *appdbimpl) ForwardMessage(messageID int, targetConversationID int, senderID string, forwardedAt time.Time) (forwardedID int, err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	err = tx.QueryRow(`
+		INSERT INTO messages (conversation_id, sender, content, content_type, datetime, status)
+		SELECT ?, ?, content, content_type, CURRENT_TIMESTAMP, 'forwarded'
+		FROM messages WHERE id = ?
+		RETURNING id;
+	`, targetConversationID, senderID, messageID).Scan(&forwardedID)
+	if err != nil {
+		return 0, err
+	}
 
-// ✅ Remove a user from a group
-func (db *appdbimpl) RemoveUserFromGroup(userID string, groupID int) error {
-	query := `DELETE FROM convmembers WHERE user_id = ? AND conversation_id = ?;`
-	_, err := db.c.Exec(query, userID, groupID)
-	return err
+	_, err = tx.Exec(`
+		INSERT INTO shared_files (conversation_id, message_id, comment_id, uploader_id, storage_key, filename, size,
+			mime_type, created_at)
+		SELECT ?, ?, NULL, ?, f.storage_key, f.filename, f.size, f.mime_type, ?
+		FROM shared_files f
+		JOIN messages m ON m.id = f.message_id
+		WHERE f.message_id = ? AND m.content_type = 'file';
+	`, targetConversationID, forwardedID, senderID, forwardedAt, messageID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy shared file: %w", err)
+	}
+
+	return forwardedID, tx.Commit()
 }
 
 // ✅ Get the count of remaining members in a group
@@ -344,11 +634,69 @@ func (db *appdbimpl) GetGroupMemberCount(groupID int) (int, error) {
 	return count, err
 }
 
-// ✅ Delete a group if empty
-func (db *appdbimpl) DeleteGroup(groupID int) error {
-	query := `DELETE FROM conversations WHERE id = ?;`
-	_, err := db.c.Exec(query, groupID)
-	return err
+// DeleteGroup deletes an (empty) group with its messages, comments, files, invites and everything else that refers
+// to it, in a single transaction. SQLite doesn't enforce the foreign keys, so nothing is left to the ON DELETE CASCADE
+// clauses.
+func (db *appdbimpl) DeleteGroup(groupID int) (err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	// The space used by the files of the group is released for the users who don't use them anywhere else
+	rows, err := tx.Query(`
+		SELECT content FROM messages WHERE conversation_id = ?
+		UNION
+		SELECT mc.content FROM message_comments mc
+		JOIN messages m ON m.id = mc.message_id
+		WHERE m.conversation_id = ?
+		UNION
+		SELECT photo FROM conversations WHERE id = ? AND photo IS NOT NULL;
+	`, groupID, groupID, groupID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch files: %w", err)
+	}
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err = rows.Scan(&url); err != nil {
+			rows.Close()
+			return err
+		}
+		urls = append(urls, url)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	const groupMessages = `SELECT id FROM messages WHERE conversation_id = ?`
+	steps := []struct{ what, query string }{
+		{"receipts", `DELETE FROM message_receipts WHERE message_id IN (` + groupMessages + `);`},
+		{"edit history", `DELETE FROM message_edits WHERE message_id IN (` + groupMessages + `);`},
+		{"reactions", `DELETE FROM message_reactions WHERE message_id IN (` + groupMessages + `);`},
+		{"shared files", `DELETE FROM shared_files WHERE conversation_id = ?;`},
+		{"comments", `DELETE FROM message_comments WHERE message_id IN (` + groupMessages + `);`},
+		{"messages", `DELETE FROM messages WHERE conversation_id = ?;`},
+		{"join requests", `DELETE FROM group_join_requests WHERE conversation_id = ?;`},
+		{"invites", `DELETE FROM group_invites WHERE conversation_id = ?;`},
+		{"members", `DELETE FROM convmembers WHERE conversation_id = ?;`},
+		{"group", `DELETE FROM conversations WHERE id = ?;`},
+	}
+	for _, step := range steps {
+		if _, err = tx.Exec(step.query, groupID); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", step.what, err)
+		}
+	}
+	if err = releaseUnusedMedia(tx, urls...); err != nil {
+		return fmt.Errorf("failed to release uploads: %w", err)
+	}
+	return tx.Commit()
 }
 
 // ✅ Check if a conversation is a group
@@ -383,11 +731,32 @@ func (db *appdbimpl) UpdateGroupName(groupID int, newName string) error {
 	return err
 }
 
-// ✅ Update the group photo
-func (db *appdbimpl) UpdateGroupPhoto(groupID int, photoPath string) error {
-	query := `UPDATE conversations SET photo = ? WHERE id = ? AND is_group = TRUE;`
-	_, err := db.c.Exec(query, photoPath, groupID)
-	return err
+// UpdateGroupPhoto sets the photo of a group. The space used by the previous photo is released if its uploader doesn't
+// use it anywhere else.
+func (db *appdbimpl) UpdateGroupPhoto(groupID int, photoPath string) (err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	var previous sql.NullString
+	err = tx.QueryRow(`SELECT photo FROM conversations WHERE id = ? AND is_group = TRUE;`, groupID).Scan(&previous)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to fetch group photo: %w", err)
+	}
+	_, err = tx.Exec(`UPDATE conversations SET photo = ? WHERE id = ? AND is_group = TRUE;`, photoPath, groupID)
+	if err != nil {
+		return fmt.Errorf("failed to update group photo: %w", err)
+	}
+	if err = releaseUnusedMedia(tx, previous.String); err != nil {
+		return fmt.Errorf("failed to release uploads: %w", err)
+	}
+	return tx.Commit()
 }
 
 // Check if a message exists
@@ -402,13 +771,14 @@ func (db *appdbimpl) DoesMessageExist(messageID int) (bool, error) {
 }
 
 // Add a comment to a message
-func (db *appdbimpl) CommentOnMessage(messageID int, userID string, contentType string, content string) error {
+func (db *appdbimpl) CommentOnMessage(messageID int, userID string, contentType string, content string) (commentID int, err error) {
 	query := `
         INSERT INTO message_comments (message_id, user_id, content_type, content, timestamp)
-        VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP);
+        VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+        RETURNING id;
     `
-	_, err := db.c.Exec(query, messageID, userID, contentType, content)
-	return err
+	err = db.c.QueryRow(query, messageID, userID, contentType, content).Scan(&commentID)
+	return
 }
 
 func (db *appdbimpl) DoesConversationExist(conversationID int) (bool, error) {
@@ -421,59 +791,62 @@ func (db *appdbimpl) DoesConversationExist(conversationID int) (bool, error) {
 	return count > 0, nil
 }
 
-func (db *appdbimpl) ConvertCommentsToMessages(messageID int, conversationID int) error {
-	querySelect := `
-        SELECT user_id, content_type, content FROM message_comments WHERE message_id = ?;
-    `
-
-	// Fetch comments first
-	rows, err := db.c.Query(querySelect, messageID)
+// ConvertCommentsToMessages turns the comments of messageID into normal messages of the conversation, with the same
+// content type, and returns the IDs of the new messages. The files shared in the comments move to the new messages.
+// Everything is done in a single transaction.
+func (db *appdbimpl) ConvertCommentsToMessages(messageID int, conversationID int) (messageIDs []int, err error) {
+	tx, err := db.c.Begin()
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
 	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
 
-	// Store comments in memory before closing rows
-	var comments []struct {
-		UserID      string
-		ContentType string
-		Content     string
+	rows, err := tx.Query(`
+		SELECT id, user_id, content_type, content FROM message_comments WHERE message_id = ? ORDER BY id;
+	`, messageID)
+	if err != nil {
+		return nil, err
 	}
-
+	var comments []MessageComment
 	for rows.Next() {
-		var comment struct {
-			UserID      string
-			ContentType string
-			Content     string
-		}
-		if err := rows.Scan(&comment.UserID, &comment.ContentType, &comment.Content); err != nil {
-			rows.Close() // Ensure we close before returning an error
-			return err
+		var comment MessageComment
+		if err := rows.Scan(&comment.ID, &comment.UserID, &comment.ContentType, &comment.Content); err != nil {
+			rows.Close()
+			return nil, err
 		}
 		comments = append(comments, comment)
 	}
+	rows.Close()
 	if err = rows.Err(); err != nil {
-		return err
+		return nil, err
 	}
 
-	rows.Close() // ✅ Properly close before inserting new messages
-
-	// Insert each comment as a new message
 	for _, comment := range comments {
-		queryInsert := `
-            INSERT INTO messages (conversation_id, sender, content, datetime, status)
-            VALUES (?, ?, ?, CURRENT_TIMESTAMP, 'comment-converted');
-        `
-		_, err = db.c.Exec(queryInsert, conversationID, comment.UserID, comment.Content)
+		var newID int
+		err = tx.QueryRow(`
+			INSERT INTO messages (conversation_id, sender, content, content_type, datetime, status)
+			VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, 'comment-converted')
+			RETURNING id;
+		`, conversationID, comment.UserID, comment.Content, comment.ContentType).Scan(&newID)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("failed to convert comment: %w", err)
+		}
+		_, err = tx.Exec(`UPDATE shared_files SET message_id = ?, comment_id = NULL WHERE comment_id = ?;`,
+			newID, comment.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to move shared file: %w", err)
 		}
+		messageIDs = append(messageIDs, newID)
 	}
 
-	// Finally, delete comments from message_comments
-	queryDelete := `DELETE FROM message_comments WHERE message_id = ?;`
-	_, err = db.c.Exec(queryDelete, messageID)
-
-	return err
+	if _, err = tx.Exec(`DELETE FROM message_comments WHERE message_id = ?;`, messageID); err != nil {
+		return nil, fmt.Errorf("failed to delete comments: %w", err)
+	}
+	return messageIDs, tx.Commit()
 }
 
 // ✅ Check if a user is the owner of a comment
@@ -487,11 +860,34 @@ func (db *appdbimpl) IsCommentOwner(userID string, commentID int) (bool, error)
 	return count > 0, nil
 }
 
-// ✅ Delete a comment
-func (db *appdbimpl) DeleteComment(commentID int) error {
-	query := `DELETE FROM message_comments WHERE id = ?;`
-	_, err := db.c.Exec(query, commentID)
-	return err
+// DeleteComment deletes a comment and its shared file. The space used by its file is released if its author doesn't
+// use the file anywhere else.
+func (db *appdbimpl) DeleteComment(commentID int) (err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	var content string
+	err = tx.QueryRow(`SELECT content FROM message_comments WHERE id = ?;`, commentID).Scan(&content)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to fetch comment: %w", err)
+	}
+	if _, err = tx.Exec(`DELETE FROM shared_files WHERE comment_id = ?;`, commentID); err != nil {
+		return fmt.Errorf("failed to delete shared file: %w", err)
+	}
+	if _, err = tx.Exec(`DELETE FROM message_comments WHERE id = ?;`, commentID); err != nil {
+		return fmt.Errorf("failed to delete comment: %w", err)
+	}
+	if err = releaseUnusedMedia(tx, content); err != nil {
+		return fmt.Errorf("failed to release uploads: %w", err)
+	}
+	return tx.Commit()
 }
 
 // SendMessageWithType is extended to accept an optional replyTo parameter
@@ -501,7 +897,7 @@ func (db *appdbimpl) SendMessageWithType(
 	content string,
 	contentType string,
 	replyTo *int,
-) error {
+) (messageID int, err error) {
 	// We'll include reply_to in the INSERT
 	query := `
         INSERT INTO messages (
@@ -521,7 +917,8 @@ func (db *appdbimpl) SendMessageWithType(
             CURRENT_TIMESTAMP,
             'sent',
             ?
-        );
+        )
+        RETURNING id;
     `
 	// If replyTo is nil, pass NULL; otherwise pass the integer value
 	var replyToParam interface{}
@@ -531,75 +928,44 @@ func (db *appdbimpl) SendMessageWithType(
 		replyToParam = *replyTo
 	}
 
-	_, err := db.c.Exec(query, conversationID, senderID, content, contentType, replyToParam)
-	return err
+	err = db.c.QueryRow(query, conversationID, senderID, content, contentType, replyToParam).Scan(&messageID)
+	return
 }
 
-func (db *appdbimpl) SendMessageWithMedia(conversationID int, senderID string, contentType string, content string) error {
+func (db *appdbimpl) SendMessageWithMedia(conversationID int, senderID string, contentType string, content string) (messageID int, err error) {
 	query := `
         INSERT INTO messages (conversation_id, sender, content, content_type, datetime, status)
-        VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, 'sent');
+        VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, 'sent')
+        RETURNING id;
     `
-	_, err := db.c.Exec(query, conversationID, senderID, content, contentType)
-	return err
-}
-
-// SaveUploadedFile saves an uploaded file (photo or GIF) and returns content type & file path
-func (db *appdbimpl) SaveUploadedFile(file io.Reader, header *multipart.FileHeader, userID string) (string, string, error) {
-	// Allowed file types
-	fileExt := strings.ToLower(filepath.Ext(header.Filename))
-	allowedExts := map[string]string{
-		".jpg":  "photo",
-		".jpeg": "photo",
-		".png":  "photo",
-		".gif":  "gif",
-	}
-
-	contentType, ok := allowedExts[fileExt]
-	if !ok {
-		return "", "", errors.New("invalid file type")
-	}
-
-	// Ensure uploads directory exists
-	uploadDir := "webui/public/uploads"
-	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-
-		return "", "", errors.New("fail to create a directory")
-	}
-
-	// Generate unique filename (userID + timestamp)
-	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-	fileName := userID + "_" + timestamp + fileExt
-	filePath := filepath.Join(uploadDir, fileName)
-
-	// Save file
-	out, err := os.Create(filePath)
-	if err != nil {
-		return "", "", err
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, file)
-	if err != nil {
-		return "", "", err
-	}
-
-	// Return content type and file path
-	return contentType, "/uploads/" + fileName, nil
+	err = db.c.QueryRow(query, conversationID, senderID, content, contentType).Scan(&messageID)
+	return
 }
 
-func (db *appdbimpl) GetCommentsByMessageID(messageID int) ([]MessageComment, error) {
-	query := `
+// messageCommentSelect selects the columns scanned by scanMessageComment
+const messageCommentSelect = `
         SELECT 
             mc.id, 
+            mc.message_id,
             u.id AS user_id,
             u.name, 
+            mc.content_type,
             mc.content, 
             mc.timestamp
         FROM 
             message_comments mc
         JOIN 
             users u ON mc.user_id = u.id
+`
+
+func scanMessageComment(row rowScanner) (MessageComment, error) {
+	var comment MessageComment
+	err := row.Scan(&comment.ID, &comment.MessageID, &comment.UserID, &comment.Username, &comment.ContentType, &comment.Content, &comment.Timestamp)
+	return comment, err
+}
+
+func (db *appdbimpl) GetCommentsByMessageID(messageID int) ([]MessageComment, error) {
+	query := messageCommentSelect + `
         WHERE 
             mc.message_id = ?;
     `
@@ -612,8 +978,8 @@ func (db *appdbimpl) GetCommentsByMessageID(messageID int) ([]MessageComment, er
 
 	var comments []MessageComment
 	for rows.Next() {
-		var comment MessageComment
-		if err := rows.Scan(&comment.ID, &comment.UserID, &comment.Username, &comment.Content, &comment.Timestamp); err != nil {
+		comment, err := scanMessageComment(rows)
+		if err != nil {
 			return nil, err
 		}
 		comments = append(comments, comment)
@@ -621,9 +987,29 @@ func (db *appdbimpl) GetCommentsByMessageID(messageID int) ([]MessageComment, er
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	if err := db.attachCommentFiles(comments); err != nil {
+		return nil, err
+	}
 	return comments, nil
 }
 
+// GetCommentByID returns a single comment. It returns sql.ErrNoRows if the comment does not exist.
+func (db *appdbimpl) GetCommentByID(commentID int) (MessageComment, error) {
+	query := messageCommentSelect + `
+        WHERE 
+            mc.id = ?;
+    `
+	comment, err := scanMessageComment(db.c.QueryRow(query, commentID))
+	if err != nil {
+		return MessageComment{}, err
+	}
+	comments := []MessageComment{comment}
+	if err := db.attachCommentFiles(comments); err != nil {
+		return MessageComment{}, err
+	}
+	return comments[0], nil
+}
+
 func (db *appdbimpl) GetConversationBetweenUsers(user1 string, user2 string) (Conversation, error) {
 	query := `
         SELECT c.id, c.lastconvo, c.is_group, c.photo, c.name
@@ -2,13 +2,19 @@
 Package database is the middleware between the app database and the code. All data (de)serialization (save/load) from a
 persistent database are handled here. Database specific logic should never escape this package.
 
-To use this package you need to apply migrations to the database if needed/wanted, connect to it (using the database
-data source name from config), and then initialize an instance of AppDatabase from the DB connection.
+To use this package you need to connect to the database (using the database data source name from config), and then
+initialize an instance of AppDatabase from the DB connection. New applies the schema migrations that are missing (see
+Migrate and the migrations directory), so the database is always up to date when the application starts.
+
+Two databases are supported: SQLite (DriverSQLite, the default) and PostgreSQL (DriverPostgres). Queries are shared,
+and written with "?" placeholders; each database has its own migrations, in migrations/sqlite and migrations/postgres,
+with the same version numbers.
 
 For example, this code adds a parameter in `webapi` executable for the database data source name (add it to the
 main.WebAPIConfiguration structure):
 
 	DB struct {
+		Driver   string `conf:"default:sqlite3"`
 		Filename string `conf:""`
 	}
 
@@ -26,7 +32,7 @@ This is an example on how to migrate the DB and connect to it:
 		_ = db.Close()
 	}()
 
-Then you can initialize the AppDatabase and pass it to the api package.
+Then you can initialize the AppDatabase with database.New(database.DriverSQLite, db) and pass it to the api package.
 */
 package database
 
@@ -34,8 +40,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"io"
-	"mime/multipart"
+	"time"
 )
 
 // AppDatabase is the high level interface for the DB
@@ -56,7 +61,7 @@ type AppDatabase interface {
 	GetConversationById(conversationID int) (conversation Conversation, err error)
 	ConversationExists(senderID string, recipientID string) (bool, error)
 	GetMyConversations_db(userID string) ([]Conversation, error)
-	RemoveUserFromGroup(userID string, groupID int) error
+	GetConversationSummary(conversationID int) (ConversationSummary, error)
 	GetGroupMemberCount(groupID int) (int, error)
 	DeleteGroup(groupID int) error
 	IsConversationGroup(conversationID int) (bool, error)
@@ -66,120 +71,133 @@ type AppDatabase interface {
 	// Message-related methods
 	SendMessage(conversationID int, senderID string, content string) error
 	IsUserInConversation(userID string, conversationID int) (bool, error)
-	SendMessageFull(conversationID int, senderID string, content string) error
-	GetMessagesByConversationId(conversationID int) ([]MessageWithSender, error)
+	SendMessageFull(conversationID int, senderID string, content string) (int, error)
+	GetMessagesByConversationId(conversationID int, viewerID string) ([]MessageWithSender, error)
+	GetMessagesPage(conversationID int, before int, after int, limit int, viewerID string) (MessagePage, error)
+	GetMessageByID(messageID int, viewerID string) (MessageWithSender, error)
+	GetMessageConversationID(messageID int) (int, error)
+	GetConversationMemberIDs(conversationID int) ([]string, error)
 	IsMessageOwner(userID string, messageID int) (bool, error)
 	DeleteMessage(messageID int) error
+	EditMessage(messageID int, newContent string, editedAt time.Time) error
+	GetMessageEdits(messageID int) ([]MessageEdit, error)
 	GetMessageContent(messageID int) (string, error)
-	ForwardMessage(targetConversationID int, senderID string, content string) error
+	ForwardMessage(messageID int, targetConversationID int, senderID string, forwardedAt time.Time) (int, error)
 	UpdateGroupPhoto(groupID int, photoPath string) error
 	DoesMessageExist(messageID int) (bool, error)
-	CommentOnMessage(messageID int, userID string, contentType string, content string) error
-	ConvertCommentsToMessages(messageID int, conversationID int) error
+	CommentOnMessage(messageID int, userID string, contentType string, content string) (int, error)
+	ConvertCommentsToMessages(messageID int, conversationID int) ([]int, error)
 	IsCommentOwner(userID string, commentID int) (bool, error)
 	DeleteComment(commentID int) error
-	SendMessageWithType(conversationID int, senderID string, content string, contentType string, replyTo *int) error
-	SendMessageWithMedia(conversationID int, senderID string, contentType string, content string) error
-	SaveUploadedFile(file io.Reader, header *multipart.FileHeader, userID string) (string, string, error)
+	SendMessageWithType(conversationID int, senderID string, content string, contentType string, replyTo *int) (int, error)
+	GetMessageThread(messageID int, viewerID string) (MessageThread, error)
+	SendMessageWithMedia(conversationID int, senderID string, contentType string, content string) (int, error)
 	GetCommentsByMessageID(messageID int) ([]MessageComment, error)
+	GetCommentByID(commentID int) (MessageComment, error)
 	GetConversationBetweenUsers(user1 string, user2 string) (Conversation, error)
+	MarkDelivered(userID string) error
+	MarkConversationRead(userID string, conversationID int, messageID int) error
 	GetGroupByName(groupName string) (Conversation, error)
 	GetGroupNameById(conversationID int) (string, error)
 
 	// User updates
 	UpdateUserName(id string, newname string) (err error)
 
+	// Group roles
+	GetMemberRole(userID string, conversationID int) (string, error)
+	SetMemberRole(userID string, conversationID int, role string) (bool, error)
+	GetGroupMembers(conversationID int) ([]GroupMember, error)
+	RemoveGroupMember(userID string, groupID int) (string, error)
+	GetGroupPermissions(groupID int) (GroupPermissions, error)
+	UpdateGroupPermissions(groupID int, perms GroupPermissions) error
+
+	// Media
+	RecordMedia(m Media, quota int64) (Media, error)
+	GetStorageUsage(userID string) ([]StorageUsage, error)
+	GetMediaByKey(key string) (Media, error)
+	OwnsMedia(sha256 string, userID string) (bool, error)
+	GetReferencedUploads() (map[string]bool, error)
+	GetUploadTimes() (map[string]time.Time, error)
+	UploadInUse(key string, since time.Time) (bool, error)
+	DeleteMediaRecords(key string) error
+	AddMediaVariants(key string, variants []MediaVariant) error
+	GetMediaVariants(urls []string) (map[string]map[string]string, error)
+	AddMediaAudio(key string, audio AudioInfo) error
+	GetMediaAudio(urls []string) (map[string]AudioInfo, error)
+
+	// Shared files
+	AddSharedFile(f SharedFile) (SharedFile, error)
+	GetSharedFiles(conversationID int, before int, limit int) ([]SharedFile, error)
+	GetSharedFileByKey(key string) (SharedFile, error)
+	GetConversationMedia(q MediaGalleryQuery) ([]MediaItem, error)
+
+	// Group invites
+	CreateInvite(invite GroupInvite) (GroupInvite, error)
+	GetInvites(groupID int) ([]GroupInvite, error)
+	GetInviteByToken(token string) (GroupInvite, error)
+	RevokeInvite(groupID int, inviteID int, revokedAt time.Time) (bool, error)
+	JoinWithInvite(invite GroupInvite, userID string) (bool, error)
+	RequestToJoin(invite GroupInvite, userID string, createdAt time.Time) error
+	GetJoinRequests(groupID int) ([]JoinRequest, error)
+	ApproveJoinRequest(groupID int, userID string) (bool, error)
+	RejectJoinRequest(groupID int, userID string) (bool, error)
+
+	// Reactions
+	AddReaction(messageID int, userID string, emoji string, createdAt time.Time) (bool, error)
+	RemoveReaction(messageID int, userID string, emoji string) (bool, error)
+	GetReactions(messageID int, viewerID string) ([]ReactionSummary, error)
+
+	// Session-related methods
+	CreateSession(session Session, tokenHash string) (Session, error)
+	GetSessionByTokenHash(tokenHash string) (Session, error)
+	TouchSession(sessionID int, lastUsedAt time.Time, ip string) error
+	DeleteSession(sessionID int) error
+	DeleteExpiredSessions(userID string, now time.Time) error
+	GetActiveSessions(userID string, now time.Time) ([]Session, error)
+	DeleteUserSession(userID string, sessionID int) (bool, error)
+	DeleteOtherSessions(userID string, keepSessionID int) (int, error)
+
+	// Search
+	SearchMessages(userID string, search MessageSearch) ([]MessageSearchResult, error)
+
 	// Connection health
 	Ping() error
 }
 type appdbimpl struct {
-	c *sql.DB
+	c *conn
+
+	// search is true if the full-text index of the messages is available
+	search bool
 }
 
-// New returns a new instance of AppDatabase based on the SQLite connection `db`.
-// `db` is required - an error will be returned if `db` is `nil`.
-func New(db *sql.DB) (AppDatabase, error) {
+// New returns a new instance of AppDatabase based on the connection `db`, opened with the database/sql driver named
+// `driver` (DriverSQLite or DriverPostgres). `db` is required - an error will be returned if `db` is `nil`.
+func New(driver string, db *sql.DB) (AppDatabase, error) {
 	if db == nil {
 		return nil, errors.New("database is required when building a AppDatabase")
 	}
+	c, err := newConn(driver, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bring the schema up to date. Versions already applied are skipped, so this is a no-op most of the times
+	if _, _, err := migrate(c); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
 
-	// Check if table exists. If not, the database is empty, and we need to create the structure
-	var tableName string
-	err := db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='users';`).Scan(&tableName)
-	if errors.Is(err, sql.ErrNoRows) {
-		err = createDatabase(db)
-		if err != nil {
-			return nil, fmt.Errorf("error creating database structure: %w", err)
-		}
+	// The full-text search index is optional with SQLite: it needs FTS5
+	search, err := searchIndexAvailable(c)
+	if err != nil {
+		return nil, fmt.Errorf("error checking the search index: %w", err)
 	}
 
 	return &appdbimpl{
-		c: db,
+		c:      c,
+		search: search,
 	}, nil
 }
 
 func (db *appdbimpl) Ping() error {
 	return db.c.Ping()
 }
-
-func createDatabase(db *sql.DB) error {
-	tables := [5]string{
-		`CREATE TABLE IF NOT EXISTS users(
-			id VARCHAR(64), 
-			name VARCHAR(25) NOT NULL,
-			photo VARCHAR(255)
-		);`,
-
-		`CREATE TABLE IF NOT EXISTS conversations(
-			id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, 
-			lastconvo TIMESTAMP NOT NULL,
-			is_group BOOLEAN DEFAULT FALSE,
-			photo VARCHAR(255),
-			name VARCHAR(255)
-
-
-		);`,
-
-		`CREATE TABLE IF NOT EXISTS convmembers (
-			id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, 
-			conversation_id INTEGER NOT NULL,
-			user_id INTEGER NOT NULL,
-			FOREIGN KEY (conversation_id) REFERENCES conversations (id),
-			FOREIGN KEY (user_id) REFERENCES users (id)
-		);`,
-
-		`CREATE TABLE IF NOT EXISTS messages(
-			id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, 
-			datetime TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			content TEXT NOT NULL,
-			content_type TEXT DEFAULT 'text',  -- ✅ New column to store message type
-			sender INTEGER NOT NULL,
-			conversation_id INTEGER NOT NULL,
-			status VARCHAR(10) DEFAULT 'sent',
-			reply_to INTEGER DEFAULT NULL,
-			FOREIGN KEY(sender) REFERENCES users(id),
-			FOREIGN KEY(conversation_id) REFERENCES conversations(id)
-			FOREIGN KEY(reply_to) REFERENCES messages(id)
-		);`,
-		`CREATE TABLE IF NOT EXISTS message_comments (
-			id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
-			message_id INTEGER NOT NULL,
-			user_id VARCHAR(64) NOT NULL,
-			content_type VARCHAR(10) CHECK (content_type IN ('text', 'emoji', 'photo', 'gif')) NOT NULL,
-			content TEXT NOT NULL,
-			timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY(message_id) REFERENCES messages(id),
-			FOREIGN KEY(user_id) REFERENCES users(id)
-		);`,
-	}
-	for t := 0; t < len(tables); t++ {
-		sqlStmt := tables[t]
-		_, err := db.Exec(sqlStmt)
-
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported database drivers, named after the database/sql drivers they use.
+const (
+	DriverSQLite   = "sqlite3"
+	DriverPostgres = "postgres"
+)
+
+// conn wraps the database connection, so that queries can be written once for every driver: they use "?"
+// placeholders, which are rewritten as "$1", "$2", ... for PostgreSQL. Everything else must be standard SQL that
+// both databases understand (RETURNING, ON CONFLICT and row values are fine); the few queries that can't be shared
+// check conn.driver.
+type conn struct {
+	*sql.DB
+	driver string
+}
+
+// newConn checks the driver name, and wraps db.
+func newConn(driver string, db *sql.DB) (*conn, error) {
+	if driver != DriverSQLite && driver != DriverPostgres {
+		return nil, fmt.Errorf("unsupported database driver %q", driver)
+	}
+	return &conn{DB: db, driver: driver}, nil
+}
+
+func (c *conn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.DB.Exec(c.rebind(query), args...)
+}
+
+func (c *conn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.DB.Query(c.rebind(query), args...)
+}
+
+func (c *conn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.DB.QueryRow(c.rebind(query), args...)
+}
+
+func (c *conn) Begin() (*tx, error) {
+	t, err := c.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &tx{Tx: t, conn: c}, nil
+}
+
+// tx is a transaction of a conn, with the same placeholder rewriting.
+type tx struct {
+	*sql.Tx
+	conn *conn
+}
+
+func (t *tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.Tx.Exec(t.conn.rebind(query), args...)
+}
+
+func (t *tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.Tx.Query(t.conn.rebind(query), args...)
+}
+
+func (t *tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return t.Tx.QueryRow(t.conn.rebind(query), args...)
+}
+
+// rebind rewrites the "?" placeholders of query for the driver. Question marks in string literals and quoted
+// identifiers are left alone.
+func (c *conn) rebind(query string) string {
+	if c.driver != DriverPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// timeArg returns the value to compare with the timestamps set by the database (e.g., messages.datetime). SQLite
+// stores CURRENT_TIMESTAMP as text, so the argument must be text in the same format to be compared correctly.
+func (c *conn) timeArg(t time.Time) interface{} {
+	if c.driver == DriverSQLite {
+		return t.UTC().Format(sqliteTimestampLayout)
+	}
+	return t
+}
+
+// sqliteTimestampLayout is the format of the timestamps set by SQLite with CURRENT_TIMESTAMP (UTC).
+const sqliteTimestampLayout = "2006-01-02 15:04:05"
+
+// sqliteDriverTimestampLayout is the format of the time.Time values saved by the SQLite driver.
+const sqliteDriverTimestampLayout = "2006-01-02 15:04:05.999999999-07:00"
+
+// timestamp scans a timestamp computed by a query, e.g. with COALESCE or MAX. PostgreSQL returns a time, while
+// SQLite returns a string, as the column type is lost.
+type timestamp struct {
+	t *time.Time
+}
+
+func (ts timestamp) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case time.Time:
+		*ts.t = v
+		return nil
+	case string:
+		return ts.parse(v)
+	case []byte:
+		return ts.parse(string(v))
+	default:
+		return fmt.Errorf("unsupported timestamp value %T", value)
+	}
+}
+
+func (ts timestamp) parse(value string) error {
+	t, err := time.Parse(sqliteTimestampLayout, value)
+	if err != nil {
+		// Times passed as query arguments are saved by the driver with the date, the time and the zone
+		t, err = time.Parse(sqliteDriverTimestampLayout, value)
+	}
+	if err != nil {
+		return err
+	}
+	*ts.t = t
+	return nil
+}
+
+// nullTimestamp scans a timestamp computed by a query that can be NULL (e.g., MAX over no rows), in which case the
+// time is set to nil.
+type nullTimestamp struct {
+	t **time.Time
+}
+
+func (ts nullTimestamp) Scan(value interface{}) error {
+	if value == nil {
+		*ts.t = nil
+		return nil
+	}
+	var t time.Time
+	if err := (timestamp{&t}).Scan(value); err != nil {
+		return err
+	}
+	*ts.t = &t
+	return nil
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// EditMessage replaces the content of a message, and keeps the previous content in the edit history. It returns
+// sql.ErrNoRows if the message does not exist.
+func (db *appdbimpl) EditMessage(messageID int, newContent string, editedAt time.Time) (err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	var previousContent string
+	err = tx.QueryRow(`SELECT content FROM messages WHERE id = ?;`, messageID).Scan(&previousContent)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO message_edits (message_id, previous_content, edited_at)
+		VALUES (?, ?, ?);
+	`, messageID, previousContent, editedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store edit history: %w", err)
+	}
+
+	_, err = tx.Exec(`UPDATE messages SET content = ?, edited_at = ? WHERE id = ?;`, newContent, editedAt, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to update message: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// GetMessageEdits returns the previous versions of a message, the oldest first. The current content is not included.
+func (db *appdbimpl) GetMessageEdits(messageID int) ([]MessageEdit, error) {
+	query := `
+		SELECT id, message_id, previous_content, edited_at
+		FROM message_edits
+		WHERE message_id = ?
+		ORDER BY id ASC;
+	`
+	rows, err := db.c.Query(query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []MessageEdit{}
+	for rows.Next() {
+		var edit MessageEdit
+		if err := rows.Scan(&edit.ID, &edit.MessageID, &edit.Content, &edit.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return edits, nil
+}
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"strings"
+)
+
+// sharedFileSelect selects the columns scanned by scanSharedFile.
+const sharedFileSelect = `
+	SELECT f.id, f.conversation_id, f.message_id, f.comment_id, f.uploader_id, u.name, f.storage_key, f.filename, f.size,
+		f.mime_type, f.created_at
+	FROM shared_files f
+	JOIN users u ON u.id = f.uploader_id
+`
+
+func scanSharedFile(row rowScanner) (SharedFile, error) {
+	var f SharedFile
+	var key string
+	err := row.Scan(&f.ID, &f.ConversationID, &f.MessageID, &f.CommentID, &f.UploaderID, &f.UploaderUsername, &key,
+		&f.Name, &f.Size, &f.MIMEType, &f.CreatedAt)
+	f.URL = UploadsPrefix + key
+	return f, err
+}
+
+// AddSharedFile records a file sent in a message or a comment of a conversation (ID and UploaderUsername are ignored).
+// f.URL must be the URL of a file of the media store.
+func (db *appdbimpl) AddSharedFile(f SharedFile) (SharedFile, error) {
+	err := db.c.QueryRow(`
+		INSERT INTO shared_files (conversation_id, message_id, comment_id, uploader_id, storage_key, filename, size,
+			mime_type, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id;
+	`, f.ConversationID, f.MessageID, f.CommentID, f.UploaderID, strings.TrimPrefix(f.URL, UploadsPrefix), f.Name,
+		f.Size, f.MIMEType, f.CreatedAt).Scan(&f.ID)
+	return f, err
+}
+
+// GetSharedFiles returns up to limit files of a conversation, newest first. With before > 0, only the files older
+// than the file with that ID are returned.
+func (db *appdbimpl) GetSharedFiles(conversationID int, before int, limit int) ([]SharedFile, error) {
+	query := sharedFileSelect + `WHERE f.conversation_id = ?`
+	args := []interface{}{conversationID}
+	if before > 0 {
+		query += ` AND f.id < ?`
+		args = append(args, before)
+	}
+	query += ` ORDER BY f.id DESC LIMIT ?;`
+	args = append(args, limit)
+
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []SharedFile{}
+	for rows.Next() {
+		f, err := scanSharedFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// GetSharedFileByKey returns the last file recorded with the given store key. It returns sql.ErrNoRows if there is
+// none (e.g., the key is an image).
+func (db *appdbimpl) GetSharedFileByKey(key string) (SharedFile, error) {
+	return scanSharedFile(db.c.QueryRow(sharedFileSelect+`WHERE f.storage_key = ? ORDER BY f.id DESC LIMIT 1;`, key))
+}
+
+// getFileInfos returns the files of the messages (column "message_id") or comments (column "comment_id") with the
+// given IDs, indexed by ID.
+func (db *appdbimpl) getFileInfos(column string, ids []int) (map[int]FileInfo, error) {
+	result := map[int]FileInfo{}
+	if len(ids) == 0 {
+		return result, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	query := `
+		SELECT ` + column + `, filename, size, mime_type FROM shared_files
+		WHERE ` + column + ` IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ") + `);
+	`
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var info FileInfo
+		if err := rows.Scan(&id, &info.Name, &info.Size, &info.MIMEType); err != nil {
+			return nil, err
+		}
+		result[id] = info
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// attachFiles fills the File field of the file messages.
+func (db *appdbimpl) attachFiles(messages []MessageWithSender) error {
+	var ids []int
+	for _, msg := range messages {
+		if msg.ContentType == "file" {
+			ids = append(ids, msg.ID)
+		}
+	}
+	files, err := db.getFileInfos("message_id", ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		if info, ok := files[messages[i].ID]; ok {
+			messages[i].File = &info
+		}
+	}
+	return nil
+}
+
+// attachCommentFiles fills the File field of the file comments.
+func (db *appdbimpl) attachCommentFiles(comments []MessageComment) error {
+	var ids []int
+	for _, c := range comments {
+		if c.ContentType == "file" {
+			ids = append(ids, c.ID)
+		}
+	}
+	files, err := db.getFileInfos("comment_id", ids)
+	if err != nil {
+		return err
+	}
+	for i := range comments {
+		if info, ok := files[comments[i].ID]; ok {
+			comments[i].File = &info
+		}
+	}
+	return nil
+}
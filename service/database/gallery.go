@@ -0,0 +1,133 @@
+package database
+
+import (
+	"strings"
+)
+
+// Sources of the media items, see MediaItem.
+const (
+	MediaSourceMessage = "message"
+	MediaSourceComment = "comment"
+)
+
+// GetConversationMedia returns up to q.Limit media items of a conversation, newest first. Items sent in the same
+// second are ordered by source (messages first), then by ID.
+func (db *appdbimpl) GetConversationMedia(q MediaGalleryQuery) ([]MediaItem, error) {
+	items := []MediaItem{}
+	if len(q.ContentTypes) == 0 {
+		return items, nil
+	}
+	types := make([]interface{}, len(q.ContentTypes))
+	for i, t := range q.ContentTypes {
+		types[i] = t
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(types)), ", ")
+
+	// item_id is the ID of the message or of the comment, to order the items and compare them with the cursor
+	query := `
+	SELECT source, message_id, comment_id, content_type, content, sender_id, sender_name, ts FROM (
+		SELECT '` + MediaSourceMessage + `' AS source, m.id AS message_id, CAST(NULL AS INTEGER) AS comment_id,
+		       m.content_type AS content_type, m.content AS content, m.sender AS sender_id, u.name AS sender_name,
+		       m.datetime AS ts, m.id AS item_id
+		FROM messages m
+		JOIN users u ON u.id = m.sender
+		WHERE m.conversation_id = ? AND m.content_type IN (` + placeholders + `)`
+	args := append([]interface{}{q.ConversationID}, types...)
+	if q.Comments {
+		query += `
+		UNION ALL
+		SELECT '` + MediaSourceComment + `', mc.message_id, mc.id, mc.content_type, mc.content, mc.user_id, u.name,
+		       mc.timestamp, mc.id
+		FROM message_comments mc
+		JOIN messages m ON m.id = mc.message_id
+		JOIN users u ON u.id = mc.user_id
+		WHERE m.conversation_id = ? AND mc.content_type IN (` + placeholders + `)`
+		args = append(append(args, q.ConversationID), types...)
+	}
+	query += `
+	) media`
+	switch {
+	case q.BeforeID > 0 && q.BeforeSource == MediaSourceComment:
+		query += `
+	WHERE (ts, source, item_id) < (SELECT timestamp, '` + MediaSourceComment + `', id FROM message_comments WHERE id = ?)`
+		args = append(args, q.BeforeID)
+	case q.BeforeID > 0:
+		query += `
+	WHERE (ts, source, item_id) < (SELECT datetime, '` + MediaSourceMessage + `', id FROM messages WHERE id = ?)`
+		args = append(args, q.BeforeID)
+	}
+	query += `
+	ORDER BY ts DESC, source DESC, item_id DESC
+	LIMIT ?;`
+	args = append(args, q.Limit)
+
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item MediaItem
+		err = rows.Scan(&item.Source, &item.MessageID, &item.CommentID, &item.ContentType, &item.URL, &item.SenderID,
+			&item.SenderUsername, timestamp{&item.Timestamp})
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := db.attachMediaDetails(items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// attachMediaDetails fills the variants of the photos and GIFs and the file details of the files.
+func (db *appdbimpl) attachMediaDetails(items []MediaItem) error {
+	var urls []string
+	var messageIDs, commentIDs []int
+	for _, item := range items {
+		switch {
+		case item.ContentType == "photo" || item.ContentType == "gif":
+			urls = append(urls, item.URL)
+		case item.ContentType == "file" && item.CommentID != nil:
+			commentIDs = append(commentIDs, *item.CommentID)
+		case item.ContentType == "file":
+			messageIDs = append(messageIDs, item.MessageID)
+		}
+	}
+
+	variants, err := db.GetMediaVariants(urls)
+	if err != nil {
+		return err
+	}
+	messageFiles, err := db.getFileInfos("message_id", messageIDs)
+	if err != nil {
+		return err
+	}
+	commentFiles, err := db.getFileInfos("comment_id", commentIDs)
+	if err != nil {
+		return err
+	}
+
+	for i := range items {
+		item := &items[i]
+		switch {
+		case item.ContentType == "photo" || item.ContentType == "gif":
+			item.Variants = variants[item.URL]
+		case item.ContentType == "file" && item.CommentID != nil:
+			if info, ok := commentFiles[*item.CommentID]; ok {
+				item.File = &info
+			}
+		case item.ContentType == "file":
+			if info, ok := messageFiles[item.MessageID]; ok {
+				item.File = &info
+			}
+		}
+	}
+	return nil
+}
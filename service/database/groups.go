@@ -0,0 +1,129 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Roles of the members of a group. Members of one-to-one conversations are always RoleMember.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// GetMemberRole returns the role of userID in the conversation. It returns sql.ErrNoRows if the user is not a member.
+func (db *appdbimpl) GetMemberRole(userID string, conversationID int) (string, error) {
+	var role string
+	err := db.c.QueryRow(`SELECT role FROM convmembers WHERE user_id = ? AND conversation_id = ?;`,
+		userID, conversationID).Scan(&role)
+	return role, err
+}
+
+// SetMemberRole changes the role of userID in the conversation. It returns false if the user is not a member.
+func (db *appdbimpl) SetMemberRole(userID string, conversationID int, role string) (bool, error) {
+	res, err := db.c.Exec(`UPDATE convmembers SET role = ? WHERE user_id = ? AND conversation_id = ?;`,
+		role, userID, conversationID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// GetGroupMembers returns the members of a conversation with their role, in the order they joined.
+func (db *appdbimpl) GetGroupMembers(conversationID int) ([]GroupMember, error) {
+	query := `
+		SELECT u.id, u.name, u.photo, cm.role
+		FROM convmembers cm
+		JOIN users u ON u.id = cm.user_id
+		WHERE cm.conversation_id = ?
+		ORDER BY cm.id;
+	`
+	rows, err := db.c.Query(query, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []GroupMember{}
+	for rows.Next() {
+		var member GroupMember
+		if err := rows.Scan(&member.UserID, &member.Username, &member.Photo, &member.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// RemoveGroupMember removes userID from the group. If the group is left without an owner, the admin (or, if there are
+// no admins, the member) who joined first becomes the new owner, and its ID is returned.
+func (db *appdbimpl) RemoveGroupMember(userID string, groupID int) (newOwnerID string, err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	_, err = tx.Exec(`DELETE FROM convmembers WHERE user_id = ? AND conversation_id = ?;`, userID, groupID)
+	if err != nil {
+		return "", fmt.Errorf("failed to remove member: %w", err)
+	}
+
+	var owners int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM convmembers WHERE conversation_id = ? AND role = ?;`,
+		groupID, RoleOwner).Scan(&owners)
+	if err != nil {
+		return "", fmt.Errorf("failed to count owners: %w", err)
+	}
+
+	if owners == 0 {
+		var memberID int
+		err = tx.QueryRow(`
+			SELECT id, user_id FROM convmembers
+			WHERE conversation_id = ?
+			ORDER BY CASE WHEN role = ? THEN 0 ELSE 1 END, id
+			LIMIT 1;
+		`, groupID, RoleAdmin).Scan(&memberID, &newOwnerID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("failed to choose the new owner: %w", err)
+		}
+		if err == nil {
+			_, err = tx.Exec(`UPDATE convmembers SET role = ? WHERE id = ?;`, RoleOwner, memberID)
+			if err != nil {
+				return "", fmt.Errorf("failed to transfer ownership: %w", err)
+			}
+		}
+	}
+
+	return newOwnerID, tx.Commit()
+}
+
+// GetGroupPermissions returns the minimum role needed for each change of the group.
+func (db *appdbimpl) GetGroupPermissions(groupID int) (GroupPermissions, error) {
+	var perms GroupPermissions
+	err := db.c.QueryRow(`
+		SELECT perm_rename, perm_change_photo, perm_add_members FROM conversations WHERE id = ?;
+	`, groupID).Scan(&perms.Rename, &perms.ChangePhoto, &perms.AddMembers)
+	return perms, err
+}
+
+// UpdateGroupPermissions replaces the permissions of the group.
+func (db *appdbimpl) UpdateGroupPermissions(groupID int, perms GroupPermissions) error {
+	_, err := db.c.Exec(`
+		UPDATE conversations SET perm_rename = ?, perm_change_photo = ?, perm_add_members = ? WHERE id = ?;
+	`, perms.Rename, perms.ChangePhoto, perms.AddMembers, groupID)
+	return err
+}
@@ -0,0 +1,284 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrAlreadyMember is returned by JoinWithInvite and ApproveJoinRequest when the user is already in the group.
+var ErrAlreadyMember = errors.New("already a member of the group")
+
+// inviteSelect lists the columns scanned by scanInvite.
+const inviteSelect = `id, conversation_id, token, created_by, created_at, expires_at, max_uses, uses, requires_approval,
+	revoked_at`
+
+func scanInvite(row rowScanner) (GroupInvite, error) {
+	var invite GroupInvite
+	var expiresAt, revokedAt sql.NullTime
+	var maxUses sql.NullInt64
+	err := row.Scan(&invite.ID, &invite.ConversationID, &invite.Token, &invite.CreatedBy, &invite.CreatedAt,
+		&expiresAt, &maxUses, &invite.Uses, &invite.RequiresApproval, &revokedAt)
+	if err != nil {
+		return GroupInvite{}, err
+	}
+	if expiresAt.Valid {
+		invite.ExpiresAt = &expiresAt.Time
+	}
+	if maxUses.Valid {
+		n := int(maxUses.Int64)
+		invite.MaxUses = &n
+	}
+	if revokedAt.Valid {
+		invite.RevokedAt = &revokedAt.Time
+	}
+	return invite, nil
+}
+
+// CreateInvite stores a new invite (ID and Uses are ignored and assigned by the database).
+func (db *appdbimpl) CreateInvite(invite GroupInvite) (GroupInvite, error) {
+	var expiresAt interface{}
+	if invite.ExpiresAt != nil {
+		expiresAt = *invite.ExpiresAt
+	}
+	var maxUses interface{}
+	if invite.MaxUses != nil {
+		maxUses = *invite.MaxUses
+	}
+	query := `
+		INSERT INTO group_invites (conversation_id, token, created_by, created_at, expires_at, max_uses, requires_approval)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		RETURNING id;
+	`
+	err := db.c.QueryRow(query, invite.ConversationID, invite.Token, invite.CreatedBy, invite.CreatedAt, expiresAt,
+		maxUses, invite.RequiresApproval).Scan(&invite.ID)
+	if err != nil {
+		return GroupInvite{}, err
+	}
+	invite.Uses = 0
+	return invite, nil
+}
+
+// GetInvites returns the invites of a group that were not revoked, the newest first. Expired and used up invites are
+// included, so that admins can see them.
+func (db *appdbimpl) GetInvites(groupID int) ([]GroupInvite, error) {
+	query := `SELECT ` + inviteSelect + ` FROM group_invites
+		WHERE conversation_id = ? AND revoked_at IS NULL
+		ORDER BY id DESC;`
+	rows, err := db.c.Query(query, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []GroupInvite{}
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+// GetInviteByToken returns the invite with the given token, revoked or not. It returns sql.ErrNoRows if there is no
+// such invite.
+func (db *appdbimpl) GetInviteByToken(token string) (GroupInvite, error) {
+	query := `SELECT ` + inviteSelect + ` FROM group_invites WHERE token = ?;`
+	return scanInvite(db.c.QueryRow(query, token))
+}
+
+// RevokeInvite marks an invite of the group as revoked, so that it can't be used anymore. Pending join requests made
+// with it are dropped. It returns false if the group has no such invite, or it was already revoked.
+func (db *appdbimpl) RevokeInvite(groupID int, inviteID int, revokedAt time.Time) (revoked bool, err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	res, err := tx.Exec(`
+		UPDATE group_invites SET revoked_at = ?
+		WHERE id = ? AND conversation_id = ? AND revoked_at IS NULL;
+	`, revokedAt, inviteID, groupID)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke invite: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, nil
+	}
+
+	_, err = tx.Exec(`DELETE FROM group_join_requests WHERE invite_id = ?;`, inviteID)
+	if err != nil {
+		return false, fmt.Errorf("failed to drop join requests: %w", err)
+	}
+	return true, tx.Commit()
+}
+
+// useInvite adds userID to the group of the invite as a member and counts a use of the invite. Unless force is set,
+// nothing is done and false is returned if the invite was revoked or has no uses left. ErrAlreadyMember is returned
+// if the user is already in the group; the membership is checked in tx, so concurrent joins add the user only once.
+func useInvite(tx *tx, invite GroupInvite, userID string, force bool) (bool, error) {
+	res, err := tx.Exec(`
+		INSERT INTO convmembers (user_id, conversation_id, role) VALUES (?, ?, ?)
+		ON CONFLICT (conversation_id, user_id) DO NOTHING;
+	`, userID, invite.ConversationID, RoleMember)
+	if err != nil {
+		return false, fmt.Errorf("failed to add member: %w", err)
+	}
+	added, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if added == 0 {
+		return false, ErrAlreadyMember
+	}
+
+	query := `UPDATE group_invites SET uses = uses + 1 WHERE id = ?`
+	if !force {
+		query += ` AND revoked_at IS NULL AND (max_uses IS NULL OR uses < max_uses)`
+	}
+	res, err = tx.Exec(query+`;`, invite.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to count invite use: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0 || force, nil
+}
+
+// JoinWithInvite adds userID to the group of the invite, counting one use. It returns false if the invite was revoked
+// or has no uses left; the check is done atomically, so concurrent joins can't exceed MaxUses. ErrAlreadyMember is
+// returned if the user is already in the group.
+func (db *appdbimpl) JoinWithInvite(invite GroupInvite, userID string) (joined bool, err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	joined, err = useInvite(tx, invite, userID, false)
+	if err != nil || !joined {
+		return false, err
+	}
+	_, err = tx.Exec(`DELETE FROM group_join_requests WHERE conversation_id = ? AND user_id = ?;`,
+		invite.ConversationID, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to drop join request: %w", err)
+	}
+	return true, tx.Commit()
+}
+
+// RequestToJoin stores a pending request of userID to join the group of the invite. A previous request of the same
+// user is replaced.
+func (db *appdbimpl) RequestToJoin(invite GroupInvite, userID string, createdAt time.Time) error {
+	_, err := db.c.Exec(`
+		INSERT INTO group_join_requests (conversation_id, user_id, invite_id, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (conversation_id, user_id) DO UPDATE SET invite_id = excluded.invite_id, created_at = excluded.created_at;
+	`, invite.ConversationID, userID, invite.ID, createdAt)
+	return err
+}
+
+// GetJoinRequests returns the pending join requests of a group, the oldest first.
+func (db *appdbimpl) GetJoinRequests(groupID int) ([]JoinRequest, error) {
+	query := `
+		SELECT jr.conversation_id, jr.user_id, u.name, u.photo, jr.invite_id, jr.created_at
+		FROM group_join_requests jr
+		JOIN users u ON u.id = jr.user_id
+		WHERE jr.conversation_id = ?
+		ORDER BY jr.created_at, jr.user_id;
+	`
+	rows, err := db.c.Query(query, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []JoinRequest{}
+	for rows.Next() {
+		var req JoinRequest
+		err := rows.Scan(&req.ConversationID, &req.UserID, &req.Username, &req.Photo, &req.InviteID, &req.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// ApproveJoinRequest adds userID to the group and counts a use of the invite the request was made with. The limits of
+// the invite are not checked again: the admin approving the request has the last word. It returns false if there is
+// no pending request, and ErrAlreadyMember (after dropping the request) if the user is already in the group.
+func (db *appdbimpl) ApproveJoinRequest(groupID int, userID string) (approved bool, err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	invite := GroupInvite{ConversationID: groupID}
+	err = tx.QueryRow(`SELECT invite_id FROM group_join_requests WHERE conversation_id = ? AND user_id = ?;`,
+		groupID, userID).Scan(&invite.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to fetch join request: %w", err)
+	}
+
+	_, err = tx.Exec(`DELETE FROM group_join_requests WHERE conversation_id = ? AND user_id = ?;`, groupID, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to drop join request: %w", err)
+	}
+	_, err = useInvite(tx, invite, userID, true)
+	if errors.Is(err, ErrAlreadyMember) {
+		if err = tx.Commit(); err != nil {
+			return false, err
+		}
+		return false, ErrAlreadyMember
+	} else if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// RejectJoinRequest drops the pending request of userID to join the group. It returns false if there is no such
+// request.
+func (db *appdbimpl) RejectJoinRequest(groupID int, userID string) (bool, error) {
+	res, err := db.c.Exec(`DELETE FROM group_join_requests WHERE conversation_id = ? AND user_id = ?;`,
+		groupID, userID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
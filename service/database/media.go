@@ -0,0 +1,565 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UploadsPrefix is the path the files of the media store are served from: the URL of a file is UploadsPrefix followed
+// by its key.
+const UploadsPrefix = "/uploads/"
+
+// mediaSelect lists the columns scanned by scanMedia.
+const mediaSelect = `id, sha256, storage_key, owner_id, size, mime_type, created_at, content_type`
+
+func scanMedia(row rowScanner) (Media, error) {
+	var m Media
+	err := row.Scan(&m.ID, &m.SHA256, &m.Key, &m.OwnerID, &m.Size, &m.MIMEType, &m.CreatedAt, &m.ContentType)
+	return m, err
+}
+
+// ErrQuotaExceeded is returned by RecordMedia when the owner of a file has no room left for it.
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// RecordMedia records that m.OwnerID uploaded a file (ID is ignored and assigned by the database), and adds it to the
+// storage usage of the owner. If the owner already uploaded the same content, the existing record is returned with
+// CreatedAt set to m.CreatedAt (the grace period of the upload GC starts over), and the usage doesn't change. With
+// quota > 0, it returns ErrQuotaExceeded if the file would bring the usage of the owner over quota bytes.
+func (db *appdbimpl) RecordMedia(m Media, quota int64) (_ Media, err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Media{}, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	query := `SELECT ` + mediaSelect + ` FROM media WHERE sha256 = ? AND owner_id = ?;`
+	uploadedAgain := func() (Media, error) {
+		_, err := tx.Exec(`UPDATE media SET created_at = ? WHERE sha256 = ? AND owner_id = ?;`,
+			m.CreatedAt, m.SHA256, m.OwnerID)
+		if err != nil {
+			return Media{}, err
+		}
+		existing, err := scanMedia(tx.QueryRow(query, m.SHA256, m.OwnerID))
+		if err != nil {
+			return Media{}, err
+		}
+		return existing, tx.Commit()
+	}
+
+	_, err = scanMedia(tx.QueryRow(query, m.SHA256, m.OwnerID))
+	if err == nil {
+		return uploadedAgain()
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return Media{}, err
+	}
+
+	if quota > 0 {
+		// Concurrent uploads of the owner would all see the usage before the others. SQLite has a single writer;
+		// PostgreSQL needs the row of the owner to be locked until the end of the transaction, which serializes the
+		// uploads of a user.
+		if db.c.driver == DriverPostgres {
+			_, err = tx.Exec(`SELECT id FROM users WHERE id = ? FOR NO KEY UPDATE;`, m.OwnerID)
+			if err != nil {
+				return Media{}, err
+			}
+		}
+		var used int64
+		err = tx.QueryRow(`SELECT COALESCE(SUM(bytes), 0) FROM storage_usage WHERE user_id = ?;`, m.OwnerID).Scan(&used)
+		if err != nil {
+			return Media{}, err
+		}
+		if used+m.Size > quota {
+			return Media{}, ErrQuotaExceeded
+		}
+	}
+
+	// A concurrent upload of the same content may have been recorded since: it's counted already
+	result, err := tx.Exec(`
+		INSERT INTO media (sha256, storage_key, owner_id, size, mime_type, created_at, content_type)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (sha256, owner_id) DO NOTHING;
+	`, m.SHA256, m.Key, m.OwnerID, m.Size, m.MIMEType, m.CreatedAt, m.ContentType)
+	if err != nil {
+		return Media{}, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return Media{}, err
+	} else if inserted == 0 {
+		return uploadedAgain()
+	}
+	_, err = tx.Exec(`
+		INSERT INTO storage_usage (user_id, content_type, files, bytes)
+		VALUES (?, ?, 1, ?)
+		ON CONFLICT (user_id, content_type) DO UPDATE
+		SET files = storage_usage.files + 1, bytes = storage_usage.bytes + excluded.bytes;
+	`, m.OwnerID, m.ContentType, m.Size)
+	if err != nil {
+		return Media{}, err
+	}
+
+	m, err = scanMedia(tx.QueryRow(query, m.SHA256, m.OwnerID))
+	if err != nil {
+		return Media{}, err
+	}
+	return m, tx.Commit()
+}
+
+// GetStorageUsage returns the storage usage of a user by content type, for the content types with uploads.
+func (db *appdbimpl) GetStorageUsage(userID string) ([]StorageUsage, error) {
+	rows, err := db.c.Query(`
+		SELECT content_type, files, bytes FROM storage_usage
+		WHERE user_id = ? AND files > 0
+		ORDER BY content_type;
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []StorageUsage{}
+	for rows.Next() {
+		var u StorageUsage
+		if err := rows.Scan(&u.ContentType, &u.Files, &u.Bytes); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// GetMediaByKey returns the first record of the file with the given store key. It returns sql.ErrNoRows if there is
+// none, e.g. for the files uploaded before the media store existed.
+func (db *appdbimpl) GetMediaByKey(key string) (Media, error) {
+	query := `SELECT ` + mediaSelect + ` FROM media WHERE storage_key = ? ORDER BY id LIMIT 1;`
+	return scanMedia(db.c.QueryRow(query, key))
+}
+
+// OwnsMedia returns true if userID uploaded a file with the given SHA-256.
+func (db *appdbimpl) OwnsMedia(sha256 string, userID string) (bool, error) {
+	var owned bool
+	err := db.c.QueryRow(`SELECT EXISTS (SELECT 1 FROM media WHERE sha256 = ? AND owner_id = ?);`, sha256, userID).
+		Scan(&owned)
+	return owned, err
+}
+
+// AddMediaVariants records the resized variants of the file with the given store key. Variants that were already
+// recorded are left as they are.
+func (db *appdbimpl) AddMediaVariants(key string, variants []MediaVariant) error {
+	for _, v := range variants {
+		_, err := db.c.Exec(`
+			INSERT INTO media_variants (storage_key, variant, variant_key, width, height, mime_type)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (storage_key, variant) DO NOTHING;
+		`, key, v.Name, v.Key, v.Width, v.Height, v.MIMEType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadKeys returns the distinct store keys of the files with the given URLs, as query arguments. URLs outside of
+// UploadsPrefix are skipped.
+func uploadKeys(urls []string) []interface{} {
+	var args []interface{}
+	seen := map[string]bool{}
+	for _, url := range urls {
+		key, ok := strings.CutPrefix(url, UploadsPrefix)
+		if ok && key != "" && !seen[key] {
+			seen[key] = true
+			args = append(args, key)
+		}
+	}
+	return args
+}
+
+// GetMediaVariants returns the URLs of the variants of the files with the given URLs, indexed by file URL and variant
+// name. Files without variants (e.g., uploaded before they existed, or not images) are missing from the result.
+func (db *appdbimpl) GetMediaVariants(urls []string) (map[string]map[string]string, error) {
+	result := map[string]map[string]string{}
+	args := uploadKeys(urls)
+	if len(args) == 0 {
+		return result, nil
+	}
+
+	query := `
+		SELECT storage_key, variant, variant_key FROM media_variants
+		WHERE storage_key IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ") + `);
+	`
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, name, variantKey string
+		if err := rows.Scan(&key, &name, &variantKey); err != nil {
+			return nil, err
+		}
+		url := UploadsPrefix + key
+		if result[url] == nil {
+			result[url] = map[string]string{}
+		}
+		result[url][name] = UploadsPrefix + variantKey
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// attachVariants fills the Variants field of the photo and GIF messages, and the SenderPhotoVariants field of every
+// message.
+func (db *appdbimpl) attachVariants(messages []MessageWithSender) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	urls := make([]string, 0, 2*len(messages))
+	for _, msg := range messages {
+		if msg.ContentType == "photo" || msg.ContentType == "gif" {
+			urls = append(urls, msg.Content)
+		}
+		if msg.SenderPhoto.Valid {
+			urls = append(urls, msg.SenderPhoto.String)
+		}
+	}
+
+	variants, err := db.GetMediaVariants(urls)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		if messages[i].ContentType == "photo" || messages[i].ContentType == "gif" {
+			messages[i].Variants = variants[messages[i].Content]
+		}
+		if messages[i].SenderPhoto.Valid {
+			messages[i].SenderPhotoVariants = variants[messages[i].SenderPhoto.String]
+		}
+	}
+	return nil
+}
+
+// AddMediaAudio records the duration and waveform of the audio file with the given store key, unless they were
+// already recorded.
+func (db *appdbimpl) AddMediaAudio(key string, audio AudioInfo) error {
+	waveform, err := json.Marshal(audio.Waveform)
+	if err != nil {
+		return err
+	}
+	_, err = db.c.Exec(`
+		INSERT INTO media_audio (storage_key, duration_ms, waveform)
+		VALUES (?, ?, ?)
+		ON CONFLICT (storage_key) DO NOTHING;
+	`, key, audio.DurationMS, string(waveform))
+	return err
+}
+
+// GetMediaAudio returns the duration and waveform of the audio files with the given URLs, indexed by URL. Files that
+// were not probed are missing from the result.
+func (db *appdbimpl) GetMediaAudio(urls []string) (map[string]AudioInfo, error) {
+	result := map[string]AudioInfo{}
+	args := uploadKeys(urls)
+	if len(args) == 0 {
+		return result, nil
+	}
+
+	query := `
+		SELECT storage_key, duration_ms, waveform FROM media_audio
+		WHERE storage_key IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ") + `);
+	`
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, waveform string
+		var audio AudioInfo
+		if err := rows.Scan(&key, &audio.DurationMS, &waveform); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(waveform), &audio.Waveform); err != nil {
+			return nil, err
+		}
+		result[UploadsPrefix+key] = audio
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// attachAudio fills the Audio field of the audio messages.
+func (db *appdbimpl) attachAudio(messages []MessageWithSender) error {
+	var urls []string
+	for _, msg := range messages {
+		if msg.ContentType == "audio" {
+			urls = append(urls, msg.Content)
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+
+	audio, err := db.GetMediaAudio(urls)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		if info, ok := audio[messages[i].Content]; ok && messages[i].ContentType == "audio" {
+			messages[i].Audio = &info
+		}
+	}
+	return nil
+}
+
+// GetReferencedUploads returns the store keys of the files that are still used: user and group photos, the content of
+// the messages and comments, and the variants of those files. Messages and comments left behind by groups deleted
+// without their content don't count. Photos set before the media store existed may be plain file names, without
+// UploadsPrefix.
+func (db *appdbimpl) GetReferencedUploads() (map[string]bool, error) {
+	rows, err := db.c.Query(`
+		SELECT photo FROM users WHERE photo IS NOT NULL AND photo <> ''
+		UNION
+		SELECT photo FROM conversations WHERE photo IS NOT NULL AND photo <> ''
+		UNION
+		SELECT m.content FROM messages m
+		JOIN conversations c ON c.id = m.conversation_id
+		WHERE m.content LIKE ?
+		UNION
+		SELECT mc.content FROM message_comments mc
+		JOIN messages m ON m.id = mc.message_id
+		JOIN conversations c ON c.id = m.conversation_id
+		WHERE mc.content LIKE ?;
+	`, UploadsPrefix+"%", UploadsPrefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := map[string]bool{}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		keys[strings.TrimPrefix(url, UploadsPrefix)] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	variants, err := db.c.Query(`SELECT storage_key, variant_key FROM media_variants;`)
+	if err != nil {
+		return nil, err
+	}
+	defer variants.Close()
+
+	for variants.Next() {
+		var key, variantKey string
+		if err := variants.Scan(&key, &variantKey); err != nil {
+			return nil, err
+		}
+		if keys[key] {
+			keys[variantKey] = true
+		}
+	}
+	if err = variants.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// GetUploadTimes returns when each file of the media store was last uploaded, by store key. Variants get the time of
+// their original. Files uploaded before the media store existed are missing.
+func (db *appdbimpl) GetUploadTimes() (map[string]time.Time, error) {
+	rows, err := db.c.Query(`
+		SELECT storage_key, MAX(created_at) FROM media GROUP BY storage_key
+		UNION ALL
+		SELECT v.variant_key, MAX(m.created_at)
+		FROM media_variants v
+		JOIN media m ON m.storage_key = v.storage_key
+		GROUP BY v.variant_key;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	times := map[string]time.Time{}
+	for rows.Next() {
+		var key string
+		var uploaded time.Time
+		if err := rows.Scan(&key, timestamp{&uploaded}); err != nil {
+			return nil, err
+		}
+		if uploaded.After(times[key]) {
+			times[key] = uploaded
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return times, nil
+}
+
+// UploadInUse reports whether the file with the given store key is referenced (see GetReferencedUploads), or was
+// uploaded after since. A variant is in use if its original is. The upload GC checks each file again with it right
+// before deleting it: references may have been added since the sweep loaded them.
+func (db *appdbimpl) UploadInUse(key string, since time.Time) (bool, error) {
+	original := key
+	err := db.c.QueryRow(`SELECT storage_key FROM media_variants WHERE variant_key = ?;`, key).Scan(&original)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	url := UploadsPrefix + original
+	var uses int
+	err = db.c.QueryRow(`
+		SELECT COUNT(*) FROM (
+			SELECT 1 FROM users WHERE photo IN (?, ?)
+			UNION ALL
+			SELECT 1 FROM conversations WHERE photo IN (?, ?)
+			UNION ALL
+			SELECT 1 FROM messages m
+			JOIN conversations c ON c.id = m.conversation_id
+			WHERE m.content = ?
+			UNION ALL
+			SELECT 1 FROM message_comments mc
+			JOIN messages m ON m.id = mc.message_id
+			JOIN conversations c ON c.id = m.conversation_id
+			WHERE mc.content = ?
+			UNION ALL
+			SELECT 1 FROM media WHERE storage_key = ? AND created_at > ?
+		) uses;
+	`, url, original, url, original, url, url, original, since.UTC()).Scan(&uses)
+	return uses > 0, err
+}
+
+// releaseUnusedMedia is called in tx when messages, comments or photos with the given URLs go away. The uploads of
+// those files whose owner doesn't use them anymore (in a message or comment of their own, as their photo or as a group
+// photo) are forgotten, and the space they used is released from the storage usage of the owner. The files themselves
+// are left to the upload GC: others may still use them.
+func releaseUnusedMedia(tx *tx, urls ...string) error {
+	released := map[string]bool{}
+	for _, url := range urls {
+		if !strings.HasPrefix(url, UploadsPrefix) || released[url] {
+			continue
+		}
+		released[url] = true
+
+		rows, err := tx.Query(`SELECT `+mediaSelect+` FROM media WHERE storage_key = ?;`,
+			strings.TrimPrefix(url, UploadsPrefix))
+		if err != nil {
+			return err
+		}
+		var uploads []Media
+		for rows.Next() {
+			upload, err := scanMedia(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			uploads = append(uploads, upload)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, upload := range uploads {
+			var uses int
+			err = tx.QueryRow(`
+				SELECT COUNT(*) FROM (
+					SELECT 1 FROM messages m
+					JOIN conversations c ON c.id = m.conversation_id
+					WHERE m.sender = ? AND m.content = ?
+					UNION ALL
+					SELECT 1 FROM message_comments mc
+					JOIN messages m ON m.id = mc.message_id
+					JOIN conversations c ON c.id = m.conversation_id
+					WHERE mc.user_id = ? AND mc.content = ?
+					UNION ALL
+					SELECT 1 FROM users WHERE id = ? AND photo = ?
+					UNION ALL
+					SELECT 1 FROM conversations WHERE photo = ?
+				) uses;
+			`, upload.OwnerID, url, upload.OwnerID, url, upload.OwnerID, url, url).Scan(&uses)
+			if err != nil {
+				return err
+			}
+			if uses > 0 {
+				continue
+			}
+
+			if _, err = tx.Exec(`DELETE FROM media WHERE id = ?;`, upload.ID); err != nil {
+				return fmt.Errorf("failed to delete upload: %w", err)
+			}
+			_, err = tx.Exec(`
+				UPDATE storage_usage SET files = files - 1, bytes = bytes - ?
+				WHERE user_id = ? AND content_type = ?;
+			`, upload.Size, upload.OwnerID, upload.ContentType)
+			if err != nil {
+				return fmt.Errorf("failed to update storage usage: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteMediaRecords forgets a file deleted from the media store: its uploads, its variants (as an original or as a
+// variant) and its audio details. The storage usage of its owners is updated.
+func (db *appdbimpl) DeleteMediaRecords(key string) (err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	if _, err = tx.Exec(`DELETE FROM media_variants WHERE storage_key = ? OR variant_key = ?;`, key, key); err != nil {
+		return fmt.Errorf("failed to delete variants: %w", err)
+	}
+	if _, err = tx.Exec(`DELETE FROM media_audio WHERE storage_key = ?;`, key); err != nil {
+		return fmt.Errorf("failed to delete audio details: %w", err)
+	}
+
+	// Release the space used by the owners of the file
+	_, err = tx.Exec(`
+		UPDATE storage_usage
+		SET files = files - (
+				SELECT COUNT(*) FROM media m
+				WHERE m.storage_key = ? AND m.owner_id = storage_usage.user_id
+				  AND m.content_type = storage_usage.content_type
+			),
+			bytes = bytes - (
+				SELECT COALESCE(SUM(m.size), 0) FROM media m
+				WHERE m.storage_key = ? AND m.owner_id = storage_usage.user_id
+				  AND m.content_type = storage_usage.content_type
+			)
+		WHERE user_id IN (SELECT owner_id FROM media WHERE storage_key = ?);
+	`, key, key, key)
+	if err != nil {
+		return fmt.Errorf("failed to update storage usage: %w", err)
+	}
+	if _, err = tx.Exec(`DELETE FROM media WHERE storage_key = ?;`, key); err != nil {
+		return fmt.Errorf("failed to delete uploads: %w", err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,252 @@
+package database
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shabdaanov1/wasa/service/globaltime"
+)
+
+// migrationFiles holds the schema migrations, embedded in the executable, in one directory per driver. Each file is
+// named NNNN_description.sql, where NNNN is the schema version it brings the database to. Files are applied in
+// order, each in its own transaction, and must never change once released: add a new file instead. A schema change
+// needs a file for each driver, with the same version.
+//
+// A migration that starts with a "-- optional:" line needs a SQLite module that may not be compiled in (e.g., FTS5).
+// Without it, the migration is skipped and not recorded: it's tried again at the next start.
+//
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+// migrationsDirs maps the drivers to their migrations directory.
+var migrationsDirs = map[string]string{
+	DriverSQLite:   "sqlite",
+	DriverPostgres: "postgres",
+}
+
+// migration is a single schema change.
+type migration struct {
+	version    int
+	name       string
+	statements []string
+
+	// optional is true if the migration can be skipped when a module is missing
+	optional bool
+}
+
+// loadMigrations reads and sorts the embedded migrations of the driver.
+func loadMigrations(driver string) ([]migration, error) {
+	dir := path.Join("migrations", migrationsDirs[driver])
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		name := entry.Name()
+		prefix, _, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{
+			version:    version,
+			name:       strings.TrimSuffix(name, ".sql"),
+			statements: splitStatements(string(content)),
+			optional:   strings.HasPrefix(string(content), "-- optional:"),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i := range migrations {
+		if migrations[i].version != i+1 {
+			return nil, fmt.Errorf("missing or duplicate migration version %d", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// splitStatements splits a migration file in statements: they end with a ";" at the end of a line. Comment lines
+// ("--") are removed. Trigger bodies (BEGIN ... END;) are kept in one piece.
+func splitStatements(content string) []string {
+	var statements []string
+	var current strings.Builder
+	inBody := false
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+
+		upper := strings.ToUpper(trimmed)
+		if upper == "BEGIN" {
+			inBody = true
+		}
+		if strings.HasSuffix(trimmed, ";") && (!inBody || upper == "END;") {
+			statements = append(statements, strings.TrimSpace(current.String()))
+			current.Reset()
+			inBody = false
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// Migrate brings the schema of the database to the latest version embedded in the executable, and returns the
+// version before and after. It's called by New, so calling it directly is only needed to migrate without starting
+// the application.
+//
+// SQLite databases created before versioned migrations existed have no schema_version table, but already have some
+// of the tables. They are adopted by running every migration, ignoring the changes that are already there.
+func Migrate(driver string, db *sql.DB) (from int, to int, err error) {
+	c, err := newConn(driver, db)
+	if err != nil {
+		return 0, 0, err
+	}
+	return migrate(c)
+}
+
+func migrate(c *conn) (from int, to int, err error) {
+	migrations, err := loadMigrations(c.driver)
+	if err != nil {
+		return 0, 0, fmt.Errorf("loading migrations: %w", err)
+	}
+
+	legacy, err := tableExists(c, "users")
+	if err != nil {
+		return 0, 0, err
+	}
+	versioned, err := tableExists(c, "schema_version")
+	if err != nil {
+		return 0, 0, err
+	}
+	legacy = legacy && !versioned && c.driver == DriverSQLite
+
+	_, err = c.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		return 0, 0, fmt.Errorf("creating schema_version: %w", err)
+	}
+
+	applied, err := appliedVersions(c)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading schema version: %w", err)
+	}
+	for version := range applied {
+		from = max(from, version)
+	}
+	if from > len(migrations) {
+		return from, from, fmt.Errorf("the database schema (version %d) is newer than this executable (version %d)",
+			from, len(migrations))
+	}
+
+	// Versions are applied in order, but an optional migration that was skipped can be older than the current version
+	to = from
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		err := applyMigration(c, m, legacy)
+		if m.optional && isMissingModuleError(err) {
+			continue
+		} else if err != nil {
+			return from, to, fmt.Errorf("applying migration %s: %w", m.name, err)
+		}
+		to = max(to, m.version)
+	}
+	return from, to, nil
+}
+
+// appliedVersions returns the versions recorded in schema_version.
+func appliedVersions(c *conn) (map[int]bool, error) {
+	rows, err := c.Query(`SELECT version FROM schema_version;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// applyMigration runs the statements of m and records the new version, in a single transaction. In legacy mode,
+// errors about columns or tables that already exist are ignored.
+func applyMigration(c *conn, m migration, legacy bool) (err error) {
+	tx, err := c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	for _, stmt := range m.statements {
+		if _, err = tx.Exec(stmt); err != nil {
+			if legacy && isAlreadyExistsError(err) {
+				continue
+			}
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?);`,
+		m.version, m.name, globaltime.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("recording schema version: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// isAlreadyExistsError returns true for the errors caused by adding a column or table that is already there.
+func isAlreadyExistsError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "duplicate column name") || strings.Contains(msg, "already exists")
+}
+
+// isMissingModuleError returns true for the errors caused by using a SQLite module that is not compiled in.
+func isMissingModuleError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no such module")
+}
+
+func tableExists(c *conn, name string) (bool, error) {
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?;`
+	if c.driver == DriverPostgres {
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?;`
+	}
+
+	var count int
+	if err := c.QueryRow(query, name).Scan(&count); err != nil {
+		return false, fmt.Errorf("checking table %s: %w", name, err)
+	}
+	return count > 0, nil
+}
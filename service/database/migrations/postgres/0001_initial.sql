@@ -0,0 +1,46 @@
+-- Schema of the first release. Unlike SQLite, PostgreSQL enforces foreign keys: rows that belong to a deleted
+-- conversation or message are deleted with it.
+
+CREATE TABLE IF NOT EXISTS users (
+	id VARCHAR(64) PRIMARY KEY NOT NULL,
+	name VARCHAR(25) NOT NULL,
+	photo VARCHAR(255)
+);
+
+CREATE TABLE IF NOT EXISTS conversations (
+	id SERIAL PRIMARY KEY NOT NULL,
+	lastconvo TIMESTAMPTZ NOT NULL,
+	is_group BOOLEAN DEFAULT FALSE,
+	photo VARCHAR(255),
+	name VARCHAR(255)
+);
+
+CREATE TABLE IF NOT EXISTS convmembers (
+	id SERIAL PRIMARY KEY NOT NULL,
+	conversation_id INTEGER NOT NULL,
+	user_id VARCHAR(64) NOT NULL,
+	FOREIGN KEY (conversation_id) REFERENCES conversations (id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	id SERIAL PRIMARY KEY NOT NULL,
+	datetime TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	content TEXT NOT NULL,
+	sender VARCHAR(64) NOT NULL,
+	conversation_id INTEGER NOT NULL,
+	status VARCHAR(20) DEFAULT 'sent',
+	FOREIGN KEY (sender) REFERENCES users (id),
+	FOREIGN KEY (conversation_id) REFERENCES conversations (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS message_comments (
+	id SERIAL PRIMARY KEY NOT NULL,
+	message_id INTEGER NOT NULL,
+	user_id VARCHAR(64) NOT NULL,
+	content_type VARCHAR(10) CHECK (content_type IN ('text', 'emoji', 'photo', 'gif')) NOT NULL,
+	content TEXT NOT NULL,
+	timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (message_id) REFERENCES messages (id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
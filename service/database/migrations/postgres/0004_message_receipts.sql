@@ -0,0 +1,11 @@
+-- Per-member delivery and read receipts.
+
+CREATE TABLE IF NOT EXISTS message_receipts (
+	message_id INTEGER NOT NULL,
+	user_id VARCHAR(64) NOT NULL,
+	delivered_at TIMESTAMPTZ,
+	read_at TIMESTAMPTZ,
+	PRIMARY KEY (message_id, user_id),
+	FOREIGN KEY (message_id) REFERENCES messages (id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
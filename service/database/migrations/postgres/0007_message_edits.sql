@@ -0,0 +1,13 @@
+-- Message editing, with the history of the previous versions.
+
+ALTER TABLE messages ADD COLUMN edited_at TIMESTAMPTZ DEFAULT NULL;
+
+CREATE TABLE IF NOT EXISTS message_edits (
+	id SERIAL PRIMARY KEY NOT NULL,
+	message_id INTEGER NOT NULL,
+	previous_content TEXT NOT NULL,
+	edited_at TIMESTAMPTZ NOT NULL,
+	FOREIGN KEY (message_id) REFERENCES messages (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_edits_message ON message_edits (message_id, id);
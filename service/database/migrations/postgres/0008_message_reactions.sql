@@ -0,0 +1,11 @@
+-- Emoji reactions, at most one of each emoji per user and message.
+
+CREATE TABLE IF NOT EXISTS message_reactions (
+	message_id INTEGER NOT NULL,
+	user_id VARCHAR(64) NOT NULL,
+	emoji VARCHAR(32) NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (message_id, user_id, emoji),
+	FOREIGN KEY (message_id) REFERENCES messages (id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
@@ -0,0 +1,11 @@
+-- Resized variants (avatar, thumbnail, preview, GIF poster) of the uploaded images.
+
+CREATE TABLE IF NOT EXISTS media_variants (
+	storage_key VARCHAR(128) NOT NULL,
+	variant VARCHAR(32) NOT NULL,
+	variant_key VARCHAR(128) NOT NULL,
+	width INTEGER NOT NULL,
+	height INTEGER NOT NULL,
+	mime_type VARCHAR(128) NOT NULL,
+	PRIMARY KEY (storage_key, variant)
+);
@@ -0,0 +1,12 @@
+-- Duration and waveform summary of the uploaded audio files (voice notes). Comments can hold audio too.
+
+CREATE TABLE IF NOT EXISTS media_audio (
+	storage_key VARCHAR(128) NOT NULL PRIMARY KEY,
+	duration_ms BIGINT NOT NULL,
+	waveform TEXT NOT NULL
+);
+
+ALTER TABLE message_comments DROP CONSTRAINT IF EXISTS message_comments_content_type_check;
+
+ALTER TABLE message_comments ADD CONSTRAINT message_comments_content_type_check
+	CHECK (content_type IN ('text', 'emoji', 'photo', 'gif', 'audio'));
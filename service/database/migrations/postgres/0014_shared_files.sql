@@ -0,0 +1,32 @@
+-- Files (documents, archives, ...) sent in messages and comments, with their original name. Comments can hold
+-- files too.
+
+CREATE TABLE IF NOT EXISTS shared_files (
+	id SERIAL PRIMARY KEY NOT NULL,
+	conversation_id INTEGER NOT NULL,
+	message_id INTEGER,
+	comment_id INTEGER,
+	uploader_id VARCHAR(64) NOT NULL,
+	storage_key VARCHAR(128) NOT NULL,
+	filename VARCHAR(255) NOT NULL,
+	size BIGINT NOT NULL,
+	mime_type VARCHAR(255) NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	FOREIGN KEY (conversation_id) REFERENCES conversations (id) ON DELETE CASCADE,
+	FOREIGN KEY (message_id) REFERENCES messages (id) ON DELETE CASCADE,
+	FOREIGN KEY (comment_id) REFERENCES message_comments (id) ON DELETE CASCADE,
+	FOREIGN KEY (uploader_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_shared_files_conversation ON shared_files (conversation_id, id);
+
+CREATE INDEX IF NOT EXISTS idx_shared_files_message ON shared_files (message_id);
+
+CREATE INDEX IF NOT EXISTS idx_shared_files_comment ON shared_files (comment_id);
+
+CREATE INDEX IF NOT EXISTS idx_shared_files_storage_key ON shared_files (storage_key);
+
+ALTER TABLE message_comments DROP CONSTRAINT IF EXISTS message_comments_content_type_check;
+
+ALTER TABLE message_comments ADD CONSTRAINT message_comments_content_type_check
+	CHECK (content_type IN ('text', 'emoji', 'photo', 'gif', 'audio', 'file'));
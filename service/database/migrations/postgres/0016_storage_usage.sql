@@ -0,0 +1,23 @@
+-- Storage accounting: the bytes and files uploaded by each user, by content type, for the storage quotas. Uploads are
+-- counted once per owner (see media); they are released when the upload GC deletes the file.
+
+ALTER TABLE media ADD COLUMN content_type VARCHAR(10) NOT NULL DEFAULT 'file';
+
+UPDATE media SET content_type = CASE
+	WHEN mime_type = 'image/gif' THEN 'gif'
+	WHEN mime_type LIKE 'image/%' THEN 'photo'
+	WHEN mime_type LIKE 'audio/%' THEN 'audio'
+	ELSE 'file'
+END;
+
+CREATE TABLE IF NOT EXISTS storage_usage (
+	user_id VARCHAR(64) NOT NULL,
+	content_type VARCHAR(10) NOT NULL,
+	files INTEGER NOT NULL DEFAULT 0,
+	bytes BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (user_id, content_type),
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+INSERT INTO storage_usage (user_id, content_type, files, bytes)
+SELECT owner_id, content_type, COUNT(*), SUM(size) FROM media GROUP BY owner_id, content_type;
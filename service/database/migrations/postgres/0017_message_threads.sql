@@ -0,0 +1,3 @@
+-- Reply threads: the replies of a message are found through reply_to, recursively.
+
+CREATE INDEX IF NOT EXISTS idx_messages_reply_to ON messages (reply_to);
@@ -0,0 +1,4 @@
+-- Full-text index of the text messages.
+
+CREATE INDEX IF NOT EXISTS idx_messages_search ON messages
+	USING GIN (to_tsvector('simple', content)) WHERE COALESCE(content_type, 'text') = 'text';
@@ -0,0 +1,20 @@
+-- A user is a member of a conversation at most once. Concurrent joins could add the same user twice: the duplicates
+-- are merged into the oldest row, which keeps the highest role and the furthest read position of the group.
+
+UPDATE convmembers SET
+	role = (
+		SELECT CASE MAX(CASE d.role WHEN 'owner' THEN 2 WHEN 'admin' THEN 1 ELSE 0 END)
+			WHEN 2 THEN 'owner' WHEN 1 THEN 'admin' ELSE 'member' END
+		FROM convmembers d
+		WHERE d.conversation_id = convmembers.conversation_id AND d.user_id = convmembers.user_id
+	),
+	last_read_message_id = (
+		SELECT MAX(d.last_read_message_id)
+		FROM convmembers d
+		WHERE d.conversation_id = convmembers.conversation_id AND d.user_id = convmembers.user_id
+	)
+WHERE id IN (SELECT MIN(id) FROM convmembers GROUP BY conversation_id, user_id HAVING COUNT(*) > 1);
+
+DELETE FROM convmembers WHERE id NOT IN (SELECT MIN(id) FROM convmembers GROUP BY conversation_id, user_id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_convmembers_member ON convmembers (conversation_id, user_id);
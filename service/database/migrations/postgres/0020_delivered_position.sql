@@ -0,0 +1,5 @@
+-- Delivery position of each member: MarkDelivered only looks at the messages after it.
+
+ALTER TABLE convmembers ADD COLUMN last_delivered_message_id INTEGER DEFAULT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages (conversation_id, id);
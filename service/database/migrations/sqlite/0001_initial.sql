@@ -0,0 +1,45 @@
+-- Schema of the first release.
+
+CREATE TABLE IF NOT EXISTS users (
+	id VARCHAR(64),
+	name VARCHAR(25) NOT NULL,
+	photo VARCHAR(255)
+);
+
+CREATE TABLE IF NOT EXISTS conversations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	lastconvo TIMESTAMP NOT NULL,
+	is_group BOOLEAN DEFAULT FALSE,
+	photo VARCHAR(255),
+	name VARCHAR(255)
+);
+
+CREATE TABLE IF NOT EXISTS convmembers (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	conversation_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	FOREIGN KEY (conversation_id) REFERENCES conversations (id),
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	datetime TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	content TEXT NOT NULL,
+	sender INTEGER NOT NULL,
+	conversation_id INTEGER NOT NULL,
+	status VARCHAR(10) DEFAULT 'sent',
+	FOREIGN KEY (sender) REFERENCES users (id),
+	FOREIGN KEY (conversation_id) REFERENCES conversations (id)
+);
+
+CREATE TABLE IF NOT EXISTS message_comments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	message_id INTEGER NOT NULL,
+	user_id VARCHAR(64) NOT NULL,
+	content_type VARCHAR(10) CHECK (content_type IN ('text', 'emoji', 'photo', 'gif')) NOT NULL,
+	content TEXT NOT NULL,
+	timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (message_id) REFERENCES messages (id),
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
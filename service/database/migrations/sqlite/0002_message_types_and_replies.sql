@@ -0,0 +1,5 @@
+-- Photo/GIF messages and replies.
+
+ALTER TABLE messages ADD COLUMN content_type TEXT DEFAULT 'text';
+
+ALTER TABLE messages ADD COLUMN reply_to INTEGER DEFAULT NULL REFERENCES messages (id);
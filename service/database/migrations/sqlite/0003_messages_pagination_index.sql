@@ -0,0 +1,3 @@
+-- Cursor pagination of the messages of a conversation.
+
+CREATE INDEX IF NOT EXISTS idx_messages_conversation_datetime ON messages (conversation_id, datetime, id);
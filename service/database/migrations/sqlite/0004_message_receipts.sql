@@ -0,0 +1,11 @@
+-- Per-member delivery and read receipts.
+
+CREATE TABLE IF NOT EXISTS message_receipts (
+	message_id INTEGER NOT NULL,
+	user_id VARCHAR(64) NOT NULL,
+	delivered_at TIMESTAMP,
+	read_at TIMESTAMP,
+	PRIMARY KEY (message_id, user_id),
+	FOREIGN KEY (message_id) REFERENCES messages (id),
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
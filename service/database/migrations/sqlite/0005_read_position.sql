@@ -0,0 +1,3 @@
+-- Read position of each member, for the unread counters.
+
+ALTER TABLE convmembers ADD COLUMN last_read_message_id INTEGER DEFAULT NULL;
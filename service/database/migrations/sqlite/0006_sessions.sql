@@ -0,0 +1,16 @@
+-- Login sessions. Only the SHA-256 of the bearer token is stored.
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	user_id VARCHAR(64) NOT NULL,
+	token_hash VARCHAR(64) NOT NULL UNIQUE,
+	created_at TIMESTAMP NOT NULL,
+	last_used_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	device_label VARCHAR(64) NOT NULL DEFAULT '',
+	ip VARCHAR(64) NOT NULL DEFAULT '',
+	user_agent VARCHAR(255) NOT NULL DEFAULT '',
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions (user_id);
@@ -0,0 +1,13 @@
+-- Message editing, with the history of the previous versions.
+
+ALTER TABLE messages ADD COLUMN edited_at TIMESTAMP DEFAULT NULL;
+
+CREATE TABLE IF NOT EXISTS message_edits (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	message_id INTEGER NOT NULL,
+	previous_content TEXT NOT NULL,
+	edited_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (message_id) REFERENCES messages (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_edits_message ON message_edits (message_id, id);
@@ -0,0 +1,19 @@
+-- Group roles (owner, admin, member), and the minimum role needed for each group change. The first member of each
+-- existing group becomes its owner.
+
+ALTER TABLE convmembers ADD COLUMN role VARCHAR(10) NOT NULL DEFAULT 'member';
+
+ALTER TABLE conversations ADD COLUMN perm_rename VARCHAR(10) NOT NULL DEFAULT 'admin';
+
+ALTER TABLE conversations ADD COLUMN perm_change_photo VARCHAR(10) NOT NULL DEFAULT 'admin';
+
+ALTER TABLE conversations ADD COLUMN perm_add_members VARCHAR(10) NOT NULL DEFAULT 'admin';
+
+UPDATE convmembers SET role = 'owner'
+WHERE id IN (
+	SELECT MIN(cm.id)
+	FROM convmembers cm
+	JOIN conversations c ON c.id = cm.conversation_id
+	WHERE c.is_group = TRUE
+	GROUP BY cm.conversation_id
+);
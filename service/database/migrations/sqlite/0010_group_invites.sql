@@ -0,0 +1,29 @@
+-- Group invite links, and the join requests of the invites that need approval.
+
+CREATE TABLE IF NOT EXISTS group_invites (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	conversation_id INTEGER NOT NULL,
+	token VARCHAR(64) NOT NULL UNIQUE,
+	created_by VARCHAR(64) NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP DEFAULT NULL,
+	max_uses INTEGER DEFAULT NULL,
+	uses INTEGER NOT NULL DEFAULT 0,
+	requires_approval BOOLEAN NOT NULL DEFAULT FALSE,
+	revoked_at TIMESTAMP DEFAULT NULL,
+	FOREIGN KEY (conversation_id) REFERENCES conversations (id),
+	FOREIGN KEY (created_by) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_group_invites_conversation ON group_invites (conversation_id);
+
+CREATE TABLE IF NOT EXISTS group_join_requests (
+	conversation_id INTEGER NOT NULL,
+	user_id VARCHAR(64) NOT NULL,
+	invite_id INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (conversation_id, user_id),
+	FOREIGN KEY (conversation_id) REFERENCES conversations (id),
+	FOREIGN KEY (user_id) REFERENCES users (id),
+	FOREIGN KEY (invite_id) REFERENCES group_invites (id)
+);
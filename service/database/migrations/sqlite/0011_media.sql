@@ -0,0 +1,15 @@
+-- Files saved in the media store. The same content uploaded by several users is stored once, with one row per owner.
+
+CREATE TABLE IF NOT EXISTS media (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	sha256 VARCHAR(64) NOT NULL,
+	storage_key VARCHAR(128) NOT NULL,
+	owner_id VARCHAR(64) NOT NULL,
+	size INTEGER NOT NULL,
+	mime_type VARCHAR(128) NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	UNIQUE (sha256, owner_id),
+	FOREIGN KEY (owner_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_media_storage_key ON media (storage_key);
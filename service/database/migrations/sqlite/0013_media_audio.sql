@@ -0,0 +1,26 @@
+-- Duration and waveform summary of the uploaded audio files (voice notes). Comments can hold audio too: SQLite can't
+-- change a CHECK constraint, so message_comments is rebuilt.
+
+CREATE TABLE IF NOT EXISTS media_audio (
+	storage_key VARCHAR(128) NOT NULL PRIMARY KEY,
+	duration_ms INTEGER NOT NULL,
+	waveform TEXT NOT NULL
+);
+
+CREATE TABLE message_comments_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	message_id INTEGER NOT NULL,
+	user_id VARCHAR(64) NOT NULL,
+	content_type VARCHAR(10) CHECK (content_type IN ('text', 'emoji', 'photo', 'gif', 'audio')) NOT NULL,
+	content TEXT NOT NULL,
+	timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (message_id) REFERENCES messages (id),
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+INSERT INTO message_comments_new (id, message_id, user_id, content_type, content, timestamp)
+SELECT id, message_id, user_id, content_type, content, timestamp FROM message_comments;
+
+DROP TABLE message_comments;
+
+ALTER TABLE message_comments_new RENAME TO message_comments;
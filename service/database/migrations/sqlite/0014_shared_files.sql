@@ -0,0 +1,45 @@
+-- Files (documents, archives, ...) sent in messages and comments, with their original name. Comments can hold
+-- files too: SQLite can't change a CHECK constraint, so message_comments is rebuilt.
+
+CREATE TABLE IF NOT EXISTS shared_files (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	conversation_id INTEGER NOT NULL,
+	message_id INTEGER,
+	comment_id INTEGER,
+	uploader_id VARCHAR(64) NOT NULL,
+	storage_key VARCHAR(128) NOT NULL,
+	filename VARCHAR(255) NOT NULL,
+	size INTEGER NOT NULL,
+	mime_type VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (conversation_id) REFERENCES conversations (id),
+	FOREIGN KEY (message_id) REFERENCES messages (id),
+	FOREIGN KEY (comment_id) REFERENCES message_comments (id),
+	FOREIGN KEY (uploader_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_shared_files_conversation ON shared_files (conversation_id, id);
+
+CREATE INDEX IF NOT EXISTS idx_shared_files_message ON shared_files (message_id);
+
+CREATE INDEX IF NOT EXISTS idx_shared_files_comment ON shared_files (comment_id);
+
+CREATE INDEX IF NOT EXISTS idx_shared_files_storage_key ON shared_files (storage_key);
+
+CREATE TABLE message_comments_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	message_id INTEGER NOT NULL,
+	user_id VARCHAR(64) NOT NULL,
+	content_type VARCHAR(10) CHECK (content_type IN ('text', 'emoji', 'photo', 'gif', 'audio', 'file')) NOT NULL,
+	content TEXT NOT NULL,
+	timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (message_id) REFERENCES messages (id),
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+INSERT INTO message_comments_new (id, message_id, user_id, content_type, content, timestamp)
+SELECT id, message_id, user_id, content_type, content, timestamp FROM message_comments;
+
+DROP TABLE message_comments;
+
+ALTER TABLE message_comments_new RENAME TO message_comments;
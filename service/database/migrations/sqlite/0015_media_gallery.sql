@@ -0,0 +1,5 @@
+-- Media gallery of a conversation: its messages of a given type, newest first, and the comments of its messages.
+
+CREATE INDEX IF NOT EXISTS idx_messages_conversation_type ON messages (conversation_id, content_type, datetime, id);
+
+CREATE INDEX IF NOT EXISTS idx_message_comments_message ON message_comments (message_id);
@@ -0,0 +1,27 @@
+-- optional: needs SQLite built with FTS5 (-tags sqlite_fts5). Without it, message search is not available.
+-- Full-text index of the text messages: a plain FTS5 table whose rowid is the message ID, kept in sync with the
+-- messages table by triggers.
+
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(content, tokenize = 'unicode61 remove_diacritics 2');
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages
+WHEN COALESCE(new.content_type, 'text') = 'text'
+BEGIN
+	INSERT INTO messages_fts (rowid, content) VALUES (new.id, new.content);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages
+BEGIN
+	DELETE FROM messages_fts WHERE rowid = old.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content, content_type ON messages
+BEGIN
+	DELETE FROM messages_fts WHERE rowid = old.id;
+	INSERT INTO messages_fts (rowid, content)
+	SELECT new.id, new.content WHERE COALESCE(new.content_type, 'text') = 'text';
+END;
+
+-- Index the messages sent before this migration
+INSERT INTO messages_fts (rowid, content)
+SELECT id, content FROM messages WHERE COALESCE(content_type, 'text') = 'text';
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"strings"
+	"time"
+)
+
+// AddReaction adds the emoji reaction of userID to a message. It returns false if the user already reacted with the
+// same emoji.
+func (db *appdbimpl) AddReaction(messageID int, userID string, emoji string, createdAt time.Time) (bool, error) {
+	res, err := db.c.Exec(`
+		INSERT INTO message_reactions (message_id, user_id, emoji, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (message_id, user_id, emoji) DO NOTHING;
+	`, messageID, userID, emoji, createdAt)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// RemoveReaction removes the emoji reaction of userID from a message. It returns false if there was no such reaction.
+func (db *appdbimpl) RemoveReaction(messageID int, userID string, emoji string) (bool, error) {
+	res, err := db.c.Exec(`DELETE FROM message_reactions WHERE message_id = ? AND user_id = ? AND emoji = ?;`,
+		messageID, userID, emoji)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// GetReactions returns the reaction summaries of a message, as seen by viewerID.
+func (db *appdbimpl) GetReactions(messageID int, viewerID string) ([]ReactionSummary, error) {
+	reactions, err := db.getReactions([]int{messageID}, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	if reactions[messageID] == nil {
+		return []ReactionSummary{}, nil
+	}
+	return reactions[messageID], nil
+}
+
+// attachReactions fills the Reactions field of the messages, as seen by viewerID.
+func (db *appdbimpl) attachReactions(messages []MessageWithSender, viewerID string) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int, len(messages))
+	for i := range messages {
+		ids[i] = messages[i].ID
+	}
+
+	reactions, err := db.getReactions(ids, viewerID)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].ID]
+		if messages[i].Reactions == nil {
+			messages[i].Reactions = []ReactionSummary{}
+		}
+	}
+	return nil
+}
+
+// getReactions returns the reaction summaries of the messages, indexed by message ID. In each message, emojis are in
+// the order they were first used.
+func (db *appdbimpl) getReactions(messageIDs []int, viewerID string) (map[int][]ReactionSummary, error) {
+	args := make([]interface{}, 0, len(messageIDs)+1)
+	args = append(args, viewerID)
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+
+	query := `
+		SELECT message_id, emoji, COUNT(*), MAX(CASE WHEN user_id = ? THEN 1 ELSE 0 END)
+		FROM message_reactions
+		WHERE message_id IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(messageIDs)), ", ") + `)
+		GROUP BY message_id, emoji
+		ORDER BY message_id, MIN(created_at), emoji;
+	`
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := make(map[int][]ReactionSummary)
+	for rows.Next() {
+		var messageID, reactedByMe int
+		var reaction ReactionSummary
+		if err := rows.Scan(&messageID, &reaction.Emoji, &reaction.Count, &reactedByMe); err != nil {
+			return nil, err
+		}
+		reaction.ReactedByMe = reactedByMe == 1
+		reactions[messageID] = append(reactions[messageID], reaction)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return reactions, nil
+}
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// receiptSummarySelect computes the ReceiptSummary columns of a message `m`. Only receipts of current members of the
+// conversation are counted, so that the numbers never exceed the number of recipients.
+const receiptSummarySelect = `
+	  (SELECT COUNT(*) FROM convmembers rcm
+	   WHERE rcm.conversation_id = m.conversation_id AND rcm.user_id <> m.sender) AS receipt_recipients,
+	  (SELECT COUNT(*) FROM message_receipts r
+	   JOIN convmembers rcm ON rcm.user_id = r.user_id AND rcm.conversation_id = m.conversation_id
+	   WHERE r.message_id = m.id AND r.delivered_at IS NOT NULL) AS receipt_delivered,
+	  (SELECT COUNT(*) FROM message_receipts r
+	   JOIN convmembers rcm ON rcm.user_id = r.user_id AND rcm.conversation_id = m.conversation_id
+	   WHERE r.message_id = m.id AND r.read_at IS NOT NULL) AS receipt_read
+`
+
+// fillCheckmarks computes the Checkmarks field from the counters.
+func (s *ReceiptSummary) fillCheckmarks() {
+	switch {
+	case s.Recipients == 0:
+		s.Checkmarks = 0
+	case s.Read >= s.Recipients:
+		s.Checkmarks = 2
+	case s.Delivered >= s.Recipients:
+		s.Checkmarks = 1
+	default:
+		s.Checkmarks = 0
+	}
+}
+
+// MarkDelivered records that every message sent to userID, in any of their conversations, has been delivered. Only
+// the messages after the delivery position of each membership are looked at, and the position is then moved to the
+// newest of them.
+func (db *appdbimpl) MarkDelivered(userID string) (err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	type pending struct {
+		conversationID int
+		from, to       int
+	}
+	rows, err := tx.Query(`
+		SELECT cm.conversation_id, COALESCE(cm.last_delivered_message_id, 0), MAX(m.id)
+		FROM convmembers cm
+		JOIN messages m ON m.conversation_id = cm.conversation_id AND m.id > COALESCE(cm.last_delivered_message_id, 0)
+		WHERE cm.user_id = ?
+		GROUP BY cm.conversation_id, cm.last_delivered_message_id;
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to load delivery positions: %w", err)
+	}
+	var conversations []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.conversationID, &p.from, &p.to); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		conversations = append(conversations, p)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(conversations) == 0 {
+		return nil
+	}
+
+	// Only the messages up to the position are marked, as the newer ones (sent in the meantime) are not counted by the
+	// new position. Concurrent requests can mark the same messages: the first receipt is kept.
+	for _, p := range conversations {
+		_, err = tx.Exec(`
+			INSERT INTO message_receipts (message_id, user_id, delivered_at)
+			SELECT m.id, ?, CURRENT_TIMESTAMP
+			FROM messages m
+			WHERE m.conversation_id = ? AND m.sender <> ? AND m.id > ? AND m.id <= ?
+			ON CONFLICT (message_id, user_id) DO NOTHING;
+		`, userID, p.conversationID, userID, p.from, p.to)
+		if err != nil {
+			return fmt.Errorf("failed to store delivery receipts: %w", err)
+		}
+		_, err = tx.Exec(`
+			UPDATE convmembers SET last_delivered_message_id = ?
+			WHERE user_id = ? AND conversation_id = ?
+			  AND (last_delivered_message_id IS NULL OR last_delivered_message_id < ?);
+		`, p.to, userID, p.conversationID, p.to)
+		if err != nil {
+			return fmt.Errorf("failed to update delivery position: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// MarkConversationRead records that userID has read every message of the conversation up to (and including)
+// messageID: it moves the read position of the member forward (used for the unread counters), and stores a read
+// receipt for each message sent by the others. The message must belong to the conversation.
+func (db *appdbimpl) MarkConversationRead(userID string, conversationID int, messageID int) (err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	// The read position never goes back
+	_, err = tx.Exec(`
+		UPDATE convmembers SET last_read_message_id = ?
+		WHERE user_id = ? AND conversation_id = ?
+		  AND (last_read_message_id IS NULL OR last_read_message_id < ?);
+	`, messageID, userID, conversationID, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to update read position: %w", err)
+	}
+
+	query := `
+		INSERT INTO message_receipts (message_id, user_id, delivered_at, read_at)
+		SELECT m.id, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+		FROM messages m
+		WHERE m.conversation_id = ?
+		  AND m.sender <> ?
+		  AND (m.datetime, m.id) <= (SELECT datetime, id FROM messages WHERE id = ?)
+		ON CONFLICT (message_id, user_id) DO UPDATE SET
+			delivered_at = COALESCE(message_receipts.delivered_at, excluded.delivered_at),
+			read_at = COALESCE(message_receipts.read_at, excluded.read_at);
+	`
+	_, err = tx.Exec(query, userID, conversationID, userID, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to store read receipts: %w", err)
+	}
+
+	return tx.Commit()
+}
@@ -9,6 +9,10 @@ type User struct {
 	ID       string         `json:"id"`
 	Username string         `json:"username"`
 	Photo    sql.NullString `json:"photo"`
+
+	// URLs of the resized variants of Photo, by variant name. The queries of this package leave it empty: see
+	// GetMediaVariants.
+	PhotoVariants map[string]string `json:"photo_variants,omitempty"`
 }
 
 type Conversation struct {
@@ -17,9 +21,40 @@ type Conversation struct {
 	IsGroup   bool           `json:"is_group"`
 	Photo     sql.NullString `json:"photo"`
 	Name      string         `json:"name"`
+
+	// URLs of the resized variants of Photo, by variant name (e.g., "avatar")
+	PhotoVariants map[string]string `json:"photo_variants,omitempty"`
+
 	// NEW FIELDS:
 	LastMessage     sql.NullString `json:"last_message"`
 	LastMessageType sql.NullString `json:"last_message_type"`
+
+	// Messages from the other members after the read position of the user
+	UnreadCount          int  `json:"unread_count"`
+	FirstUnreadMessageID *int `json:"first_unread_message_id"` // nil if there are no unread messages
+}
+
+// ConversationSummary holds the fields of a Conversation (as returned by GetMyConversations_db) that change when a
+// message is sent, forwarded or deleted.
+type ConversationSummary struct {
+	ConversationID  int            `json:"conversation_id"`
+	LastMessage     sql.NullString `json:"last_message"`
+	LastMessageType sql.NullString `json:"last_message_type"`
+	LastConvo       time.Time      `json:"last_convo"`
+}
+
+// Session is a login of a user. The bearer token itself is never stored, only its hash.
+type Session struct {
+	ID         int       `json:"id"`
+	UserID     string    `json:"user_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+
+	// Where the session was created (DeviceLabel is chosen by the client at login) and last used from
+	DeviceLabel string `json:"device_label"`
+	IP          string `json:"ip"`
+	UserAgent   string `json:"user_agent"`
 }
 
 type Convmember struct {
@@ -53,7 +88,9 @@ type MessageWithSender struct {
 	ID             int            `json:"id"`
 	Datetime       time.Time      `json:"datetime"`
 	Content        string         `json:"content"`
+	ContentType    string         `json:"content_type"`
 	Status         string         `json:"status"`
+	EditedAt       *time.Time     `json:"edited_at"` // Time of the last edit, nil if the message was never edited
 	SenderID       string         `json:"sender_id"`
 	SenderUsername string         `json:"sender_username"`
 	SenderPhoto    sql.NullString `json:"sender_photo"` // Use sql.NullString for nullable fields
@@ -63,12 +100,242 @@ type MessageWithSender struct {
 	// Optionally, show snippet from original message (if reply_to is valid).
 	ReplyToContent        sql.NullString `json:"reply_to_content,omitempty"`
 	ReplyToSenderUsername sql.NullString `json:"reply_to_sender,omitempty"`
+
+	// Number of direct replies to the message, and time of the latest one (nil without replies)
+	ReplyCount  int        `json:"reply_count"`
+	LastReplyAt *time.Time `json:"last_reply_at"`
+
+	// Aggregated delivery state among the other members of the conversation
+	Receipt ReceiptSummary `json:"receipt"`
+
+	// Emoji reactions, as seen by the user who asked for the message
+	Reactions []ReactionSummary `json:"reactions"`
+
+	// URLs of the resized variants of the photo or GIF of the message, and of the photo of the sender, by variant
+	// name (e.g., "thumbnail"). Missing for files without variants.
+	Variants            map[string]string `json:"variants,omitempty"`
+	SenderPhotoVariants map[string]string `json:"sender_photo_variants,omitempty"`
+
+	// Duration and waveform of the file of an audio message. Missing if they are unknown.
+	Audio *AudioInfo `json:"audio,omitempty"`
+
+	// Original name, size and type of the file of a file message
+	File *FileInfo `json:"file,omitempty"`
 }
 
-type MessageComment struct {
+// ThreadMessage is a message of a reply thread. Depth is 0 for the message the thread was opened from, 1 for its
+// replies, 2 for the replies to the replies, and so on.
+type ThreadMessage struct {
+	MessageWithSender
+	Depth int `json:"depth"`
+}
+
+// MessageThread is a message (Root) with all its replies, recursively, the oldest first. ReplyCount and LastReplyAt
+// are the number of replies in the whole thread and the time of the latest one (nil without replies).
+type MessageThread struct {
+	Root        ThreadMessage   `json:"root"`
+	ReplyCount  int             `json:"reply_count"`
+	LastReplyAt *time.Time      `json:"last_reply_at"`
+	Replies     []ThreadMessage `json:"replies"`
+}
+
+// GroupMember is a member of a conversation, with their role.
+type GroupMember struct {
+	UserID   string         `json:"id"`
+	Username string         `json:"username"`
+	Photo    sql.NullString `json:"photo"`
+	Role     string         `json:"role"`
+}
+
+// GroupPermissions holds the minimum role (RoleMember, RoleAdmin or RoleOwner) needed for each change of a group.
+type GroupPermissions struct {
+	Rename      string `json:"rename"`
+	ChangePhoto string `json:"change_photo"`
+	AddMembers  string `json:"add_members"`
+}
+
+// ReactionSummary counts the reactions to a message with one emoji.
+type ReactionSummary struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reacted_by_me"`
+}
+
+// MessageEdit is a past version of an edited message: Content was replaced at EditedAt.
+type MessageEdit struct {
 	ID        int       `json:"id"`
-	UserID    string    `json:"user_id"`
-	Username  string    `json:"username"`
+	MessageID int       `json:"message_id"`
 	Content   string    `json:"content"`
-	Timestamp time.Time `json:"timestamp"`
+	EditedAt  time.Time `json:"edited_at"`
+}
+
+// MessageSearch is a full-text search on the messages. Zero values mean "no filter". Limit is required.
+type MessageSearch struct {
+	Query          string
+	SenderID       string
+	ConversationID int
+	ContentType    string
+	From           time.Time
+	To             time.Time
+	Limit          int
+	Offset         int
+}
+
+// MessageSearchResult is a message matching a MessageSearch. Snippet is the part of the content around the match,
+// with matched terms between SnippetMatchStart and SnippetMatchEnd. Lower Rank values are better matches.
+type MessageSearchResult struct {
+	MessageID      int       `json:"message_id"`
+	ConversationID int       `json:"conversation_id"`
+	Datetime       time.Time `json:"datetime"`
+	ContentType    string    `json:"content_type"`
+	SenderID       string    `json:"sender_id"`
+	SenderUsername string    `json:"sender_username"`
+	Snippet        string    `json:"snippet"`
+	Rank           float64   `json:"rank"`
+}
+
+// ReceiptSummary is the delivery state of a message. One-to-one chats show it as checkmarks, groups as "read by Read
+// of Recipients".
+type ReceiptSummary struct {
+	// Recipients is the number of members of the conversation, except the sender
+	Recipients int `json:"recipients"`
+	Delivered  int `json:"delivered"`
+	Read       int `json:"read"`
+
+	// Checkmarks is 0 while the message is not delivered to every recipient, 1 when it is, 2 when every recipient
+	// has read it
+	Checkmarks int `json:"checkmarks"`
+}
+
+// MessagePage is a page of messages of a conversation, in chronological order, as returned by GetMessagesPage.
+type MessagePage struct {
+	Messages []MessageWithSender
+
+	// HasOlder is true if there are messages before the first one of this page
+	HasOlder bool
+
+	// HasNewer is true if there are messages after the last one of this page
+	HasNewer bool
+}
+
+type MessageComment struct {
+	ID          int       `json:"id"`
+	MessageID   int       `json:"message_id"`
+	UserID      string    `json:"user_id"`
+	Username    string    `json:"username"`
+	ContentType string    `json:"content_type"`
+	Content     string    `json:"content"`
+	Timestamp   time.Time `json:"timestamp"`
+
+	// Original name, size and type of the file of a file comment
+	File *FileInfo `json:"file,omitempty"`
+}
+
+// GroupInvite is a link that lets anyone holding Token join a group. ExpiresAt and MaxUses are nil when the invite has
+// no such limit.
+type GroupInvite struct {
+	ID               int        `json:"id"`
+	ConversationID   int        `json:"conversation_id"`
+	Token            string     `json:"token"`
+	CreatedBy        string     `json:"created_by"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ExpiresAt        *time.Time `json:"expires_at"`
+	MaxUses          *int       `json:"max_uses"`
+	Uses             int        `json:"uses"`
+	RequiresApproval bool       `json:"requires_approval"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+}
+
+// JoinRequest is a pending request to join a group through an invite that requires the approval of an admin.
+type JoinRequest struct {
+	ConversationID int            `json:"conversation_id"`
+	UserID         string         `json:"user_id"`
+	Username       string         `json:"username"`
+	Photo          sql.NullString `json:"photo"`
+	InviteID       int            `json:"invite_id"`
+	CreatedAt      time.Time      `json:"created_at"`
+}
+
+// Media is a file of the media store uploaded by OwnerID. Key is the key of the file in the store, derived from its
+// SHA256.
+type Media struct {
+	ID        int       `json:"id"`
+	SHA256    string    `json:"sha256"`
+	Key       string    `json:"key"`
+	OwnerID   string    `json:"owner_id"`
+	Size      int64     `json:"size"`
+	MIMEType  string    `json:"mime_type"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// ContentType is the content type of a message with this file ("photo", "gif", "audio" or "file"), which the
+	// storage usage is broken down by
+	ContentType string `json:"content_type"`
+}
+
+// StorageUsage is the space used by the uploads of a user, for one content type.
+type StorageUsage struct {
+	ContentType string `json:"content_type"`
+	Files       int    `json:"files"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// AudioInfo describes an uploaded audio file, see media.AudioInfo.
+type AudioInfo struct {
+	DurationMS int64 `json:"duration_ms"`
+	Waveform   []int `json:"waveform"`
+}
+
+// FileInfo describes a file sent as a "file" message or comment.
+type FileInfo struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	MIMEType string `json:"mime_type"`
+}
+
+// SharedFile is a file sent in a conversation, in a message (MessageID) or a comment (CommentID).
+type SharedFile struct {
+	ID               int    `json:"id"`
+	ConversationID   int    `json:"conversation_id"`
+	MessageID        *int   `json:"message_id,omitempty"`
+	CommentID        *int   `json:"comment_id,omitempty"`
+	UploaderID       string `json:"uploader_id"`
+	UploaderUsername string `json:"uploader_username"`
+	URL              string `json:"url"`
+	FileInfo
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MediaGalleryQuery selects the media of a conversation for GetConversationMedia. ContentTypes are message content
+// types ("photo", "gif", "file"); Comments also selects the media sent in comments. When BeforeID is set, only the
+// items older than the message (BeforeSource "message") or comment (BeforeSource "comment") with that ID are returned.
+type MediaGalleryQuery struct {
+	ConversationID int
+	ContentTypes   []string
+	Comments       bool
+	BeforeSource   string
+	BeforeID       int
+	Limit          int
+}
+
+// MediaItem is a photo, GIF or file sent in a message or in a comment (CommentID) of that message.
+type MediaItem struct {
+	Source         string            `json:"source"`
+	MessageID      int               `json:"message_id"`
+	CommentID      *int              `json:"comment_id,omitempty"`
+	ContentType    string            `json:"content_type"`
+	URL            string            `json:"url"`
+	Variants       map[string]string `json:"variants,omitempty"`
+	File           *FileInfo         `json:"file,omitempty"`
+	SenderID       string            `json:"sender_id"`
+	SenderUsername string            `json:"sender_username"`
+	Timestamp      time.Time         `json:"timestamp"`
+}
+
+// MediaVariant is a resized copy of an uploaded image, see media.VariantSpecs.
+type MediaVariant struct {
+	Name     string
+	Key      string
+	Width    int
+	Height   int
+	MIMEType string
 }
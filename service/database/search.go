@@ -0,0 +1,146 @@
+package database
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrSearchUnavailable is returned by SearchMessages when the SQLite library was built without FTS5 (build the
+// executable with `-tags sqlite_fts5`). PostgreSQL always supports full-text search.
+var ErrSearchUnavailable = errors.New("full-text search is not available")
+
+// Markers around the matched terms in MessageSearchResult.Snippet. They are control characters, so they can't appear
+// in user content, and the api package can escape the snippet before turning them into HTML.
+const (
+	SnippetMatchStart = "\x02"
+	SnippetMatchEnd   = "\x03"
+)
+
+// searchIndexAvailable returns true if the full-text index of the messages exists. With SQLite, it's created by an
+// optional migration, skipped if FTS5 is not compiled in. PostgreSQL always has it.
+func searchIndexAvailable(c *conn) (bool, error) {
+	if c.driver == DriverPostgres {
+		return true, nil
+	}
+
+	exists, err := tableExists(c, "messages_fts")
+	if err != nil || !exists {
+		return false, err
+	}
+	// This build must support it, or the triggers would make every new message fail
+	_, err = c.Exec(`SELECT rowid FROM messages_fts LIMIT 0;`)
+	if isMissingModuleError(err) {
+		return false, errors.New("the database has a full-text index, but SQLite was built without FTS5 " +
+			"(build with -tags sqlite_fts5)")
+	}
+	return err == nil, err
+}
+
+// ftsQuery turns free text into an FTS5 query: every word must match, and the last one can be a prefix (for search
+// as you type). Words are quoted, so the FTS5 query syntax can't be used (or broken) by the user.
+func ftsQuery(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	if len(words) > 0 {
+		words[len(words)-1] += "*"
+	}
+	return strings.Join(words, " ")
+}
+
+// tsQuery is the PostgreSQL version of ftsQuery. Words are quoted lexemes, and the last one has the prefix marker.
+func tsQuery(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		word = strings.ReplaceAll(word, `\`, `\\`)
+		words[i] = "'" + strings.ReplaceAll(word, "'", "''") + "'"
+	}
+	if len(words) > 0 {
+		words[len(words)-1] += ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+// SearchMessages returns the messages matching search.Query in the conversations userID belongs to, the best matches
+// first. One more result than search.Limit may be returned, to let the caller know there is another page.
+func (db *appdbimpl) SearchMessages(userID string, search MessageSearch) ([]MessageSearchResult, error) {
+	if !db.search {
+		return nil, ErrSearchUnavailable
+	}
+
+	var query string
+	var args []interface{}
+	if db.c.driver == DriverPostgres {
+		// Ranks are negated, so that the best matches come first like with bm25()
+		query = `
+		SELECT m.id, m.conversation_id, m.datetime, COALESCE(m.content_type, 'text'), u.id, u.name,
+		       ts_headline('simple', m.content, q, ?), -ts_rank(to_tsvector('simple', m.content), q) AS rank
+		FROM messages m
+		JOIN users u ON u.id = m.sender
+		JOIN convmembers cm ON cm.conversation_id = m.conversation_id AND cm.user_id = ?
+		CROSS JOIN to_tsquery('simple', ?) AS q
+		WHERE COALESCE(m.content_type, 'text') = 'text' AND to_tsvector('simple', m.content) @@ q`
+		args = []interface{}{
+			"StartSel=" + SnippetMatchStart + ", StopSel=" + SnippetMatchEnd + ", MaxWords=16, MinWords=8",
+			userID, tsQuery(search.Query),
+		}
+	} else {
+		query = `
+		SELECT m.id, m.conversation_id, m.datetime, COALESCE(m.content_type, 'text'), u.id, u.name,
+		       snippet(messages_fts, 0, ?, ?, '…', 16), bm25(messages_fts) AS rank
+		FROM messages_fts
+		JOIN messages m ON m.id = messages_fts.rowid
+		JOIN users u ON u.id = m.sender
+		JOIN convmembers cm ON cm.conversation_id = m.conversation_id AND cm.user_id = ?
+		WHERE messages_fts MATCH ?`
+		args = []interface{}{SnippetMatchStart, SnippetMatchEnd, userID, ftsQuery(search.Query)}
+	}
+
+	if search.SenderID != "" {
+		query += "\n\t\t  AND m.sender = ?"
+		args = append(args, search.SenderID)
+	}
+	if search.ConversationID > 0 {
+		query += "\n\t\t  AND m.conversation_id = ?"
+		args = append(args, search.ConversationID)
+	}
+	if search.ContentType != "" {
+		query += "\n\t\t  AND COALESCE(m.content_type, 'text') = ?"
+		args = append(args, search.ContentType)
+	}
+	if !search.From.IsZero() {
+		query += "\n\t\t  AND m.datetime >= ?"
+		args = append(args, db.c.timeArg(search.From))
+	}
+	if !search.To.IsZero() {
+		query += "\n\t\t  AND m.datetime < ?"
+		args = append(args, db.c.timeArg(search.To))
+	}
+	query += `
+		ORDER BY rank, m.id DESC
+		LIMIT ? OFFSET ?;
+	`
+	args = append(args, search.Limit+1, search.Offset)
+
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []MessageSearchResult{}
+	for rows.Next() {
+		var result MessageSearchResult
+		err = rows.Scan(&result.MessageID, &result.ConversationID, &result.Datetime, &result.ContentType,
+			&result.SenderID, &result.SenderUsername, &result.Snippet, &result.Rank)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"time"
+)
+
+// sessionSelect lists the columns scanned by scanSession.
+const sessionSelect = `id, user_id, created_at, last_used_at, expires_at, device_label, ip, user_agent`
+
+func scanSession(row rowScanner) (Session, error) {
+	var session Session
+	err := row.Scan(&session.ID, &session.UserID, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt,
+		&session.DeviceLabel, &session.IP, &session.UserAgent)
+	return session, err
+}
+
+// CreateSession stores a new login session (ID is ignored and assigned by the database). Only the hash of the bearer
+// token is stored, so a leak of the database does not leak usable credentials.
+func (db *appdbimpl) CreateSession(session Session, tokenHash string) (Session, error) {
+	query := `
+		INSERT INTO sessions (user_id, token_hash, created_at, last_used_at, expires_at, device_label, ip, user_agent)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id;
+	`
+	err := db.c.QueryRow(query, session.UserID, tokenHash, session.CreatedAt, session.LastUsedAt, session.ExpiresAt,
+		session.DeviceLabel, session.IP, session.UserAgent).Scan(&session.ID)
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// GetSessionByTokenHash returns the session with the given token hash, expired or not. It returns sql.ErrNoRows if
+// there is no such session.
+func (db *appdbimpl) GetSessionByTokenHash(tokenHash string) (Session, error) {
+	query := `SELECT ` + sessionSelect + ` FROM sessions WHERE token_hash = ?;`
+	return scanSession(db.c.QueryRow(query, tokenHash))
+}
+
+// TouchSession updates the last time the session was used, and the address it was used from.
+func (db *appdbimpl) TouchSession(sessionID int, lastUsedAt time.Time, ip string) error {
+	_, err := db.c.Exec(`UPDATE sessions SET last_used_at = ?, ip = ? WHERE id = ?;`, lastUsedAt, ip, sessionID)
+	return err
+}
+
+// DeleteSession removes a session, so that its token can't be used anymore.
+func (db *appdbimpl) DeleteSession(sessionID int) error {
+	_, err := db.c.Exec(`DELETE FROM sessions WHERE id = ?;`, sessionID)
+	return err
+}
+
+// DeleteExpiredSessions removes every session of userID that expired before now.
+func (db *appdbimpl) DeleteExpiredSessions(userID string, now time.Time) error {
+	_, err := db.c.Exec(`DELETE FROM sessions WHERE user_id = ? AND expires_at <= ?;`, userID, now)
+	return err
+}
+
+// GetActiveSessions returns the sessions of userID that are not expired at now, the most recently used first.
+func (db *appdbimpl) GetActiveSessions(userID string, now time.Time) ([]Session, error) {
+	query := `
+		SELECT ` + sessionSelect + `
+		FROM sessions
+		WHERE user_id = ? AND expires_at > ?
+		ORDER BY last_used_at DESC, id DESC;
+	`
+	rows, err := db.c.Query(query, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteUserSession removes the session sessionID if it belongs to userID. It returns false if there is no such
+// session.
+func (db *appdbimpl) DeleteUserSession(userID string, sessionID int) (bool, error) {
+	res, err := db.c.Exec(`DELETE FROM sessions WHERE id = ? AND user_id = ?;`, sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// DeleteOtherSessions removes every session of userID except keepSessionID, and returns how many were removed.
+func (db *appdbimpl) DeleteOtherSessions(userID string, keepSessionID int) (int, error) {
+	res, err := db.c.Exec(`DELETE FROM sessions WHERE user_id = ? AND id <> ?;`, userID, keepSessionID)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(affected), nil
+}
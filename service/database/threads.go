@@ -0,0 +1,74 @@
+package database
+
+// GetMessageThread returns a message and all its replies, including the replies to the replies, the oldest reply
+// first. It returns sql.ErrNoRows if the message does not exist. Reactions are summarized for viewerID.
+func (db *appdbimpl) GetMessageThread(messageID int, viewerID string) (MessageThread, error) {
+	root, err := db.GetMessageByID(messageID, viewerID)
+	if err != nil {
+		return MessageThread{}, err
+	}
+
+	// Replies are in the conversation of the message they reply to; UNION ignores the rows already seen, so a cycle
+	// of replies can't loop forever
+	query := `
+	WITH RECURSIVE thread (id, conversation_id) AS (
+		SELECT id, conversation_id FROM messages WHERE id = ?
+		UNION
+		SELECT m.id, m.conversation_id
+		FROM messages m
+		JOIN thread t ON m.reply_to = t.id AND m.conversation_id = t.conversation_id
+	)` + messageWithSenderSelect + `
+	WHERE m.id IN (SELECT id FROM thread) AND m.id <> ?
+	ORDER BY m.id;
+	`
+	rows, err := db.c.Query(query, messageID, messageID)
+	if err != nil {
+		return MessageThread{}, err
+	}
+	defer rows.Close()
+
+	replies := []MessageWithSender{}
+	for rows.Next() {
+		msg, err := scanMessageWithSender(rows)
+		if err != nil {
+			return MessageThread{}, err
+		}
+		replies = append(replies, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return MessageThread{}, err
+	}
+
+	if err := db.attachReactions(replies, viewerID); err != nil {
+		return MessageThread{}, err
+	}
+	if err := db.attachVariants(replies); err != nil {
+		return MessageThread{}, err
+	}
+	if err := db.attachAudio(replies); err != nil {
+		return MessageThread{}, err
+	}
+	if err := db.attachFiles(replies); err != nil {
+		return MessageThread{}, err
+	}
+
+	// A reply is always newer than the message it replies to, so its parent comes first in ID order
+	thread := MessageThread{
+		Root:    ThreadMessage{MessageWithSender: root},
+		Replies: make([]ThreadMessage, len(replies)),
+	}
+	index := map[int]*ThreadMessage{root.ID: &thread.Root}
+	for i, reply := range replies {
+		thread.Replies[i] = ThreadMessage{MessageWithSender: reply}
+		current := &thread.Replies[i]
+		index[reply.ID] = current
+		if parent, ok := index[int(reply.ReplyTo.Int64)]; ok {
+			current.Depth = parent.Depth + 1
+		}
+		if thread.LastReplyAt == nil || reply.Datetime.After(*thread.LastReplyAt) {
+			thread.LastReplyAt = &replies[i].Datetime
+		}
+	}
+	thread.ReplyCount = len(replies)
+	return thread, nil
+}
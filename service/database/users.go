@@ -142,10 +142,31 @@ func (db *appdbimpl) UpdateUserName(id string, newname string) (err error) {
 	return nil
 }
 
-func (db *appdbimpl) UpdateUserPhoto(userID string, photoPath string) error {
-	query := `UPDATE users SET photo = ? WHERE id = ?;`
-	_, err := db.c.Exec(query, photoPath, userID)
-	return err
+// UpdateUserPhoto sets the photo of a user. The space used by the previous photo is released if the user doesn't use
+// it anywhere else.
+func (db *appdbimpl) UpdateUserPhoto(userID string, photoPath string) (err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if newerr := tx.Rollback(); newerr != nil && !errors.Is(newerr, sql.ErrTxDone) {
+			err = fmt.Errorf("failed to rollback transaction: %w", newerr)
+		}
+	}()
+
+	var previous sql.NullString
+	err = tx.QueryRow(`SELECT photo FROM users WHERE id = ?;`, userID).Scan(&previous)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to fetch photo: %w", err)
+	}
+	if _, err = tx.Exec(`UPDATE users SET photo = ? WHERE id = ?;`, photoPath, userID); err != nil {
+		return fmt.Errorf("failed to update photo: %w", err)
+	}
+	if err = releaseUnusedMedia(tx, previous.String); err != nil {
+		return fmt.Errorf("failed to release uploads: %w", err)
+	}
+	return tx.Commit()
 }
 
 func GetUserByID(db *sql.DB, userID string) (*User, error) {
@@ -0,0 +1,276 @@
+/*
+Package events contains the in-process fan-out hub used to push real-time updates to connected clients.
+
+Handlers in the api package publish an Event addressed to a set of user IDs (usually the members of a conversation),
+and every open subscription belonging to one of those users receives a copy. The hub never blocks the publisher: a
+subscriber that is too slow to drain its buffer is dropped, and the client is expected to reconnect and reload.
+
+Every event gets an increasing ID, and the hub remembers the last events of each user. A client that reconnects can
+pass the ID of the last event it has seen to SubscribeFrom and receive what it missed in the meantime. The events of a
+user who has no subscription are forgotten after historyTTL: clients that reconnect later get a full snapshot.
+
+Example:
+
+	hub := events.NewHub()
+	defer hub.Close()
+
+	sub := hub.Subscribe(userID)
+	defer sub.Close()
+
+	hub.Publish([]string{userID}, events.Event{Type: events.MessageCreated, ConversationID: 1})
+	ev := <-sub.Events()
+*/
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/shabdaanov1/wasa/service/globaltime"
+)
+
+// Event types published by the api package.
+const (
+	MessageCreated      = "message.created"
+	MessageDeleted      = "message.deleted"
+	MessageEdited       = "message.edited"
+	CommentAdded        = "comment.added"
+	CommentRemoved      = "comment.removed"
+	GroupRenamed        = "group.renamed"
+	ConversationUpdated = "conversation.updated"
+	MessagesRead        = "messages.read"
+	ReactionAdded       = "reaction.added"
+	ReactionRemoved     = "reaction.removed"
+	MemberRoleChanged   = "member.role_changed"
+	MemberRemoved       = "member.removed"
+)
+
+const (
+	// subscriptionBuffer is the number of events a subscription can hold before it is considered too slow and dropped
+	subscriptionBuffer = 64
+
+	// historySize is the number of past events remembered for each user, for SubscribeFrom
+	historySize = 128
+
+	// historyTTL is how long the events of a user are remembered after their last subscription ends (or after the
+	// last event, if it's later)
+	historyTTL = 10 * time.Minute
+
+	// historySweepInterval is how often Publish looks for the histories to forget
+	historySweepInterval = time.Minute
+)
+
+// Event is a single update delivered to subscribers.
+type Event struct {
+	// ID is assigned by the hub when the event is published. IDs are increasing, also across restarts of the process.
+	ID             uint64      `json:"id"`
+	Type           string      `json:"type"`
+	ConversationID int         `json:"conversation_id"`
+	Payload        interface{} `json:"payload,omitempty"`
+}
+
+// history is the tail of the events published to a single user.
+type history struct {
+	events []Event
+
+	// floor is the ID of the newest event that is no longer in events (or the hub start, if nothing was dropped).
+	// A client that has seen floor can be resumed without losing anything.
+	floor uint64
+
+	// lastUsed is the time of the last event, or of the end of the last subscription of the user
+	lastUsed time.Time
+}
+
+// Hub fans out events to subscriptions, indexed by user ID. It is safe for concurrent use.
+type Hub struct {
+	mu      sync.Mutex
+	subs    map[string]map[*Subscription]struct{}
+	history map[string]*history
+	start   uint64
+	lastID  uint64
+	closed  bool
+
+	// forgotten is the ID of the newest event of the histories that were forgotten: it's the floor of the users that
+	// have no history. lastSweep is the last time the histories were checked.
+	forgotten uint64
+	lastSweep time.Time
+}
+
+// NewHub returns an empty, running Hub.
+func NewHub() *Hub {
+	// Start numbering from the current time, so that IDs seen by clients before a restart are never confused with
+	// newer ones. Microseconds keep IDs below 2^53, so they are safe as JSON numbers in JavaScript too.
+	start := uint64(globaltime.Now().UnixMicro())
+	return &Hub{
+		subs:      make(map[string]map[*Subscription]struct{}),
+		history:   make(map[string]*history),
+		start:     start,
+		lastID:    start,
+		forgotten: start,
+		lastSweep: globaltime.Now(),
+	}
+}
+
+// Subscription is a stream of events for one user. Events() is closed when the subscription ends, either because
+// Close was called, the hub was closed, or the subscriber fell behind.
+type Subscription struct {
+	hub    *Hub
+	userID string
+	ch     chan Event
+	once   sync.Once
+}
+
+// Subscribe registers a new subscription for userID. If the hub is already closed, the returned subscription is
+// closed too.
+func (h *Hub) Subscribe(userID string) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.subscribeLocked(userID)
+}
+
+// SubscribeFrom registers a new subscription for userID and returns the remembered events published to userID after
+// lastID. If complete is false, some events after lastID were already forgotten (or lastID comes from an older run of
+// the server) and the caller should send a full snapshot instead. The last ID known to the hub is returned too, to be
+// used as the ID of such a snapshot.
+func (h *Hub) SubscribeFrom(userID string, lastID uint64) (sub *Subscription, missed []Event, complete bool, current uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub = h.subscribeLocked(userID)
+
+	floor := h.forgotten
+	if hist, ok := h.history[userID]; ok {
+		floor = hist.floor
+		for _, ev := range hist.events {
+			if ev.ID > lastID {
+				missed = append(missed, ev)
+			}
+		}
+	}
+	return sub, missed, lastID >= floor, h.lastID
+}
+
+func (h *Hub) subscribeLocked(userID string) *Subscription {
+	sub := &Subscription{
+		hub:    h,
+		userID: userID,
+		ch:     make(chan Event, subscriptionBuffer),
+	}
+	if h.closed {
+		close(sub.ch)
+		sub.once.Do(func() {})
+		return sub
+	}
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[*Subscription]struct{})
+	}
+	h.subs[userID][sub] = struct{}{}
+	return sub
+}
+
+// Publish assigns an ID to ev and delivers it to every subscription of the given users. It never blocks:
+// subscriptions with a full buffer are closed and removed.
+func (h *Hub) Publish(userIDs []string, ev Event) {
+	var slow []*Subscription
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.lastID++
+	ev.ID = h.lastID
+	now := globaltime.Now()
+	if now.Sub(h.lastSweep) >= historySweepInterval {
+		h.forgetIdle(now)
+	}
+	for _, userID := range userIDs {
+		h.remember(userID, ev, now)
+		for sub := range h.subs[userID] {
+			select {
+			case sub.ch <- ev:
+			default:
+				slow = append(slow, sub)
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	for _, sub := range slow {
+		sub.Close()
+	}
+}
+
+// remember appends ev to the history of userID. The caller must hold the lock.
+func (h *Hub) remember(userID string, ev Event, now time.Time) {
+	hist, ok := h.history[userID]
+	if !ok {
+		hist = &history{floor: h.forgotten}
+		h.history[userID] = hist
+	}
+	hist.lastUsed = now
+	if len(hist.events) == historySize {
+		hist.floor = hist.events[0].ID
+		hist.events = append(hist.events[:0], hist.events[1:]...)
+	}
+	hist.events = append(hist.events, ev)
+}
+
+// forgetIdle drops the histories of the users that have had no subscription for historyTTL. The caller must hold the
+// lock.
+func (h *Hub) forgetIdle(now time.Time) {
+	h.lastSweep = now
+	for userID, hist := range h.history {
+		if len(h.subs[userID]) > 0 || now.Sub(hist.lastUsed) < historyTTL {
+			continue
+		}
+		if n := len(hist.events); n > 0 && hist.events[n-1].ID > h.forgotten {
+			h.forgotten = hist.events[n-1].ID
+		}
+		delete(h.history, userID)
+	}
+}
+
+// Close ends every subscription and makes further Publish calls no-ops.
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	subs := h.subs
+	h.subs = nil
+	h.history = nil
+	h.mu.Unlock()
+
+	for _, userSubs := range subs {
+		for sub := range userSubs {
+			sub.once.Do(func() { close(sub.ch) })
+		}
+	}
+	return nil
+}
+
+// Events returns the channel where events for this subscription are delivered.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Close removes the subscription from the hub and closes its channel. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.hub.mu.Lock()
+		if userSubs, ok := s.hub.subs[s.userID]; ok {
+			delete(userSubs, s)
+			if len(userSubs) == 0 {
+				delete(s.hub.subs, s.userID)
+				if hist, ok := s.hub.history[s.userID]; ok {
+					hist.lastUsed = globaltime.Now()
+				}
+			}
+		}
+		s.hub.mu.Unlock()
+		close(s.ch)
+	})
+}
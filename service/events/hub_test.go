@@ -0,0 +1,57 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shabdaanov1/wasa/service/globaltime"
+)
+
+// TestHistoryForgotten checks that the events of the users without a subscription are forgotten after historyTTL, and
+// that the clients of those users get a full snapshot instead of an incomplete resume.
+func TestHistoryForgotten(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	globaltime.FixedTime = now
+	defer func() { globaltime.FixedTime = time.Time{} }()
+
+	hub := NewHub()
+	defer hub.Close()
+
+	connected := hub.Subscribe("connected")
+	defer connected.Close()
+
+	hub.Publish([]string{"connected", "away"}, Event{Type: MessageCreated, ConversationID: 1})
+	sub, missed, complete, last := hub.SubscribeFrom("away", hub.start)
+	sub.Close()
+	if len(missed) != 1 || !complete {
+		t.Fatalf("before the TTL: got %d missed events, complete %v; want 1, true", len(missed), complete)
+	}
+
+	// The history is kept for historyTTL after the subscription ends
+	globaltime.FixedTime = now.Add(historyTTL / 2)
+	hub.Publish([]string{"connected"}, Event{Type: MessageCreated, ConversationID: 1})
+	if _, ok := hub.history["away"]; !ok {
+		t.Fatal("history forgotten before the TTL")
+	}
+
+	globaltime.FixedTime = now.Add(2 * historyTTL)
+	hub.Publish([]string{"connected"}, Event{Type: MessageCreated, ConversationID: 1})
+	if _, ok := hub.history["away"]; ok {
+		t.Fatal("history of a user without subscriptions not forgotten after the TTL")
+	}
+	if _, ok := hub.history["connected"]; !ok {
+		t.Fatal("history of a connected user forgotten")
+	}
+
+	// A client that saw the forgotten event can still resume, one that didn't must reload
+	sub, missed, complete, _ = hub.SubscribeFrom("away", last)
+	sub.Close()
+	if len(missed) != 0 || !complete {
+		t.Errorf("resume after the last event: got %d missed events, complete %v; want 0, true", len(missed), complete)
+	}
+	sub, _, complete, _ = hub.SubscribeFrom("away", last-1)
+	sub.Close()
+	if complete {
+		t.Error("resume before a forgotten event reported as complete")
+	}
+}
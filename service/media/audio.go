@@ -0,0 +1,513 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// WaveformBars is the number of values of the waveform summary of an audio file.
+const WaveformBars = 64
+
+// ErrNotAudio is returned by ProbeAudio when the content can't be parsed as an audio file of the given type.
+var ErrNotAudio = errors.New("not a valid audio file")
+
+// AudioInfo describes an audio file, as shown by the players before it's downloaded.
+type AudioInfo struct {
+	Duration time.Duration
+
+	// Waveform holds up to WaveformBars levels from 0 to 100, evenly spread over the duration. The audio is not
+	// decoded: the levels are the sizes of the compressed frames (their bitrate), which follow the loudness closely
+	// enough with variable bitrate codecs (Opus voice notes, VBR MP3, AAC) to draw the usual voice note bars. Constant
+	// bitrate files get a flat waveform.
+	Waveform []int
+}
+
+// audioFrame is a compressed frame (or packet) of an audio file: it starts at time seconds and takes size bytes.
+type audioFrame struct {
+	time float64
+	size int
+}
+
+// ProbeAudio reads the duration and the waveform of an audio file of the given MIME type (audio/ogg with the Opus
+// codec, audio/mpeg or audio/mp4) from its container headers. It returns ErrNotAudio if the content doesn't match the
+// type.
+func ProbeAudio(r io.ReaderAt, size int64, mimeType string) (AudioInfo, error) {
+	var frames []audioFrame
+	var duration float64
+	var err error
+	switch mimeType {
+	case "audio/ogg":
+		frames, duration, err = probeOpus(io.NewSectionReader(r, 0, size))
+	case "audio/mpeg":
+		frames, duration, err = probeMP3(r, size)
+	case "audio/mp4":
+		frames, duration, err = probeMP4(r, size)
+	default:
+		return AudioInfo{}, fmt.Errorf("%w: unsupported type %s", ErrNotAudio, mimeType)
+	}
+	if err != nil {
+		return AudioInfo{}, err
+	}
+	if len(frames) == 0 || duration <= 0 {
+		return AudioInfo{}, fmt.Errorf("%w: no audio frames", ErrNotAudio)
+	}
+	return AudioInfo{
+		Duration: time.Duration(duration * float64(time.Second)),
+		Waveform: waveform(frames, duration),
+	}, nil
+}
+
+// waveform splits the duration in WaveformBars slots (fewer for short files), and scales the mean size of the frames
+// of each slot to 0-100.
+func waveform(frames []audioFrame, duration float64) []int {
+	bars := min(WaveformBars, len(frames))
+	sums := make([]float64, bars)
+	counts := make([]int, bars)
+	for _, f := range frames {
+		i := min(max(int(f.time/duration*float64(bars)), 0), bars-1)
+		sums[i] += float64(f.size)
+		counts[i]++
+	}
+	var peak float64
+	for i := range sums {
+		if counts[i] > 0 {
+			sums[i] /= float64(counts[i])
+			peak = max(peak, sums[i])
+		}
+	}
+	levels := make([]int, bars)
+	for i, s := range sums {
+		if peak > 0 {
+			levels[i] = int(s/peak*100 + 0.5)
+		}
+	}
+	return levels
+}
+
+// Ogg/Opus, see RFC 3533 (Ogg) and RFC 7845 (Opus in Ogg).
+
+// opusRate is the sample rate of the Opus granule positions, whatever the input rate.
+const opusRate = 48000
+
+// opusFrameSamples is the duration (at opusRate) of the frames of each Opus configuration, see RFC 6716 section 3.1.
+var opusFrameSamples = [32]int{
+	480, 960, 1920, 2880, 480, 960, 1920, 2880, 480, 960, 1920, 2880, // SILK: 10, 20, 40, 60 ms
+	480, 960, 480, 960, // hybrid: 10, 20 ms
+	120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960, // CELT: 2.5, 5, 10, 20 ms
+}
+
+// probeOpus reads the pages of the first logical stream of an Ogg file, which must be Opus, and returns its packets.
+func probeOpus(r io.Reader) ([]audioFrame, float64, error) {
+	br := bufio.NewReader(r)
+	var frames []audioFrame
+	var serial uint32
+	var packet []byte
+	var packets, samples int
+	var preSkip int
+	lastGranule := int64(-1)
+
+	for page := 0; ; page++ {
+		var header [27]byte
+		if _, err := io.ReadFull(br, header[:]); errors.Is(err, io.EOF) && page > 0 {
+			break
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("%w: truncated Ogg page", ErrNotAudio)
+		}
+		if string(header[:4]) != "OggS" || header[4] != 0 {
+			return nil, 0, fmt.Errorf("%w: invalid Ogg page", ErrNotAudio)
+		}
+		granule := int64(binary.LittleEndian.Uint64(header[6:14]))
+		pageSerial := binary.LittleEndian.Uint32(header[14:18])
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(br, segments); err != nil {
+			return nil, 0, fmt.Errorf("%w: truncated Ogg page", ErrNotAudio)
+		}
+		bodySize := 0
+		for _, s := range segments {
+			bodySize += int(s)
+		}
+		body := make([]byte, bodySize)
+		if _, err := io.ReadFull(br, body); err != nil {
+			return nil, 0, fmt.Errorf("%w: truncated Ogg page", ErrNotAudio)
+		}
+
+		if page == 0 {
+			serial = pageSerial
+		} else if pageSerial != serial {
+			// Other logical streams are ignored
+			continue
+		}
+		if granule >= 0 {
+			lastGranule = granule
+		}
+
+		for _, s := range segments {
+			packet = append(packet, body[:s]...)
+			body = body[s:]
+			if s == 255 {
+				// The packet goes on in the next segment
+				continue
+			}
+			switch packets {
+			case 0:
+				if len(packet) < 19 || !bytes.HasPrefix(packet, []byte("OpusHead")) {
+					return nil, 0, fmt.Errorf("%w: not an Opus stream", ErrNotAudio)
+				}
+				preSkip = int(binary.LittleEndian.Uint16(packet[10:12]))
+			case 1:
+				// OpusTags
+			default:
+				if n := opusPacketSamples(packet); n > 0 {
+					frames = append(frames, audioFrame{time: float64(samples) / opusRate, size: len(packet)})
+					samples += n
+				}
+			}
+			packets++
+			packet = packet[:0]
+		}
+	}
+
+	// The granule position of the last page is the exact duration; the sum of the packets is used if it's missing
+	if lastGranule > 0 {
+		samples = int(lastGranule)
+	}
+	return frames, float64(samples-preSkip) / opusRate, nil
+}
+
+// opusPacketSamples returns the duration (at opusRate) of an Opus packet, given its TOC byte and frame count.
+func opusPacketSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	count := 1
+	switch toc & 3 {
+	case 1, 2:
+		count = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		count = int(packet[1] & 0x3f)
+	}
+	return count * opusFrameSamples[toc>>3]
+}
+
+// MP3 (MPEG audio layer III), see ISO/IEC 11172-3 and 13818-3.
+
+var (
+	mp3Bitrates = [2][16]int{
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}, // MPEG-1
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},     // MPEG-2 and 2.5
+	}
+	mp3SampleRates = [4][3]int{
+		{11025, 12000, 8000},  // MPEG-2.5
+		{},                    // reserved
+		{22050, 24000, 16000}, // MPEG-2
+		{44100, 48000, 32000}, // MPEG-1
+	}
+)
+
+// mp3MaxSync is how far the first frame is looked for, after the ID3v2 tag.
+const mp3MaxSync = 64 << 10
+
+// probeMP3 reads the frame headers of an MP3 file, after its ID3v2 tag. Frames end at the first invalid header
+// (usually an ID3v1 or APE tag at the end of the file).
+func probeMP3(r io.ReaderAt, size int64) ([]audioFrame, float64, error) {
+	var offset int64
+	var id3 [10]byte
+	if _, err := r.ReadAt(id3[:], 0); err == nil && string(id3[:3]) == "ID3" {
+		// The size is a 28 bits "syncsafe" integer, without the header and the footer
+		tagSize := int64(id3[6]&0x7f)<<21 | int64(id3[7]&0x7f)<<14 | int64(id3[8]&0x7f)<<7 | int64(id3[9]&0x7f)
+		offset = 10 + tagSize
+		if id3[5]&0x10 != 0 {
+			offset += 10
+		}
+	}
+
+	br := bufio.NewReader(io.NewSectionReader(r, offset, max(size-offset, 0)))
+	var frames []audioFrame
+	var elapsed float64
+	for skipped := 0; ; {
+		header, err := br.Peek(4)
+		if err != nil {
+			break
+		}
+		frameSize, samples, rate := mp3Frame(header)
+		if frameSize == 0 {
+			if len(frames) > 0 {
+				break
+			}
+			// Look for the first frame
+			if skipped++; skipped > mp3MaxSync {
+				return nil, 0, fmt.Errorf("%w: no MP3 frame", ErrNotAudio)
+			}
+			_, _ = br.Discard(1)
+			continue
+		}
+		if _, err := br.Discard(frameSize); err != nil {
+			// Truncated last frame
+			break
+		}
+		frames = append(frames, audioFrame{time: elapsed, size: frameSize})
+		elapsed += float64(samples) / float64(rate)
+	}
+	return frames, elapsed, nil
+}
+
+// mp3Frame parses a layer III frame header, and returns the size of the frame, its number of samples and its sample
+// rate. The size is 0 if the header is invalid.
+func mp3Frame(h []byte) (size int, samples int, rate int) {
+	if h[0] != 0xff || h[1]&0xe0 != 0xe0 {
+		return 0, 0, 0
+	}
+	version := (h[1] >> 3) & 3
+	layer := (h[1] >> 1) & 3
+	bitrateIndex := h[2] >> 4
+	rateIndex := (h[2] >> 2) & 3
+	padding := int((h[2] >> 1) & 1)
+	if version == 1 || layer != 1 || rateIndex == 3 {
+		return 0, 0, 0
+	}
+
+	table := 1
+	samples = 576
+	if version == 3 {
+		table = 0
+		samples = 1152
+	}
+	bitrate := mp3Bitrates[table][bitrateIndex] * 1000
+	if bitrate == 0 {
+		// Free format and invalid bitrates are not supported
+		return 0, 0, 0
+	}
+	rate = mp3SampleRates[version][rateIndex]
+	return samples/8*bitrate/rate + padding, samples, rate
+}
+
+// MP4 (M4A), see ISO/IEC 14496-12. The frames are the samples of the first sound track.
+
+// mp4Box is a box of an MP4 file: its payload is at offset, and takes size bytes.
+type mp4Box struct {
+	kind   string
+	offset int64
+	size   int64
+}
+
+// mp4Boxes returns the boxes found from start to end.
+func mp4Boxes(r io.ReaderAt, start int64, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for start+8 <= end {
+		var header [16]byte
+		if _, err := r.ReadAt(header[:8], start); err != nil {
+			return nil, fmt.Errorf("%w: truncated MP4 box", ErrNotAudio)
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// The box takes the rest of the file
+			size = end - start
+		case 1:
+			if _, err := r.ReadAt(header[8:16], start+8); err != nil {
+				return nil, fmt.Errorf("%w: truncated MP4 box", ErrNotAudio)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize || size > end-start {
+			return nil, fmt.Errorf("%w: invalid MP4 box size", ErrNotAudio)
+		}
+		boxes = append(boxes, mp4Box{kind: string(header[4:8]), offset: start + headerSize, size: size - headerSize})
+		start += size
+	}
+	return boxes, nil
+}
+
+// mp4Child returns the first box of a kind inside parent.
+func mp4Child(r io.ReaderAt, parent mp4Box, kind string) (mp4Box, bool, error) {
+	boxes, err := mp4Boxes(r, parent.offset, parent.offset+parent.size)
+	if err != nil {
+		return mp4Box{}, false, err
+	}
+	for _, b := range boxes {
+		if b.kind == kind {
+			return b, true, nil
+		}
+	}
+	return mp4Box{}, false, nil
+}
+
+// mp4Path follows a path of box kinds from parent, e.g. "minf", "stbl", "stsz".
+func mp4Path(r io.ReaderAt, parent mp4Box, kinds ...string) (mp4Box, error) {
+	box := parent
+	for _, kind := range kinds {
+		child, ok, err := mp4Child(r, box, kind)
+		if err != nil {
+			return mp4Box{}, err
+		}
+		if !ok {
+			return mp4Box{}, fmt.Errorf("%w: missing MP4 %s box", ErrNotAudio, kind)
+		}
+		box = child
+	}
+	return box, nil
+}
+
+// mp4Payload reads the payload of a box, up to limit bytes.
+func mp4Payload(r io.ReaderAt, box mp4Box, limit int64) ([]byte, error) {
+	data := make([]byte, min(box.size, limit))
+	if _, err := r.ReadAt(data, box.offset); err != nil {
+		return nil, fmt.Errorf("%w: truncated MP4 %s box", ErrNotAudio, box.kind)
+	}
+	return data, nil
+}
+
+func probeMP4(r io.ReaderAt, size int64) ([]audioFrame, float64, error) {
+	root := mp4Box{kind: "", offset: 0, size: size}
+	moov, err := mp4Path(r, root, "moov")
+	if err != nil {
+		return nil, 0, err
+	}
+	traks, err := mp4Boxes(r, moov.offset, moov.offset+moov.size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var sound *mp4Box
+	for i, trak := range traks {
+		if trak.kind != "trak" {
+			continue
+		}
+		hdlr, err := mp4Path(r, trak, "mdia", "hdlr")
+		if err != nil {
+			return nil, 0, err
+		}
+		data, err := mp4Payload(r, hdlr, 12)
+		if err != nil || len(data) < 12 {
+			return nil, 0, fmt.Errorf("%w: invalid MP4 hdlr box", ErrNotAudio)
+		}
+		switch string(data[8:12]) {
+		case "vide":
+			return nil, 0, fmt.Errorf("%w: MP4 file with a video track", ErrNotAudio)
+		case "soun":
+			if sound == nil {
+				sound = &traks[i]
+			}
+		}
+	}
+	if sound == nil {
+		return nil, 0, fmt.Errorf("%w: no MP4 sound track", ErrNotAudio)
+	}
+
+	// Time scale and duration of the track
+	mdhd, err := mp4Path(r, *sound, "mdia", "mdhd")
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := mp4Payload(r, mdhd, 32)
+	if err != nil {
+		return nil, 0, err
+	}
+	var timescale, length uint64
+	switch {
+	case len(data) >= 20 && data[0] == 0:
+		timescale = uint64(binary.BigEndian.Uint32(data[12:16]))
+		length = uint64(binary.BigEndian.Uint32(data[16:20]))
+	case len(data) >= 32 && data[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(data[20:24]))
+		length = binary.BigEndian.Uint64(data[24:32])
+	default:
+		return nil, 0, fmt.Errorf("%w: invalid MP4 mdhd box", ErrNotAudio)
+	}
+	if timescale == 0 {
+		return nil, 0, fmt.Errorf("%w: invalid MP4 time scale", ErrNotAudio)
+	}
+
+	stbl, err := mp4Path(r, *sound, "mdia", "minf", "stbl")
+	if err != nil {
+		return nil, 0, err
+	}
+	sizes, err := mp4SampleSizes(r, stbl)
+	if err != nil {
+		return nil, 0, err
+	}
+	deltas, err := mp4SampleDeltas(r, stbl, len(sizes))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	frames := make([]audioFrame, len(sizes))
+	var elapsed uint64
+	for i := range sizes {
+		frames[i] = audioFrame{time: float64(elapsed) / float64(timescale), size: sizes[i]}
+		elapsed += uint64(deltas[i])
+	}
+	if length == 0 {
+		length = elapsed
+	}
+	return frames, float64(length) / float64(timescale), nil
+}
+
+// mp4SampleSizes reads the stsz box of a sample table.
+func mp4SampleSizes(r io.ReaderAt, stbl mp4Box) ([]int, error) {
+	stsz, err := mp4Path(r, stbl, "stsz")
+	if err != nil {
+		return nil, err
+	}
+	data, err := mp4Payload(r, stsz, stsz.size)
+	if err != nil || len(data) < 12 {
+		return nil, fmt.Errorf("%w: invalid MP4 stsz box", ErrNotAudio)
+	}
+	fixed := int(binary.BigEndian.Uint32(data[4:8]))
+	count := int(binary.BigEndian.Uint32(data[8:12]))
+	if fixed == 0 && count > (len(data)-12)/4 {
+		return nil, fmt.Errorf("%w: invalid MP4 stsz box", ErrNotAudio)
+	}
+	if fixed != 0 && count > int(stbl.size) {
+		// A sample takes at least a byte of the file
+		return nil, fmt.Errorf("%w: invalid MP4 stsz box", ErrNotAudio)
+	}
+	sizes := make([]int, count)
+	for i := range sizes {
+		if fixed != 0 {
+			sizes[i] = fixed
+		} else {
+			sizes[i] = int(binary.BigEndian.Uint32(data[12+4*i:]))
+		}
+	}
+	return sizes, nil
+}
+
+// mp4SampleDeltas reads the durations of count samples from the stts box of a sample table.
+func mp4SampleDeltas(r io.ReaderAt, stbl mp4Box, count int) ([]uint32, error) {
+	stts, err := mp4Path(r, stbl, "stts")
+	if err != nil {
+		return nil, err
+	}
+	data, err := mp4Payload(r, stts, stts.size)
+	if err != nil || len(data) < 8 {
+		return nil, fmt.Errorf("%w: invalid MP4 stts box", ErrNotAudio)
+	}
+	entries := int(binary.BigEndian.Uint32(data[4:8]))
+	if entries > (len(data)-8)/8 {
+		return nil, fmt.Errorf("%w: invalid MP4 stts box", ErrNotAudio)
+	}
+	deltas := make([]uint32, 0, count)
+	for i := 0; i < entries && len(deltas) < count; i++ {
+		n := int(binary.BigEndian.Uint32(data[8+8*i:]))
+		delta := binary.BigEndian.Uint32(data[12+8*i:])
+		for j := 0; j < n && len(deltas) < count; j++ {
+			deltas = append(deltas, delta)
+		}
+	}
+	for len(deltas) < count {
+		deltas = append(deltas, 0)
+	}
+	return deltas, nil
+}
@@ -0,0 +1,312 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// probe runs ProbeAudio on data.
+func probe(data []byte, mimeType string) (AudioInfo, error) {
+	return ProbeAudio(bytes.NewReader(data), int64(len(data)), mimeType)
+}
+
+// expectDuration checks a duration to the millisecond: the MP3 frame durations are summed as floats.
+func expectDuration(t *testing.T, name string, got time.Duration, expected time.Duration) {
+	t.Helper()
+	if d := got - expected; d < -time.Millisecond || d > time.Millisecond {
+		t.Errorf("%s: got a duration of %v, expected %v", name, got, expected)
+	}
+}
+
+// expectNotAudio checks that every prefix of data shorter than n bytes is rejected with ErrNotAudio, and that the
+// longer ones are either rejected or probed without panicking.
+func expectNotAudio(t *testing.T, data []byte, mimeType string, n int) {
+	t.Helper()
+	for i := 0; i < len(data); i++ {
+		_, err := probe(data[:i], mimeType)
+		if err != nil && !errors.Is(err, ErrNotAudio) {
+			t.Fatalf("cut at %d bytes: got %v, expected ErrNotAudio", i, err)
+		}
+		if i < n && err == nil {
+			t.Fatalf("cut at %d bytes: accepted", i)
+		}
+	}
+}
+
+// oggPage returns an Ogg page of a logical stream holding whole packets.
+func oggPage(serial uint32, sequence uint32, granule int64, packets ...[]byte) []byte {
+	var lacing, body []byte
+	for _, p := range packets {
+		for n := len(p); ; n -= 255 {
+			lacing = append(lacing, byte(min(n, 255)))
+			if n < 255 {
+				break
+			}
+		}
+		body = append(body, p...)
+	}
+	page := append([]byte("OggS"), 0, 0)
+	page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+	page = binary.LittleEndian.AppendUint32(page, serial)
+	page = binary.LittleEndian.AppendUint32(page, sequence)
+	page = binary.LittleEndian.AppendUint32(page, 0) // CRC, not checked
+	page = append(page, byte(len(lacing)))
+	page = append(page, lacing...)
+	return append(page, body...)
+}
+
+// opusPreSkip is the pre-skip of testOpus, in samples at opusRate.
+const opusPreSkip = 312
+
+// testOpus returns a 1 second Ogg/Opus file: 50 packets of 20 ms, quiet for the first half and loud for the second,
+// in pages of 10 packets. A page of another logical stream is in the middle. If granules is false, the pages have
+// no granule position.
+func testOpus(granules bool) []byte {
+	head := append([]byte("OpusHead"), 1, 1)
+	head = binary.LittleEndian.AppendUint16(head, opusPreSkip)
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	head = append(head, 0, 0, 0)
+
+	data := oggPage(1, 0, 0, head)
+	data = append(data, oggPage(1, 1, 0, append([]byte("OpusTags"), make([]byte, 8)...))...)
+	for page := 0; page < 5; page++ {
+		var packets [][]byte
+		for i := 0; i < 10; i++ {
+			size := 20
+			if page*10+i >= 25 {
+				size = 80
+			}
+			packet := make([]byte, size)
+			packet[0] = 1 << 3 // SILK 20 ms, one frame
+			packets = append(packets, packet)
+		}
+		granule := int64(-1)
+		if granules {
+			granule = int64(opusPreSkip + (page+1)*10*960)
+		}
+		data = append(data, oggPage(1, uint32(2+page), granule, packets...)...)
+		if page == 2 {
+			data = append(data, oggPage(2, 0, 0, []byte("another stream"))...)
+		}
+	}
+	return data
+}
+
+func TestProbeOpus(t *testing.T) {
+	info, err := probe(testOpus(true), "audio/ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Duration != time.Second {
+		t.Errorf("got a duration of %v, expected 1s", info.Duration)
+	}
+	if len(info.Waveform) != 50 || info.Waveform[0] != 25 || info.Waveform[49] != 100 {
+		t.Errorf("waveform: got %v, expected 25 for the first 25 packets and 100 for the others", info.Waveform)
+	}
+
+	// Without granule positions, the duration of the packets is used
+	info, err = probe(testOpus(false), "audio/ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Duration(48000-opusPreSkip) * time.Second / opusRate; info.Duration != expected {
+		t.Errorf("without granule positions: got a duration of %v, expected %v", info.Duration, expected)
+	}
+
+	// Packets of more than 255 bytes and packets of several frames
+	long := make([]byte, 600)
+	long[0] = 1<<3 | 3 // SILK 20 ms, frame count in the next byte
+	long[1] = 3
+	data := append(testOpus(false), oggPage(1, 7, -1, long)...)
+	info, err = probe(data, "audio/ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Duration(48000+3*960-opusPreSkip) * time.Second / opusRate; info.Duration != expected {
+		t.Errorf("with a long packet: got a duration of %v, expected %v", info.Duration, expected)
+	}
+}
+
+func TestProbeOpusInvalid(t *testing.T) {
+	// The headers and the first audio page are needed
+	headers := len(oggPage(1, 0, 0, make([]byte, 19))) + len(oggPage(1, 1, 0, make([]byte, 16)))
+	expectNotAudio(t, testOpus(true), "audio/ogg", headers+27+10+200)
+
+	vorbis := oggPage(1, 0, 0, append([]byte("\x01vorbis"), make([]byte, 23)...))
+	for name, data := range map[string][]byte{
+		"empty":          {},
+		"not Ogg":        []byte("RIFF\x00\x00\x00\x00WAVE"),
+		"bad version":    append([]byte("OggS\x01"), testOpus(true)[5:]...),
+		"Vorbis":         vorbis,
+		"short OpusHead": oggPage(1, 0, 0, []byte("OpusHead")),
+		"no audio":       testOpus(true)[:headers],
+	} {
+		if _, err := probe(data, "audio/ogg"); !errors.Is(err, ErrNotAudio) {
+			t.Errorf("%s: got %v, expected ErrNotAudio", name, err)
+		}
+	}
+}
+
+// mp3Header returns the header of an MPEG-1 layer III frame at 48 kHz, with the given bitrate index.
+func mp3Header(bitrateIndex byte) []byte {
+	return []byte{0xff, 0xfb, bitrateIndex<<4 | 1<<2, 0x00}
+}
+
+// testMP3 returns a 3 seconds MP3 file: 125 frames of 24 ms at 64 kbps (192 bytes) then 128 kbps (384 bytes), after
+// an ID3v2 tag and some padding, and followed by an ID3v1 tag.
+func testMP3() []byte {
+	data := []byte{'I', 'D', '3', 4, 0, 0, 0, 0, 1, 0} // 128 bytes tag (syncsafe size)
+	data = append(data, make([]byte, 128+10)...)       // and 10 bytes of padding before the first frame
+	for i := 0; i < 125; i++ {
+		frame := make([]byte, 192)
+		copy(frame, mp3Header(5))
+		if i >= 63 {
+			frame = make([]byte, 384)
+			copy(frame, mp3Header(9))
+		}
+		data = append(data, frame...)
+	}
+	return append(data, append([]byte("TAG"), make([]byte, 125)...)...)
+}
+
+func TestProbeMP3(t *testing.T) {
+	info, err := probe(testMP3(), "audio/mpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDuration(t, "MP3", info.Duration, 3*time.Second)
+	if len(info.Waveform) != WaveformBars || info.Waveform[0] != 50 || info.Waveform[WaveformBars-1] != 100 {
+		t.Errorf("waveform: got %v, expected 50 for 64 kbps and 100 for 128 kbps", info.Waveform)
+	}
+
+	// A truncated last frame is ignored
+	data := testMP3()
+	info, err = probe(data[:len(data)-128-100], "audio/mpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDuration(t, "truncated MP3", info.Duration, 3*time.Second-24*time.Millisecond)
+}
+
+func TestProbeMP3Invalid(t *testing.T) {
+	// The first frame is needed
+	expectNotAudio(t, testMP3(), "audio/mpeg", 10+128+10+192)
+
+	for name, data := range map[string][]byte{
+		"empty":             {},
+		"text":              []byte("not an MP3 file at all"),
+		"no frame":          make([]byte, mp3MaxSync+1024),
+		"tag past the end":  append([]byte{'I', 'D', '3', 4, 0, 0, 0x7f, 0x7f, 0x7f, 0x7f}, testMP3()[10:]...),
+		"layer II":          append([]byte{0xff, 0xfd, 0x94, 0x00}, make([]byte, 1024)...),
+		"free bitrate":      append([]byte{0xff, 0xfb, 0x04, 0x00}, make([]byte, 1024)...),
+		"reserved rate":     append([]byte{0xff, 0xfb, 0x9c, 0x00}, make([]byte, 1024)...),
+		"reserved version":  append([]byte{0xff, 0xeb, 0x94, 0x00}, make([]byte, 1024)...),
+		"invalid bitrate":   append([]byte{0xff, 0xfb, 0xf4, 0x00}, make([]byte, 1024)...),
+		"truncated 1 frame": append(mp3Header(9), make([]byte, 100)...),
+	} {
+		if _, err := probe(data, "audio/mpeg"); !errors.Is(err, ErrNotAudio) {
+			t.Errorf("%s: got %v, expected ErrNotAudio", name, err)
+		}
+	}
+}
+
+// box returns an MP4 box with the given payload.
+func box(kind string, payload ...[]byte) []byte {
+	data := joinBytes(payload...)
+	return append(append(binary.BigEndian.AppendUint32(nil, uint32(8+len(data))), kind...), data...)
+}
+
+func joinBytes(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func uint32s(values ...uint32) []byte {
+	var data []byte
+	for _, v := range values {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+	return data
+}
+
+// mp4Track returns a trak box with a handler, a time scale of 48 kHz, and 96 samples of 1000 units (2 seconds):
+// 48 samples of 100 bytes then 48 of 400 bytes.
+func mp4Track(handler string, duration uint32) []byte {
+	mdhd := box("mdhd", uint32s(0, 0, 0, 48000, duration), []byte{0x55, 0xc4, 0, 0})
+	hdlr := box("hdlr", uint32s(0, 0), []byte(handler), make([]byte, 12), []byte("Sound\x00"))
+	sizes := uint32s(0, 0, 96)
+	for i := 0; i < 96; i++ {
+		size := uint32(100)
+		if i >= 48 {
+			size = 400
+		}
+		sizes = binary.BigEndian.AppendUint32(sizes, size)
+	}
+	stbl := box("stbl", box("stts", uint32s(0, 1, 96, 1000)), box("stsz", sizes))
+	return box("trak", box("mdia", mdhd, hdlr, box("minf", box("smhd", make([]byte, 8)), stbl)))
+}
+
+// testM4A returns a 2 seconds M4A file with the given tracks.
+func testM4A(tracks ...[]byte) []byte {
+	ftyp := box("ftyp", []byte("M4A "), uint32s(0), []byte("M4A isom"))
+	moov := box("moov", append([][]byte{box("mvhd", make([]byte, 100))}, tracks...)...)
+	return joinBytes(ftyp, moov, box("mdat", make([]byte, 48*100+48*400)))
+}
+
+func TestProbeMP4(t *testing.T) {
+	info, err := probe(testM4A(mp4Track("soun", 96000)), "audio/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Duration != 2*time.Second {
+		t.Errorf("got a duration of %v, expected 2s", info.Duration)
+	}
+	if len(info.Waveform) != WaveformBars || info.Waveform[0] != 25 || info.Waveform[WaveformBars-1] != 100 {
+		t.Errorf("waveform: got %v, expected 25 for the first half and 100 for the second", info.Waveform)
+	}
+
+	// Without a duration in the header, the samples are summed; other tracks are ignored
+	info, err = probe(testM4A(box("trak", box("mdia", box("hdlr", uint32s(0, 0), []byte("text")))),
+		mp4Track("soun", 0)), "audio/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Duration != 2*time.Second {
+		t.Errorf("without a duration: got %v, expected 2s", info.Duration)
+	}
+}
+
+func TestProbeMP4Invalid(t *testing.T) {
+	// The moov box is needed, the mdat box is not read
+	track := mp4Track("soun", 96000)
+	data := testM4A(track)
+	expectNotAudio(t, data, "audio/mp4", len(data)-len(box("mdat", make([]byte, 48*100+48*400))))
+
+	replace := func(old string, new []byte) []byte {
+		return bytes.Replace(track, []byte(old), new, 1)
+	}
+	for name, data := range map[string][]byte{
+		"empty":           {},
+		"no moov":         box("ftyp", []byte("M4A ")),
+		"box too large":   append(uint32s(1000), "moov"...),
+		"box too small":   append(uint32s(4), "moov"...),
+		"no track":        testM4A(),
+		"video track":     testM4A(track, mp4Track("vide", 96000)),
+		"zero time scale": testM4A(replace("\x00\x00\xbb\x80", uint32s(0))),
+		"mdhd version":    testM4A(bytes.Replace(track, []byte("mdhd\x00"), []byte("mdhd\x02"), 1)),
+		"no sample sizes": testM4A(replace("stsz", []byte("free"))),
+		"no durations":    testM4A(replace("stts", []byte("free"))),
+		"sample count":    testM4A(replace("\x00\x00\x00\x60\x00\x00\x00\x64", uint32s(1<<30, 100))),
+		"stts entries":    testM4A(replace("\x00\x00\x00\x01\x00\x00\x00\x60", uint32s(1<<30, 96))),
+	} {
+		if _, err := probe(data, "audio/mp4"); !errors.Is(err, ErrNotAudio) {
+			t.Errorf("%s: got %v, expected ErrNotAudio", name, err)
+		}
+	}
+
+	if _, err := probe(testMP3(), "audio/wav"); !errors.Is(err, ErrNotAudio) {
+		t.Errorf("unsupported type: got %v, expected ErrNotAudio", err)
+	}
+}
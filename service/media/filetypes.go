@@ -0,0 +1,108 @@
+package media
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Container formats, refined by containerTypes.
+const (
+	zipType = "application/zip"
+	oleType = "application/x-ole-storage"
+)
+
+// fileSignatures are the magic numbers of the documents, archives and executables, checked after the signatures of
+// Sniff.
+var fileSignatures = []signature{
+	{mimeType: "application/pdf", magic: []byte("%PDF-")},
+	{mimeType: zipType, magic: []byte("PK\x03\x04")},
+	{mimeType: zipType, magic: []byte("PK\x05\x06")}, // empty archive
+	{mimeType: oleType, magic: []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}},
+	{mimeType: "application/gzip", magic: []byte{0x1f, 0x8b}},
+	{mimeType: "application/x-7z-compressed", magic: []byte("7z\xbc\xaf\x27\x1c")},
+	{mimeType: "application/vnd.rar", magic: []byte("Rar!\x1a\x07")},
+	{mimeType: "application/rtf", magic: []byte(`{\rtf`)},
+	{mimeType: "application/postscript", magic: []byte("%!PS")},
+	{mimeType: "application/x-msdownload", magic: []byte("MZ")},
+	{mimeType: "application/x-executable", magic: []byte("\x7fELF")},
+	{mimeType: "application/x-mach-binary", magic: []byte{0xcf, 0xfa, 0xed, 0xfe}},
+	{mimeType: "application/x-sh", magic: []byte("#!")},
+}
+
+// containerTypes are the formats stored in a ZIP archive or an OLE compound file, told apart by their extension.
+var containerTypes = map[string]map[string]string{
+	zipType: {
+		".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		".odt":  "application/vnd.oasis.opendocument.text",
+		".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+		".odp":  "application/vnd.oasis.opendocument.presentation",
+		".epub": "application/epub+zip",
+		".jar":  "application/java-archive",
+		".apk":  "application/vnd.android.package-archive",
+	},
+	oleType: {
+		".doc": "application/msword",
+		".xls": "application/vnd.ms-excel",
+		".ppt": "application/vnd.ms-powerpoint",
+		".msi": "application/x-msi",
+	},
+}
+
+// textTypes are the text formats told apart by their extension.
+var textTypes = map[string]string{
+	".csv":  "text/csv",
+	".md":   "text/markdown",
+	".json": "application/json",
+	".svg":  "image/svg+xml",
+}
+
+// DetectType returns the MIME type of any file given its first bytes (up to SniffLen). The name of the file is only
+// used to tell apart the formats that look the same (e.g., DOCX and XLSX are both ZIP archives, CSV is plain text):
+// content that doesn't match a name is detected as what it is. Unknown binary content is "application/octet-stream".
+func DetectType(head []byte, name string) string {
+	if mimeType := Sniff(head); mimeType != "" {
+		return mimeType
+	}
+	ext := strings.ToLower(path.Ext(name))
+	for _, sig := range fileSignatures {
+		if bytes.HasPrefix(head, sig.magic) {
+			if refined, ok := containerTypes[sig.mimeType][ext]; ok {
+				return refined
+			}
+			return sig.mimeType
+		}
+	}
+
+	mimeType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	if mimeType == "text/plain" || mimeType == "text/xml" {
+		if refined, ok := textTypes[ext]; ok {
+			return refined
+		}
+	}
+	return mimeType
+}
+
+// MatchType returns true if mimeType matches one of the patterns: a MIME type, "type/*" or "*".
+func MatchType(mimeType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "*" || pattern == "*/*" || pattern == mimeType:
+			return true
+		case strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*")):
+			return true
+		case strings.HasSuffix(pattern, ".*") && strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*")):
+			// e.g. "application/vnd.openxmlformats-officedocument.*"
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+)
+
+// JPEG markers used by StripJPEGMetadata.
+const (
+	markerSOI  = 0xd8
+	markerEOI  = 0xd9
+	markerSOS  = 0xda
+	markerAPP1 = 0xe1
+
+	// APP13 holds Photoshop resources, including IPTC metadata
+	markerAPP13 = 0xed
+)
+
+// Identifiers at the start of the APP1 segments.
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/")
+)
+
+// exifOrientationTag is the EXIF tag of the orientation of the camera, which viewers apply when showing the image.
+const exifOrientationTag = 0x0112
+
+// errInvalidJPEG is returned by StripJPEGMetadata when the segments of the file can't be parsed.
+var errInvalidJPEG = fmt.Errorf("%w: invalid JPEG structure", ErrNotImage)
+
+// StripJPEGMetadata copies a JPEG file from src to dst without its EXIF, XMP and IPTC metadata, which can include
+// the GPS location, the camera serial number, etc. The EXIF orientation is kept (alone in a minimal EXIF segment),
+// otherwise photos taken with a rotated camera would be shown sideways. The compressed image data is copied as it is:
+// the image is not re-encoded.
+func StripJPEGMetadata(dst io.Writer, src io.Reader) error {
+	r := bufio.NewReader(src)
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi[0] != 0xff || soi[1] != markerSOI {
+		return errInvalidJPEG
+	}
+	if _, err := dst.Write(soi[:]); err != nil {
+		return err
+	}
+
+	for {
+		marker, err := readMarker(r)
+		if err != nil {
+			return err
+		}
+		if marker == markerEOI {
+			_, err := dst.Write([]byte{0xff, marker})
+			return err
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			// TEM and RSTn have no payload
+			if _, err := dst.Write([]byte{0xff, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return errInvalidJPEG
+		}
+		size := int(binary.BigEndian.Uint16(length[:]))
+		if size < 2 {
+			return errInvalidJPEG
+		}
+		payload := make([]byte, size-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return errInvalidJPEG
+		}
+
+		switch {
+		case marker == markerAPP1 && bytes.HasPrefix(payload, exifHeader):
+			// Keep the orientation only
+			if orientation := exifOrientation(payload); orientation > 1 {
+				payload = minimalExif(orientation)
+			} else {
+				continue
+			}
+		case marker == markerAPP1 && bytes.HasPrefix(payload, xmpHeader), marker == markerAPP13:
+			continue
+		}
+
+		if err := writeSegment(dst, marker, payload); err != nil {
+			return err
+		}
+		if marker == markerSOS {
+			// The entropy-coded data follows, up to EOI: nothing else to strip
+			_, err := io.Copy(dst, r)
+			return err
+		}
+	}
+}
+
+// readMarker reads the next marker, skipping the fill bytes.
+func readMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil || b != 0xff {
+		return 0, errInvalidJPEG
+	}
+	for b == 0xff {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, errInvalidJPEG
+		}
+	}
+	return b, nil
+}
+
+func writeSegment(w io.Writer, marker byte, payload []byte) error {
+	if len(payload)+2 > 0xffff {
+		return fmt.Errorf("JPEG segment too large: %d bytes", len(payload))
+	}
+	header := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(payload)+2))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// exifOrientation returns the orientation (1 to 8) recorded in the IFD0 of an APP1 EXIF payload, or 0 if there is
+// none.
+func exifOrientation(payload []byte) int {
+	tiff := payload[len(exifHeader):]
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 0
+			}
+			return orientation
+		}
+	}
+	return 0
+}
+
+// minimalExif returns an APP1 EXIF payload holding the orientation only.
+func minimalExif(orientation int) []byte {
+	payload := append([]byte(nil), exifHeader...)
+	return append(payload,
+		'M', 'M', 0x00, 0x2a, // big endian TIFF header
+		0x00, 0x00, 0x00, 0x08, // offset of IFD0
+		0x00, 0x01, // one entry
+		0x01, 0x12, 0x00, 0x03, // orientation, SHORT
+		0x00, 0x00, 0x00, 0x01, // one value
+		0x00, byte(orientation), 0x00, 0x00, // the value, padded to 4 bytes
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+	)
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG file, or 0 if it has none.
+func jpegOrientation(data []byte) int {
+	r := bufio.NewReader(bytes.NewReader(data))
+	if _, err := r.Discard(2); err != nil {
+		return 0
+	}
+	for {
+		marker, err := readMarker(r)
+		if err != nil || marker == markerSOS || marker == markerEOI {
+			return 0
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return 0
+		}
+		size := int(binary.BigEndian.Uint16(length[:]))
+		if size < 2 {
+			return 0
+		}
+		payload := make([]byte, size-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return 0
+		}
+		if marker == markerAPP1 && bytes.HasPrefix(payload, exifHeader) {
+			return exifOrientation(payload)
+		}
+	}
+}
+
+// orient applies an EXIF orientation to img, so that it's shown upright without the EXIF data (as in the variants).
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	transposed := orientation >= 5
+	dw, dh := w, h
+	if transposed {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // mirrored along the top-left diagonal
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // mirrored along the top-right diagonal
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counterclockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,207 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// secret is written in every metadata segment of testJPEG: it must not be found in the stripped file.
+const secret = "45.4642N 9.1900E SN-123456"
+
+// testJPEG returns a 16x8 JPEG image with the metadata of a phone camera: an EXIF segment with the orientation
+// (6, rotated 90°) and a GPS IFD, an XMP segment and an APP13 (IPTC) segment. A COM segment is kept by
+// StripJPEGMetadata, to check that the other segments are copied.
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 8; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(16 * x), G: uint8(32 * y), B: 128, A: 255})
+		}
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:2]) // SOI
+	writeTestSegment(t, &out, markerAPP1, testExif(6))
+	writeTestSegment(t, &out, markerAPP1, append([]byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>"), secret...))
+	writeTestSegment(t, &out, markerAPP13, append([]byte("Photoshop 3.0\x008BIM"), secret...))
+	writeTestSegment(t, &out, 0xfe, []byte("kept comment"))
+	out.Write(encoded.Bytes()[2:])
+	return out.Bytes()
+}
+
+// testExif returns an APP1 EXIF payload (little endian) with the orientation and a GPS IFD holding secret.
+func testExif(orientation int) []byte {
+	le := binary.LittleEndian
+	tiff := []byte{'I', 'I', 0x2a, 0x00, 8, 0, 0, 0}
+
+	// IFD0: orientation and GPS IFD pointer, then the GPS IFD with GPSMapDatum (ASCII, stored after the IFD)
+	ifd0 := make([]byte, 2+2*12+4)
+	le.PutUint16(ifd0, 2)
+	le.PutUint16(ifd0[2:], 0x8825) // GPSInfo, LONG
+	le.PutUint16(ifd0[4:], 4)
+	le.PutUint32(ifd0[6:], 1)
+	gpsOffset := uint32(len(tiff) + len(ifd0))
+	le.PutUint32(ifd0[10:], gpsOffset)
+	le.PutUint16(ifd0[14:], exifOrientationTag) // Orientation, SHORT
+	le.PutUint16(ifd0[16:], 3)
+	le.PutUint32(ifd0[18:], 1)
+	le.PutUint16(ifd0[22:], uint16(orientation))
+
+	gps := make([]byte, 2+12+4)
+	le.PutUint16(gps, 1)
+	le.PutUint16(gps[2:], 0x0012) // GPSMapDatum, ASCII
+	le.PutUint16(gps[4:], 2)
+	le.PutUint32(gps[6:], uint32(len(secret)+1))
+	le.PutUint32(gps[10:], gpsOffset+uint32(len(gps)))
+
+	payload := append([]byte(nil), exifHeader...)
+	payload = append(payload, tiff...)
+	payload = append(payload, ifd0...)
+	payload = append(payload, gps...)
+	payload = append(payload, secret...)
+	return append(payload, 0)
+}
+
+func writeTestSegment(t *testing.T, buf *bytes.Buffer, marker byte, payload []byte) {
+	t.Helper()
+	if err := writeSegment(buf, marker, payload); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// segments returns the markers and the payloads of the segments of a JPEG file, up to the start of scan.
+func segments(t *testing.T, data []byte) (markers []byte, payloads [][]byte) {
+	t.Helper()
+	for i := 2; i+4 <= len(data); {
+		marker := data[i+1]
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		markers = append(markers, marker)
+		payloads = append(payloads, data[i+4:i+2+size])
+		if marker == markerSOS {
+			break
+		}
+		i += 2 + size
+	}
+	return markers, payloads
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	original := testJPEG(t)
+	if bytes.Count(original, []byte(secret)) != 3 {
+		t.Fatal("the fixture doesn't have the metadata")
+	}
+	if jpegOrientation(original) != 6 {
+		t.Fatalf("orientation of the fixture: got %d, expected 6", jpegOrientation(original))
+	}
+
+	var stripped bytes.Buffer
+	if err := StripJPEGMetadata(&stripped, bytes.NewReader(original)); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stripped.Bytes(), []byte(secret)) {
+		t.Error("the metadata are still in the stripped file")
+	}
+
+	markers, payloads := segments(t, stripped.Bytes())
+	var exif int
+	for i, marker := range markers {
+		switch {
+		case marker == markerAPP13:
+			t.Error("APP13 segment not removed")
+		case marker == markerAPP1 && bytes.HasPrefix(payloads[i], xmpHeader):
+			t.Error("XMP segment not removed")
+		case marker == markerAPP1:
+			exif++
+			if !bytes.Equal(payloads[i], minimalExif(6)) {
+				t.Errorf("EXIF segment: got %q, expected the orientation only", payloads[i])
+			}
+		case marker == 0xfe && string(payloads[i]) != "kept comment":
+			t.Errorf("comment: got %q", payloads[i])
+		}
+	}
+	if exif != 1 {
+		t.Errorf("got %d EXIF segments, expected 1", exif)
+	}
+	if jpegOrientation(stripped.Bytes()) != 6 {
+		t.Errorf("orientation: got %d, expected 6", jpegOrientation(stripped.Bytes()))
+	}
+
+	// The image data is copied as it is
+	img, err := jpeg.Decode(bytes.NewReader(stripped.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 16 || img.Bounds().Dy() != 8 {
+		t.Errorf("size: got %v", img.Bounds())
+	}
+	if !bytes.HasSuffix(original, stripped.Bytes()[len(stripped.Bytes())-100:]) {
+		t.Error("the image data changed")
+	}
+}
+
+func TestStripJPEGMetadataWithoutOrientation(t *testing.T) {
+	var src bytes.Buffer
+	src.Write([]byte{0xff, markerSOI})
+	writeTestSegment(t, &src, markerAPP1, testExif(1))
+	src.Write([]byte{0xff, markerEOI})
+
+	var stripped bytes.Buffer
+	if err := StripJPEGMetadata(&stripped, bytes.NewReader(src.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped.Bytes(), []byte{0xff, markerSOI, 0xff, markerEOI}) {
+		t.Errorf("got %x, expected no EXIF segment for the default orientation", stripped.Bytes())
+	}
+}
+
+func TestStripJPEGMetadataInvalid(t *testing.T) {
+	original := testJPEG(t)
+	markers, payloads := segments(t, original)
+	headerEnd := 2
+	for i := range markers {
+		headerEnd += 4 + len(payloads[i])
+	}
+
+	// Files cut anywhere before the image data are rejected; after, the data is copied as it is. None panics.
+	for n := 0; n < len(original); n++ {
+		err := StripJPEGMetadata(&bytes.Buffer{}, bytes.NewReader(original[:n]))
+		if n < headerEnd && !errors.Is(err, ErrNotImage) {
+			t.Fatalf("cut at %d bytes: got %v, expected ErrNotImage", n, err)
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"not a JPEG":        []byte("GIF89a"),
+		"no marker":         {0xff, markerSOI, 0x00, 0x01},
+		"short length":      {0xff, markerSOI, 0xff, markerAPP1, 0x00, 0x01},
+		"length past end":   {0xff, markerSOI, 0xff, markerAPP1, 0xff, 0xff, 'E', 'x'},
+		"only fill bytes":   {0xff, markerSOI, 0xff, 0xff, 0xff},
+		"EXIF without TIFF": append([]byte{0xff, markerSOI, 0xff, markerAPP1, 0x00, 0x08}, exifHeader...),
+	} {
+		err := StripJPEGMetadata(&bytes.Buffer{}, bytes.NewReader(data))
+		if !errors.Is(err, ErrNotImage) {
+			t.Errorf("%s: got %v, expected ErrNotImage", name, err)
+		}
+	}
+
+	// Broken EXIF data is dropped, not trusted
+	for name, tiff := range map[string][]byte{
+		"bad byte order": {'X', 'X', 0x2a, 0, 8, 0, 0, 0},
+		"IFD past end":   {'I', 'I', 0x2a, 0, 0xff, 0xff, 0, 0},
+		"too many tags":  {'I', 'I', 0x2a, 0, 8, 0, 0, 0, 0xff, 0xff, 0x12, 0x01},
+	} {
+		if got := exifOrientation(append(append([]byte(nil), exifHeader...), tiff...)); got != 0 {
+			t.Errorf("%s: got orientation %d, expected 0", name, got)
+		}
+	}
+}
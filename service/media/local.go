@@ -0,0 +1,119 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// LocalStore saves the files in a directory of the local filesystem, one file per key.
+type LocalStore struct {
+	dir string
+}
+
+// NewLocalStore returns a LocalStore saving the files in dir, which is created if needed.
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating media directory: %w", err)
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+func (s *LocalStore) path(key string) (string, error) {
+	if !ValidKey(key) {
+		return "", fmt.Errorf("invalid media key %q", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+// Put writes the file to a temporary name first, and renames it when complete: a reader never sees a partial file.
+func (s *LocalStore) Put(_ context.Context, key string, r io.Reader, _ int64, _ string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get returns an *os.File, which can be used with http.ServeContent.
+func (s *LocalStore) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (s *LocalStore) Exists(_ context.Context, key string) (bool, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalStore) Delete(_ context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// List skips the temporary files of Put and anything that is not a valid key.
+func (s *LocalStore) List(ctx context.Context, fn func(Info) error) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || !ValidKey(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue // deleted since ReadDir
+		} else if err != nil {
+			return err
+		}
+		if err := fn(Info{Key: entry.Name(), Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
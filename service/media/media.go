@@ -0,0 +1,177 @@
+/*
+Package media stores the files uploaded by the users (photos, GIFs, voice notes, ...) in a pluggable Store.
+
+Files are content addressed: the key of a file is the hex-encoded SHA-256 of its content, followed by an extension
+matching its MIME type (e.g., "9f86d0...0a08.jpg"). Uploading the same content twice stores it once, and keys never
+collide or change, so they can be cached forever.
+
+Two stores are available: LocalStore keeps the files in a directory of the local filesystem, S3Store in a bucket of an
+S3-compatible object storage (AWS S3, MinIO, ...).
+
+Example:
+
+	store, err := media.NewLocalStore("webui/public/uploads")
+	if err != nil {
+		return err
+	}
+	obj, err := media.Ingest(ctx, store, file, "image/png", nil)
+	if err != nil {
+		return err
+	}
+	url := "/uploads/" + obj.Key
+*/
+package media
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Store.Get when there is no file with the given key.
+var ErrNotFound = errors.New("media not found")
+
+// Store is where the files are saved. Keys are plain file names (no slashes), see ValidKey.
+type Store interface {
+	// Put saves size bytes read from r with the given key, replacing any file with the same key
+	Put(ctx context.Context, key string, r io.Reader, size int64, mimeType string) error
+
+	// Get opens the file with the given key. It returns ErrNotFound if there is no such file. If the returned reader
+	// is also an io.Seeker, it can be served with http.ServeContent.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Exists returns true if there is a file with the given key
+	Exists(ctx context.Context, key string) (bool, error)
+
+	// Delete removes the file with the given key. Deleting a missing file is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// List calls fn for every file of the store, in no particular order, and stops at the first error of fn
+	List(ctx context.Context, fn func(Info) error) error
+}
+
+// Info describes a file of a Store, as returned by List.
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Object describes a file saved by Ingest.
+type Object struct {
+	Key      string
+	SHA256   string
+	Size     int64
+	MIMEType string
+}
+
+// extensions maps the MIME types to the extension used in the keys. Other types get no extension.
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"audio/ogg":  ".ogg",
+	"audio/mpeg": ".mp3",
+	"audio/mp4":  ".m4a",
+}
+
+// TypeByKey returns the MIME type of the file with the given key, or "" if it's unknown. The types of the content
+// addressed keys don't depend on the MIME database of the system (which may not know .opus or .m4a).
+func TypeByKey(key string) string {
+	ext := path.Ext(key)
+	for mimeType, e := range extensions {
+		if e == ext {
+			return mimeType
+		}
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// validKey matches the keys accepted by the stores: a single path element, without "..".
+var validKey = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// ValidKey returns true if key can be used with a Store. Besides content addressed keys, it accepts the names of the
+// files uploaded before the media store existed.
+func ValidKey(key string) bool {
+	return validKey.MatchString(key) && !strings.Contains(key, "..")
+}
+
+// KeyFor returns the key of a file with the given hex-encoded SHA-256 and MIME type.
+func KeyFor(sum string, mimeType string) string {
+	return sum + extensions[mimeType]
+}
+
+// Ingest saves the content of r in the store, unless a file with the same content and type is already there. The
+// content is spooled to a temporary file while it is hashed, as the key is only known at the end. The metadata of JPEG
+// files is stripped first (see StripJPEGMetadata), so the key is the hash of the content as it's stored. If accept is
+// not nil, it's called with the object before it's saved: its error is returned, and the content is not saved.
+func Ingest(ctx context.Context, store Store, r io.Reader, mimeType string, accept func(Object) error) (Object, error) {
+	tmp, err := os.CreateTemp("", "media-*")
+	if err != nil {
+		return Object{}, fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	dst := io.MultiWriter(tmp, hash, counter)
+	if mimeType == "image/jpeg" {
+		err = StripJPEGMetadata(dst, r)
+	} else {
+		_, err = io.Copy(dst, r)
+	}
+	if err != nil {
+		return Object{}, fmt.Errorf("reading upload: %w", err)
+	}
+	size := counter.n
+	sum := hex.EncodeToString(hash.Sum(nil))
+	obj := Object{
+		Key:      KeyFor(sum, mimeType),
+		SHA256:   sum,
+		Size:     size,
+		MIMEType: mimeType,
+	}
+	if accept != nil {
+		if err := accept(obj); err != nil {
+			return Object{}, err
+		}
+	}
+
+	exists, err := store.Exists(ctx, obj.Key)
+	if err != nil {
+		return Object{}, fmt.Errorf("checking %s: %w", obj.Key, err)
+	}
+	if exists {
+		return obj, nil
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return Object{}, fmt.Errorf("rewinding temporary file: %w", err)
+	}
+	if err := store.Put(ctx, obj.Key, tmp, size, mimeType); err != nil {
+		return Object{}, fmt.Errorf("saving %s: %w", obj.Key, err)
+	}
+	return obj, nil
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,406 @@
+package media
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the hex-encoded SHA-256 of an empty payload, signed for the requests without a body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config holds the connection parameters of an S3-compatible object storage.
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000"
+	// for a local MinIO
+	Endpoint string
+
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+
+	// PathStyle puts the bucket in the path (endpoint/bucket/key) instead of the host name (bucket.endpoint/key).
+	// MinIO needs it.
+	PathStyle bool
+}
+
+// S3Store saves the files as objects of an S3 bucket. Requests are signed with AWS Signature Version 4.
+type S3Store struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+
+	// now returns the signing time; it's a field so that the signature can be checked against known values
+	now func() time.Time
+}
+
+// NewS3Store returns an S3Store for the bucket described by cfg. The bucket must already exist.
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" || cfg.Region == "" {
+		return nil, errors.New("S3 bucket and region are required")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("S3 access key and secret key are required")
+	}
+	return &S3Store{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Transport: newS3Transport()},
+		now:      time.Now,
+	}, nil
+}
+
+// newS3Transport returns the transport of the requests to the storage. The timeouts only bound the connection and the
+// wait for the response headers: a body may be streamed to a slow client for as long as it takes, so the client has
+// no overall timeout.
+func newS3Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	transport.ResponseHeaderTimeout = 60 * time.Second
+	transport.IdleConnTimeout = 90 * time.Second
+	return transport
+}
+
+// objectURL returns the URL of the object with the given key, or of the bucket if key is empty.
+func (s *S3Store) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+	if s.cfg.PathStyle {
+		u.Path = base + "/" + s.cfg.Bucket + "/" + key
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = base + "/" + key
+	}
+	u.RawPath = ""
+	return &u
+}
+
+// do signs and sends a request for the object with the given key.
+func (s *S3Store) do(ctx context.Context, method string, key string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	if !ValidKey(key) {
+		return nil, fmt.Errorf("invalid media key %q", key)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := emptySHA256
+	if body != nil {
+		// The content is hashed by Ingest already, but a Store can't assume it
+		req.ContentLength = size
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+	s.sign(req, payloadHash)
+	return s.client.Do(req)
+}
+
+// sign adds the AWS Signature Version 4 headers to req. See
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3Store) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Canonical headers: host and every x-amz-* header, lowercase and sorted
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), day)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode percent-encodes every byte except the unreserved characters (and "/" unless encodeSlash is set), as
+// required by the signature.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// responseError builds the error of an unexpected response, including the beginning of the body: S3 explains the
+// error there.
+func responseError(method string, key string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64, mimeType string) error {
+	header := http.Header{}
+	if mimeType != "" {
+		header.Set("Content-Type", mimeType)
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, r, size, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return responseError(http.MethodPut, key, resp)
+	}
+	return nil
+}
+
+// Get returns an io.ReadSeeker: seeking is done with ranged requests, so the objects can be served with
+// http.ServeContent (and range requests) like the local files.
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.getRange(ctx, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength < 0 {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("s3 GET %s: unknown content length", key)
+	}
+	return &s3Object{store: s, ctx: ctx, key: key, size: resp.ContentLength, body: resp.Body}, nil
+}
+
+// getRange requests the content of an object from offset to the end.
+func (s *S3Store) getRange(ctx context.Context, key string, offset int64) (*http.Response, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": []string{fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, nil, 0, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		_ = resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, responseError(http.MethodGet, key, resp)
+	}
+	return resp, nil
+}
+
+// s3Object reads an object of an S3Store. The body of the last request is read as long as the reads are sequential;
+// after a seek, the content is requested again from the new offset.
+type s3Object struct {
+	store *S3Store
+	ctx   context.Context
+	key   string
+	size  int64
+
+	// offset is the position of the next read, bodyOffset the position of body (nil when there is no open request)
+	offset     int64
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body != nil && o.bodyOffset != o.offset {
+		_ = o.body.Close()
+		o.body = nil
+	}
+	if o.body == nil {
+		resp, err := o.store.getRange(o.ctx, o.key, o.offset)
+		if err != nil {
+			return 0, err
+		}
+		o.body, o.bodyOffset = resp.Body, o.offset
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	o.bodyOffset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("s3 object: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("s3 object: negative position")
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+func (s *S3Store) Exists(ctx context.Context, key string) (bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, 0, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode/100 == 2:
+		return true, nil
+	}
+	return false, fmt.Errorf("s3 HEAD %s: %s", key, resp.Status)
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return responseError(http.MethodDelete, key, resp)
+	}
+	return nil
+}
+
+// listResult is the response of ListObjectsV2, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjectsV2.html
+type listResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List pages through the objects of the bucket with ListObjectsV2. Objects whose name is not a valid key (e.g., in
+// "folders") are skipped.
+func (s *S3Store) List(ctx context.Context, fn func(Info) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := s.objectURL("")
+		u.RawQuery = canonicalQuery(query)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		s.sign(req, emptySHA256)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode/100 != 2 {
+			err = responseError(http.MethodGet, "?list-type=2", resp)
+			_ = resp.Body.Close()
+			return err
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3 list: %w", err)
+		}
+
+		for _, object := range result.Contents {
+			if !ValidKey(object.Key) {
+				continue
+			}
+			if err := fn(Info{Key: object.Key, Size: object.Size, ModTime: object.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
@@ -0,0 +1,44 @@
+package media
+
+import (
+	"bytes"
+)
+
+// SniffLen is the number of bytes at the start of a file that Sniff needs.
+const SniffLen = 512
+
+// signature is the magic number of the files of a MIME type, found at offset.
+type signature struct {
+	mimeType string
+	offset   int
+	magic    []byte
+}
+
+var signatures = []signature{
+	{mimeType: "image/jpeg", magic: []byte{0xff, 0xd8, 0xff}},
+	{mimeType: "image/png", magic: []byte("\x89PNG\r\n\x1a\n")},
+	{mimeType: "image/gif", magic: []byte("GIF87a")},
+	{mimeType: "image/gif", magic: []byte("GIF89a")},
+	{mimeType: "audio/ogg", magic: []byte("OggS\x00")},
+	{mimeType: "audio/mpeg", magic: []byte("ID3")},
+	// The first box of an MP4 file; ProbeAudio checks that it has sound only
+	{mimeType: "audio/mp4", offset: 4, magic: []byte("ftyp")},
+}
+
+// Sniff returns the MIME type of a file given its first bytes (up to SniffLen), or "" if it's not one of the types
+// that can be uploaded. Unlike http.DetectContentType, only the magic numbers are checked: names and extensions chosen
+// by the client are never trusted.
+func Sniff(head []byte) string {
+	for _, sig := range signatures {
+		if len(head) >= sig.offset && bytes.HasPrefix(head[sig.offset:], sig.magic) {
+			return sig.mimeType
+		}
+	}
+	// MP3 files without an ID3v2 tag start with a frame
+	if len(head) >= 4 {
+		if size, _, _ := mp3Frame(head); size > 0 {
+			return "audio/mpeg"
+		}
+	}
+	return ""
+}
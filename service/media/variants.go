@@ -0,0 +1,156 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // GIF decoder, for image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// VariantSpec is a resized variant of the uploaded images: the image is scaled down (never up) to fit in a Size x
+// Size box, keeping its aspect ratio.
+type VariantSpec struct {
+	Name string
+	Size int
+}
+
+// VariantSpecs lists the variants made for every uploaded image. Sizes are twice the usual display size, for high
+// density screens.
+var VariantSpecs = []VariantSpec{
+	{Name: "avatar", Size: 128},
+	{Name: "thumbnail", Size: 320},
+	{Name: "preview", Size: 1024},
+}
+
+// PosterVariant is the name of the static first frame of a GIF, at its original size.
+const PosterVariant = "poster"
+
+// maxVariantPixels caps the size of the images that are decoded to make variants, as the decoded image is held in
+// memory (4 bytes per pixel).
+const maxVariantPixels = 40_000_000
+
+// jpegQuality is the quality of the JPEG variants.
+const jpegQuality = 85
+
+// ErrNotImage is returned by MakeVariants when the content can't be decoded as an image of the given type.
+var ErrNotImage = errors.New("not a valid image")
+
+// Variant is a resized copy of an image, saved in the store with Key.
+type Variant struct {
+	Name     string
+	Key      string
+	Width    int
+	Height   int
+	MIMEType string
+}
+
+// VariantKey returns the key of the variant name of original, encoded as mimeType. Keys are derived from the content
+// of the original, so they never change either.
+func VariantKey(original Object, name string, mimeType string) string {
+	return original.SHA256 + "-" + name + extensions[mimeType]
+}
+
+// MakeVariants decodes the image read from r (the content of original) and saves its resized variants in the store.
+// JPEG images get JPEG variants, turned upright according to their EXIF orientation; PNG images get PNG variants, to
+// keep transparency. GIFs get a PosterVariant, and their resized variants are static PNG images too.
+func MakeVariants(ctx context.Context, store Store, original Object, r io.Reader) ([]Variant, error) {
+	// Uploads are small enough (see the size limits of the API) to be read in memory
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotImage, err)
+	}
+	if "image/"+format != original.MIMEType {
+		return nil, fmt.Errorf("%w: %s content with %s type", ErrNotImage, format, original.MIMEType)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxVariantPixels {
+		return nil, fmt.Errorf("%w: unsupported size %dx%d", ErrNotImage, config.Width, config.Height)
+	}
+
+	// image.Decode keeps the first frame of a GIF
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotImage, err)
+	}
+	if original.MIMEType == "image/jpeg" {
+		img = orient(img, jpegOrientation(data))
+	}
+
+	mimeType := original.MIMEType
+	if mimeType == "image/gif" {
+		mimeType = "image/png"
+	}
+
+	var variants []Variant
+	if original.MIMEType == "image/gif" {
+		poster, err := saveVariant(ctx, store, original, PosterVariant, img, mimeType)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, poster)
+	}
+	for _, spec := range VariantSpecs {
+		variant, err := saveVariant(ctx, store, original, spec.Name, fit(img, spec.Size), mimeType)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, variant)
+	}
+	return variants, nil
+}
+
+// fit scales img down to fit in a size x size box. Images that already fit are returned as they are.
+func fit(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return img
+	}
+	if width >= height {
+		width, height = size, max(1, height*size/width)
+	} else {
+		width, height = max(1, width*size/height), size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// saveVariant encodes img as mimeType and saves it as the variant name of original.
+func saveVariant(ctx context.Context, store Store, original Object, name string, img image.Image, mimeType string) (Variant, error) {
+	var buf bytes.Buffer
+	var err error
+	switch mimeType {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	case "image/png":
+		err = png.Encode(&buf, img)
+	default:
+		err = fmt.Errorf("can't encode %s variants", mimeType)
+	}
+	if err != nil {
+		return Variant{}, fmt.Errorf("encoding %s variant: %w", name, err)
+	}
+
+	variant := Variant{
+		Name:     name,
+		Key:      VariantKey(original, name, mimeType),
+		Width:    img.Bounds().Dx(),
+		Height:   img.Bounds().Dy(),
+		MIMEType: mimeType,
+	}
+	if err := store.Put(ctx, variant.Key, &buf, int64(buf.Len()), mimeType); err != nil {
+		return Variant{}, fmt.Errorf("saving %s variant: %w", name, err)
+	}
+	return variant, nil
+}